@@ -11,6 +11,7 @@ package UDPush
 import (
 	"fmt"
 	"net"
+	"sync"
 )
 
 // Constants
@@ -46,6 +47,9 @@ type Pusher struct {
 	BindedTo uint
 	Watchers map[string]Watcher
 	Pending  bool
+	// mu guards Watchers, which connections are attached to while
+	// requests notify or detach them
+	mu sync.Mutex
 }
 
 // Watcher Struct that satisfies the WatcherEngine
@@ -63,12 +67,16 @@ type Watcher struct {
 
 //Initialize is a 'constructor' for the pusher struct
 func (e *Pusher) Initialize(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.ServerID = id
 	e.Watchers = make(map[string]Watcher, maxClients)
 }
 
 //Attach Add a new Watcher to the notification slice
 func (e *Pusher) Attach(w Watcher) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	//Check if Watchers is full
 	if len(e.Watchers) == maxClients {
 		return fmt.Errorf("[!] Error: Not enough space for new client")
@@ -84,17 +92,35 @@ func (e *Pusher) Attach(w Watcher) (err error) {
 
 //Detach Remove a watcher from the notification slice
 func (e *Pusher) Detach(w Watcher) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	//Check if element already exists
 	if item, ok := e.Watchers[w.SessionKey]; ok {
-		item.Connection.Close()
+		if item.Connection != nil {
+			item.Connection.Close()
+		}
 		delete(e.Watchers, w.SessionKey)
 		return nil
 	}
 	return fmt.Errorf("[!] Error: client doesn't exist")
 }
 
+//Rekey Move the watcher attached with oldKey to newKey, for a client
+//whose session key was rotated while it was connected
+func (e *Pusher) Rekey(oldKey, newKey string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if item, ok := e.Watchers[oldKey]; ok {
+		delete(e.Watchers, oldKey)
+		item.SessionKey = newKey
+		e.Watchers[newKey] = item
+	}
+}
+
 //Notify Tell the watcher {clientID} to update
 func (e *Pusher) Notify(sessionkey string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	for _, k := range e.Watchers {
 		if k.SessionKey != sessionkey {
 			k.Update()
@@ -107,6 +133,8 @@ func (e *Pusher) Notify(sessionkey string) {
 
 //ShowWatchers Print current watchers in pusher
 func (e *Pusher) ShowWatchers() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	for _, k := range e.Watchers {
 		fmt.Println("Watcher: ", k)
 	}
@@ -141,7 +169,9 @@ func getPendingUpdates() update {
 //The e on the reciever stands for event
 func (e *Pusher) InitUDPush() error {
 	//Initialize the map
+	e.mu.Lock()
 	e.Watchers = make(map[string]Watcher, maxClients)
+	e.mu.Unlock()
 	connectionString := fmt.Sprintf("%s:%d", e.ServerID, e.BindedTo)
 	ln, err := net.Listen("tcp", connectionString)
 	if err != nil {
@@ -1,42 +1,35 @@
 package boxtools
 
 import (
+	crand "crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/golangbox/gobox/server/blobindex"
 	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/totp"
 	"github.com/golangbox/gobox/structs"
 	"github.com/jinzhu/gorm"
 
 	"code.google.com/p/go.crypto/bcrypt"
 )
 
-var salt []byte
+// SessionLifetime is how long a session key works for unless the session
+// is refreshed.
+const SessionLifetime = time.Hour * 24 * 30
 
 func init() {
-	f, err := os.Open("/dev/random")
-	if err != nil {
-		panic("Unable to open /dev/random")
-	}
-	salt = make([]byte, 8)
-	n, err := f.Read(salt)
-	if n != 8 || err != nil {
-		panic("Couldn't read from dev/random")
-	}
-	f.Close()
-
 	rand.Seed(time.Now().Unix())
-
 }
 
 func RandomString(n int) string {
@@ -240,33 +233,38 @@ func NewUser(email string, password string) (user structs.User, err error) {
 	if err != nil {
 		return
 	}
-	user = structs.User{
+	return createUser(structs.User{
 		Email:          email,
 		HashedPassword: hash,
-	}
+	})
+}
+
+// NewUserWithoutPassword creates a user who can only sign in through
+// single sign-on, no password matches an empty hash.
+func NewUserWithoutPassword(email string) (user structs.User, err error) {
+	return createUser(structs.User{Email: email})
+}
+
+func createUser(user structs.User) (structs.User, error) {
 	query := model.DB.Create(&user)
 	if query.Error != nil {
 		return user, query.Error
 	}
-	client, err := NewClient(user, "Server", true)
-	_ = client
-	if err != nil {
-		return
-	}
-	return
+	_, err := NewClient(user, "Server", true)
+	return user, err
 }
 
 func NewClient(user structs.User, name string, isServer bool) (client structs.Client, err error) {
-	// calculate key if we need a key?
 	newKey, err := GenerateRandomSha256()
 	if err != nil {
 		return
 	}
 	client = structs.Client{
-		UserId:     user.Id,
-		SessionKey: newKey,
-		IsServer:   isServer,
-		Name:       name,
+		UserId:           user.Id,
+		SessionKey:       newKey,
+		SessionExpiresAt: time.Now().Add(SessionLifetime),
+		IsServer:         isServer,
+		Name:             name,
 	}
 	query := model.DB.Create(&client)
 	if query.Error != nil {
@@ -275,13 +273,41 @@ func NewClient(user structs.User, name string, isServer bool) (client structs.Cl
 	return
 }
 
+// ServerClient returns the client changes the server makes to user's
+// files are written as, so every one of their devices is sent them.
+func ServerClient(user structs.User) (client structs.Client, err error) {
+	query := model.DB.Where("user_id = ? AND is_server = ?", user.Id, true).
+		First(&client)
+	if query.Error == gorm.RecordNotFound {
+		return NewClient(user, "Server", true)
+	}
+	return client, query.Error
+}
+
+// RevokeSession stops client's session key from working.
+func RevokeSession(client structs.Client) error {
+	return model.DB.Exec(
+		"UPDATE clients SET revoked_at = ? WHERE id = ?", time.Now(), client.Id,
+	).Error
+}
+
+// RevokeUserSessions revokes the session of every client user has.
+func RevokeUserSessions(user structs.User) error {
+	return model.DB.Exec(
+		"UPDATE clients SET revoked_at = ? WHERE user_id = ? AND revoked_at < ?",
+		time.Now(), user.Id, time.Unix(0, 0),
+	).Error
+}
+
+// GenerateRandomSha256 returns 32 random bytes, hex encoded like a sha256.
+// They come from crypto/rand, so they can be used as session keys.
 func GenerateRandomSha256() (s string, err error) {
-	h := sha256.New()
-	h.Write(salt)
-	io.WriteString(h, time.Now().String())
-	bytes := h.Sum(nil)
-	s = hex.EncodeToString(bytes)
-	return s, err
+	b := make([]byte, sha256.Size)
+	_, err = crand.Read(b)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func ValidateUserPassword(email, password string) (user structs.User, err error) {
@@ -292,6 +318,92 @@ func ValidateUserPassword(email, password string) (user structs.User, err error)
 	return user, err
 }
 
+// RecoveryCodeCount is how many recovery codes a user gets at a time.
+const RecoveryCodeCount = 10
+
+// NewRecoveryCodes replaces user's recovery codes with new ones and
+// returns them. Only their hashes are kept, so they can't be shown again.
+func NewRecoveryCodes(user *structs.User) (codes []string, err error) {
+	var hashes []string
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, err = crand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		var hash string
+		hash, err = hashPassword(code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hash)
+	}
+	user.HashedRecoveryCodes = strings.Join(hashes, " ")
+	err = model.DB.Exec("UPDATE users SET hashed_recovery_codes = ? WHERE id = ?",
+		user.HashedRecoveryCodes, user.Id).Error
+	return
+}
+
+// ValidateSecondFactor checks code against user's authenticator app, or
+// failing that their recovery codes. Either kind of code only works once.
+func ValidateSecondFactor(user *structs.User, code string) (ok bool, err error) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	step, ok := totp.Verify(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if ok {
+		// only one request can move the step forward, so a code can't be
+		// used twice by racing
+		query := model.DB.Exec(
+			"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+			step, user.Id, step)
+		if query.Error != nil {
+			return false, query.Error
+		}
+		user.TOTPLastStep = step
+		return query.RowsAffected == 1, nil
+	}
+
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	hashes := strings.Fields(user.HashedRecoveryCodes)
+	for i, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+		remaining := strings.Join(append(hashes[:i:i], hashes[i+1:]...), " ")
+		query := model.DB.Exec(
+			"UPDATE users SET hashed_recovery_codes = ? WHERE id = ? AND hashed_recovery_codes = ?",
+			remaining, user.Id, user.HashedRecoveryCodes)
+		if query.Error != nil {
+			return false, query.Error
+		}
+		user.HashedRecoveryCodes = remaining
+		return query.RowsAffected == 1, nil
+	}
+	return false, nil
+}
+
+// SetUserPassword replaces user's password.
+func SetUserPassword(user structs.User, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return model.DB.Exec("UPDATE users SET hashed_password = ? WHERE id = ?",
+		hash, user.Id).Error
+}
+
+// HashSecret returns a bcrypt hash of a secret that isn't a user's
+// password, like the password of a share link.
+func HashSecret(secret string) (hash string, err error) {
+	return hashPassword(secret)
+}
+
+// MatchesHash reports whether secret is the one hash was made from.
+func MatchesHash(hash string, secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
 func clear(b []byte) {
 	for i := 0; i < len(b); i++ {
 		b[i] = 0
@@ -392,10 +504,19 @@ func WriteFileActionsToDatabase(fileActions []structs.FileAction,
 	for _, fileAction := range fileActions {
 		fileAction.ClientId = client.Id
 		fileAction.File.UserId = user.Id
-		file, err := FindFile(fileAction.File.Hash, fileAction.File.Path, user)
+		fileAction.File.NamespaceId = fileAction.NamespaceId
+		var file structs.File
+		var err error
+		if fileAction.NamespaceId != 0 {
+			file, err = FindNamespaceFile(fileAction.File.Hash,
+				fileAction.File.Path, fileAction.NamespaceId)
+		} else {
+			file, err = FindFile(fileAction.File.Hash, fileAction.File.Path, user)
+		}
 		if err != nil {
 			return outPutFileActions, err
 		}
+		var blocks []structs.Block
 		if file.Id != 0 {
 			// if the file exists, assign an id
 			// otherwise GORM automatically creates
@@ -403,25 +524,101 @@ func WriteFileActionsToDatabase(fileActions []structs.FileAction,
 			// struct
 			fileAction.FileId = file.Id
 			fileAction.File = structs.File{}
+		} else {
+			// blocks are written below, once the file has an id
+			blocks = FileBlocks(fileAction.File)
+			fileAction.File.Blocks = nil
 		}
 		query = model.DB.Create(&fileAction)
+		if query.Error != nil {
+			return outPutFileActions, query.Error
+		}
+		for i := range blocks {
+			blocks[i].Id = 0
+			blocks[i].FileId = fileAction.FileId
+			query = model.DB.Create(&blocks[i])
+			if query.Error != nil {
+				return outPutFileActions, query.Error
+			}
+			err = blobindex.AddRef(blocks[i].Hash)
+			if err != nil {
+				return outPutFileActions, err
+			}
+		}
+		fileAction.File.Blocks = blocks
 		outPutFileActions = append(
 			outPutFileActions,
 			fileAction,
 		)
-		if query.Error != nil {
-			return outPutFileActions, query.Error
-		}
 	}
 	return outPutFileActions, nil
 }
 
+// FileBlocks returns the blocks a file is made of. Files sent without a
+// block list are treated as a single block holding the whole file.
+func FileBlocks(file structs.File) (blocks []structs.Block) {
+	if len(file.Blocks) != 0 || file.Hash == "" || file.Size == 0 {
+		return file.Blocks
+	}
+	return []structs.Block{
+		structs.Block{
+			Hash: file.Hash,
+			Size: file.Size,
+		},
+	}
+}
+
+// LoadFileBlocks fills in file.Blocks from the database, in order.
+func LoadFileBlocks(file *structs.File) (err error) {
+	query := model.DB.
+		Where("file_id = ?", file.Id).
+		Order("position").
+		Find(&file.Blocks)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	file.Blocks = FileBlocks(*file)
+	return nil
+}
+
+// UserHasBlock checks that one of the user's files, or a file in one of
+// their namespaces, contains a block with this hash, so clients can only
+// fetch contents they already know about.
+func UserHasBlock(user structs.User, hash string) (found bool, err error) {
+	var count int
+	query := model.DB.Table("blocks").
+		Joins("join files on files.id = blocks.file_id").
+		Where(userFilesCondition, user.Id, user.Id).
+		Where("blocks.hash = ?", hash).
+		Count(&count)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	if count > 0 {
+		return true, nil
+	}
+	// files written before blocks existed are a single block
+	query = model.DB.Model(structs.File{}).
+		Where(userFilesCondition, user.Id, user.Id).
+		Where("files.hash = ?", hash).
+		Count(&count)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return count > 0, nil
+}
+
+// userFilesCondition matches the files a user can read, given their id
+// twice.
+const userFilesCondition = "(files.namespace_id = 0 AND files.user_id = ?) OR " +
+	"files.namespace_id IN (SELECT namespace_id FROM namespace_members WHERE user_id = ?)"
+
 func FindFile(hash string, path string, user structs.User) (file structs.File, err error) {
 	query := model.DB.Where(&structs.File{
 		UserId: user.Id,
 		Path:   path,
 		Hash:   hash,
-	}).First(&file)
+	}).Where("namespace_id = ?", 0).First(&file)
 	if query.Error != nil {
 		if query.Error != gorm.RecordNotFound {
 			return file, query.Error
@@ -437,23 +634,29 @@ func ApplyFileActionsToFileSystemFileTable(fileActions []structs.FileAction, use
 		// get file for fileaction
 		var file structs.File
 		model.DB.First(&file, fileAction.FileId)
+		// files in a namespace belong to it, not to the user who wrote them
+		owner := user
+		if fileAction.NamespaceId != 0 {
+			owner = structs.User{}
+		}
 		if fileAction.IsCreate == true {
-			err := deleteFileSystemFileAtPath(file.Path, user)
+			err := deleteFileSystemFileAtPath(file.Path, owner, fileAction.NamespaceId)
 			if err != nil {
 				log.Fatal(err)
 				errs = append(errs, err)
 			}
 			newFileSystemFile := structs.FileSystemFile{
-				UserId: user.Id,
-				FileId: fileAction.FileId,
-				Path:   file.Path,
+				UserId:      owner.Id,
+				NamespaceId: fileAction.NamespaceId,
+				FileId:      fileAction.FileId,
+				Path:        file.Path,
 			}
 			query := model.DB.Create(&newFileSystemFile)
 			if query.Error != nil {
 				fmt.Println(query.Error)
 			}
 		} else {
-			err := deleteFileSystemFileAtPath(file.Path, user)
+			err := trashFileSystemFileAtPath(file.Path, owner, fileAction)
 			if err != nil {
 				log.Fatal(err)
 				errs = append(errs, err)
@@ -463,10 +666,42 @@ func ApplyFileActionsToFileSystemFileTable(fileActions []structs.FileAction, use
 	return
 }
 
-func deleteFileSystemFileAtPath(path string, user structs.User) (err error) {
+// trashFileSystemFileAtPath moves the file at path to the trash, noting
+// the delete that put it there.
+func trashFileSystemFileAtPath(path string, user structs.User,
+	fileAction structs.FileAction) (err error) {
+	var fileSystemFiles []structs.FileSystemFile
+	query := model.DB.
+		Where("path = ?", path).
+		Where("user_id = ?", user.Id).
+		Where("namespace_id = ?", fileAction.NamespaceId).
+		Find(&fileSystemFiles)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	for _, value := range fileSystemFiles {
+		query = model.DB.Create(&structs.TrashedFile{
+			UserId:       user.Id,
+			NamespaceId:  fileAction.NamespaceId,
+			FileId:       value.FileId,
+			Path:         value.Path,
+			ClientId:     fileAction.ClientId,
+			FileActionId: fileAction.Id,
+			TrashedAt:    time.Now(),
+		})
+		if query.Error != nil {
+			return query.Error
+		}
+	}
+	return deleteFileSystemFileAtPath(path, user, fileAction.NamespaceId)
+}
+
+func deleteFileSystemFileAtPath(path string, user structs.User,
+	namespaceId int64) (err error) {
 	query := model.DB.
 		Where("path = ?", path).
 		Where("user_id = ?", user.Id).
+		Where("namespace_id = ?", namespaceId).
 		Delete(structs.FileSystemFile{})
 	if query.Error != nil {
 		return query.Error
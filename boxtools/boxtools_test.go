@@ -28,7 +28,17 @@ func init() {
 	model.DB.DropTableIfExists(&structs.FileAction{})
 	model.DB.DropTableIfExists(&structs.File{})
 	model.DB.DropTableIfExists(&structs.FileSystemFile{})
-	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.UploadSession{})
+	model.DB.DropTableIfExists(&structs.GCCandidate{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.DropTableIfExists(&structs.EmailToken{})
+	model.DB.DropTableIfExists(&structs.Namespace{})
+	model.DB.DropTableIfExists(&structs.NamespaceMember{})
+	model.DB.DropTableIfExists(&structs.ShareLink{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
+	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{}, &structs.Block{}, &structs.UploadSession{}, &structs.GCCandidate{}, &structs.Blob{}, &structs.DataKey{}, &structs.EmailToken{}, &structs.Namespace{}, &structs.NamespaceMember{}, &structs.ShareLink{}, &structs.TrashedFile{})
 
 	if err != nil {
 		fmt.Println(err)
@@ -100,3 +110,45 @@ func TestRemoveRedundancy(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestFileBlocks(t *testing.T) {
+	file := structs.File{Hash: "abc", Size: 10}
+	blocks := FileBlocks(file)
+	if len(blocks) != 1 || blocks[0].Hash != "abc" || blocks[0].Size != 10 {
+		t.Error("File without blocks should be a single block")
+	}
+	file.Blocks = []structs.Block{
+		structs.Block{Hash: "a", Size: 4},
+		structs.Block{Hash: "b", Offset: 4, Size: 6},
+	}
+	if len(FileBlocks(file)) != 2 {
+		t.Error("FileBlocks should return the file's own blocks")
+	}
+	if len(FileBlocks(structs.File{})) != 0 {
+		t.Error("An empty file has no blocks")
+	}
+}
+
+func TestReplayFileActions(t *testing.T) {
+	old := structs.File{Path: "./notes.txt", Hash: "a"}
+	edited := structs.File{Path: "./notes.txt", Hash: "b"}
+	plan := structs.File{Path: "./plan.txt", Hash: "c"}
+	tree := ReplayFileActions([]structs.FileAction{
+		{IsCreate: true, File: old},
+		{IsCreate: true, File: plan},
+		{IsCreate: false, File: old},
+		{IsCreate: true, File: edited},
+		{IsCreate: false, File: plan},
+	})
+	if len(tree) != 1 || tree["notes.txt"].Hash != "b" {
+		t.Error("Replaying should leave the last version of each file still there")
+	}
+	tree = ReplayFileActions([]structs.FileAction{
+		{IsCreate: true, File: plan},
+		{IsCreate: false, File: plan},
+		{IsCreate: true, File: plan},
+	})
+	if len(tree) != 1 {
+		t.Error("A file created again after it was deleted should be in the tree")
+	}
+}
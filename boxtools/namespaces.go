@@ -0,0 +1,231 @@
+package boxtools
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+// Memberships returns every namespace user is a member of.
+func Memberships(user structs.User) (members []structs.NamespaceMember,
+	err error) {
+	query := model.DB.Where("user_id = ?", user.Id).Find(&members)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	return members, nil
+}
+
+// ResolvePath finds the namespace a path in a member's tree is in, and
+// returns its membership and the path relative to the namespace. For
+// paths in the user's own tree it returns nil and the path unchanged.
+func ResolvePath(memberships []structs.NamespaceMember, filePath string) (
+	*structs.NamespaceMember, string) {
+	cleaned := path.Clean(filePath)
+	for i, member := range memberships {
+		folder := path.Clean(member.Path)
+		if strings.HasPrefix(cleaned, folder+"/") {
+			return &memberships[i], "./" + cleaned[len(folder)+1:]
+		}
+	}
+	return nil, filePath
+}
+
+// MountedPath turns a path relative to member's namespace into the path
+// it has in member's tree.
+func MountedPath(member structs.NamespaceMember, filePath string) string {
+	return "./" + path.Join(path.Clean(member.Path), path.Clean(filePath))
+}
+
+// CanWrite reports whether role lets a member change files.
+func CanWrite(role string) bool {
+	return role == structs.RoleOwner || role == structs.RoleEditor
+}
+
+// InFolder reports whether filePath is inside folder, both being paths in
+// the same tree.
+func InFolder(filePath, folder string) bool {
+	return strings.HasPrefix(path.Clean(filePath), path.Clean(folder)+"/")
+}
+
+// FindNamespaceFile is FindFile for a file in a namespace.
+func FindNamespaceFile(hash string, path string, namespaceId int64) (
+	file structs.File, err error) {
+	query := model.DB.Where("namespace_id = ? AND path = ? AND hash = ?",
+		namespaceId, path, hash).First(&file)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return file, query.Error
+	}
+	return file, nil
+}
+
+// LatestFileActionId returns the id of the newest entry in any journal.
+func LatestFileActionId() (id int64, err error) {
+	return latestFileActionId(&model.DB)
+}
+
+func latestFileActionId(db *gorm.DB) (id int64, err error) {
+	var fileAction structs.FileAction
+	query := db.Order("id desc").First(&fileAction)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return 0, query.Error
+	}
+	return fileAction.Id, nil
+}
+
+// FreeFolder returns a folder in user's tree to mount a namespace called
+// name at, which has none of their files or other namespaces in it.
+func FreeFolder(user structs.User, name string) (folder string, err error) {
+	var fileSystemFiles []structs.FileSystemFile
+	query := model.DB.Where("user_id = ? AND namespace_id = 0", user.Id).
+		Find(&fileSystemFiles)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return "", query.Error
+	}
+	memberships, err := Memberships(user)
+	if err != nil {
+		return "", err
+	}
+	for i := 1; ; i++ {
+		folder = "./" + name
+		if i > 1 {
+			folder = fmt.Sprintf("./%s (%d)", name, i)
+		}
+		if !folderInUse(folder, fileSystemFiles, memberships) {
+			return folder, nil
+		}
+	}
+}
+
+func folderInUse(folder string, fileSystemFiles []structs.FileSystemFile,
+	memberships []structs.NamespaceMember) bool {
+	for _, value := range fileSystemFiles {
+		if InFolder(value.Path, folder) || path.Clean(value.Path) == path.Clean(folder) {
+			return true
+		}
+	}
+	for _, value := range memberships {
+		if path.Clean(value.Path) == path.Clean(folder) ||
+			InFolder(value.Path, folder) || InFolder(folder, value.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShareFolder makes folder in user's tree into a namespace called name,
+// with user as its owner. The files already in the folder are moved into
+// the namespace, so they are in its snapshot for new members. It all
+// happens in one transaction, so a folder is never left half moved.
+func ShareFolder(user structs.User, folder string, name string) (
+	namespace structs.Namespace, err error) {
+	server, err := ServerClient(user)
+	if err != nil {
+		return
+	}
+	tx := model.DB.Begin()
+	if tx.Error != nil {
+		return namespace, tx.Error
+	}
+	namespace, err = shareFolder(tx, user, server, folder, name)
+	if err != nil {
+		tx.Rollback()
+		return structs.Namespace{}, err
+	}
+	return namespace, tx.Commit().Error
+}
+
+func shareFolder(tx *gorm.DB, user structs.User, server structs.Client,
+	folder string, name string) (namespace structs.Namespace, err error) {
+	var fileSystemFiles []structs.FileSystemFile
+	query := tx.Where("user_id = ? AND namespace_id = 0", user.Id).
+		Find(&fileSystemFiles)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return namespace, query.Error
+	}
+	namespace = structs.Namespace{Name: name}
+	query = tx.Create(&namespace)
+	if query.Error != nil {
+		return namespace, query.Error
+	}
+	member := structs.NamespaceMember{
+		NamespaceId: namespace.Id,
+		UserId:      user.Id,
+		Role:        structs.RoleOwner,
+		Path:        "./" + path.Clean(folder),
+	}
+	query = tx.Create(&member)
+	if query.Error != nil {
+		return namespace, query.Error
+	}
+
+	for _, value := range fileSystemFiles {
+		if !InFolder(value.Path, folder) {
+			continue
+		}
+		var file structs.File
+		query = tx.First(&file, value.FileId)
+		if query.Error != nil {
+			return namespace, query.Error
+		}
+		err = LoadFileBlocks(&file)
+		if err != nil {
+			return
+		}
+		// the user's journal still refers to the old file, so the
+		// namespace gets a copy of it
+		blocks := file.Blocks
+		_, relative := ResolvePath([]structs.NamespaceMember{member}, value.Path)
+		file.Id = 0
+		file.UserId = user.Id
+		file.NamespaceId = namespace.Id
+		file.Path = relative
+		file.Blocks = nil
+		query = tx.Create(&file)
+		if query.Error != nil {
+			return namespace, query.Error
+		}
+		for i := range blocks {
+			blocks[i].Id = 0
+			blocks[i].FileId = file.Id
+			query = tx.Create(&blocks[i])
+			if query.Error != nil {
+				return namespace, query.Error
+			}
+			err = blobindex.AddRefIn(tx, blocks[i].Hash)
+			if err != nil {
+				return
+			}
+		}
+		err = tx.Exec(
+			"UPDATE file_system_files SET user_id = 0, namespace_id = ?, file_id = ?, path = ? WHERE id = ?",
+			namespace.Id, file.Id, relative, value.Id,
+		).Error
+		if err != nil {
+			return
+		}
+		// the namespace's journal starts with what was moved into it, so
+		// replaying it gives back the whole folder
+		query = tx.Create(&structs.FileAction{
+			ClientId:    server.Id,
+			NamespaceId: namespace.Id,
+			IsCreate:    true,
+			FileId:      file.Id,
+		})
+		if query.Error != nil {
+			return namespace, query.Error
+		}
+	}
+	latest, err := latestFileActionId(tx)
+	if err != nil {
+		return
+	}
+	err = tx.Exec("UPDATE namespace_members SET joined_action_id = ? WHERE id = ?",
+		latest, member.Id).Error
+	return namespace, err
+}
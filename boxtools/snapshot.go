@@ -0,0 +1,127 @@
+package boxtools
+
+import (
+	"path"
+
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+// ReplayFileActions plays fileActions over an empty tree, in the order
+// they're given, and returns the files left at the end, keyed by their
+// cleaned path. Unlike ComputeFilesFromFileActions it keeps the order, so
+// a file that's deleted and then created again ends up in the tree.
+func ReplayFileActions(fileActions []structs.FileAction) (tree map[string]structs.File) {
+	tree = make(map[string]structs.File)
+	for _, value := range fileActions {
+		filePath := path.Clean(value.File.Path)
+		if value.IsCreate {
+			tree[filePath] = value.File
+		} else {
+			delete(tree, filePath)
+		}
+	}
+	return
+}
+
+// TreeAt rebuilds user's tree as it was right after the journal entry
+// with id upTo, by replaying their own journal and the journals of the
+// namespaces they're a member of now. A namespace they joined after upTo
+// wasn't in their tree yet, so it's left out. Files in shared folders have
+// their Path in user's tree, and keep the NamespaceId they're in.
+func TreeAt(user structs.User, upTo int64) (tree map[string]structs.File,
+	err error) {
+	memberships, err := Memberships(user)
+	if err != nil {
+		return
+	}
+	mounts := make(map[int64]structs.NamespaceMember)
+	var namespaceIds []int64
+	for _, value := range memberships {
+		if upTo < value.JoinedActionId {
+			continue
+		}
+		mounts[value.NamespaceId] = value
+		namespaceIds = append(namespaceIds, value.NamespaceId)
+	}
+
+	own := "namespace_id = 0 AND client_id IN (SELECT id FROM clients WHERE user_id = ?)"
+	query := model.DB.Where(own, user.Id)
+	if len(namespaceIds) != 0 {
+		query = model.DB.Where("("+own+") OR namespace_id IN (?)",
+			user.Id, namespaceIds)
+	}
+	var fileActions []structs.FileAction
+	query = query.Where("id <= ?", upTo).Order("id").Find(&fileActions)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+
+	var fileIds []int64
+	seen := make(map[int64]bool)
+	for _, value := range fileActions {
+		if !seen[value.FileId] {
+			seen[value.FileId] = true
+			fileIds = append(fileIds, value.FileId)
+		}
+	}
+	files := make(map[int64]structs.File)
+	if len(fileIds) != 0 {
+		var loaded []structs.File
+		query = model.DB.Where("id IN (?)", fileIds).Find(&loaded)
+		if query.Error != nil && query.Error != gorm.RecordNotFound {
+			return nil, query.Error
+		}
+		for _, value := range loaded {
+			files[value.Id] = value
+		}
+	}
+	for i, value := range fileActions {
+		file := files[value.FileId]
+		if value.NamespaceId != 0 {
+			file.Path = MountedPath(mounts[value.NamespaceId], file.Path)
+		}
+		fileActions[i].File = file
+	}
+	return ReplayFileActions(fileActions), nil
+}
+
+// CurrentTree returns the files in user's tree now, shared folders
+// included, keyed and with their Path as in TreeAt.
+func CurrentTree(user structs.User) (tree map[string]structs.File, err error) {
+	memberships, err := Memberships(user)
+	if err != nil {
+		return
+	}
+	mounts := make(map[int64]structs.NamespaceMember)
+	var namespaceIds []int64
+	for _, value := range memberships {
+		mounts[value.NamespaceId] = value
+		namespaceIds = append(namespaceIds, value.NamespaceId)
+	}
+	query := model.DB.Where("user_id = ? AND namespace_id = 0", user.Id)
+	if len(namespaceIds) != 0 {
+		query = model.DB.Where("(user_id = ? AND namespace_id = 0) OR namespace_id IN (?)",
+			user.Id, namespaceIds)
+	}
+	var fileSystemFiles []structs.FileSystemFile
+	query = query.Find(&fileSystemFiles)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	tree = make(map[string]structs.File)
+	for _, value := range fileSystemFiles {
+		var file structs.File
+		query = model.DB.First(&file, value.FileId)
+		if query.Error != nil {
+			return nil, query.Error
+		}
+		file.Path = value.Path
+		if value.NamespaceId != 0 {
+			file.Path = MountedPath(mounts[value.NamespaceId], value.Path)
+		}
+		tree[path.Clean(file.Path)] = file
+	}
+	return tree, nil
+}
@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golangbox/gobox/structs"
@@ -23,26 +24,42 @@ type Api struct {
 	SessionKey string
 }
 
+// New returns an Api that authenticates with SessionKey, as returned by
+// Login or SignUp.
 func New(SessionKey string) (c Api) {
-	resp, err := http.Get(ApiEndpoint + "login/")
+	c.SessionKey = SessionKey
+	return
+}
+
+// newRequest makes a request to endpoint that authenticates with c's
+// session key.
+func (c *Api) newRequest(method, endpoint string, body io.Reader) (
+	*http.Request, error) {
+	req, err := http.NewRequest(method, ApiEndpoint+endpoint, body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	keyBytes, err := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Authorization", "Bearer "+c.SessionKey)
+	return req, nil
+}
+
+func (c *Api) postForm(endpoint string, values url.Values) (*http.Response, error) {
+	req, err := c.newRequest("POST", endpoint, strings.NewReader(values.Encode()))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	c.SessionKey = string(keyBytes)
-	return
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return http.DefaultClient.Do(req)
 }
 
 func (c *Api) apiRequest(endpoint string, body []byte,
 	fileType string) (*http.Response, error) {
-	return http.Post(
-		ApiEndpoint+endpoint+"/?SessionKey="+c.SessionKey,
-		"application/json",
-		bytes.NewBuffer(body),
-	)
+	req, err := c.newRequest("POST", endpoint+"/", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fileType)
+	return http.DefaultClient.Do(req)
 }
 
 func (c *Api) SendFileActionsToServer(
@@ -74,41 +91,38 @@ func (c *Api) SendFileActionsToServer(
 	if resp.StatusCode != http.StatusOK {
 		return
 	}
-	err = json.Unmarshal(contents, &filesToUpload)
+	var response structs.FileActionsResponse
+	err = json.Unmarshal(contents, &response)
 	if err != nil {
 		return
 	}
-	return
+	if len(response.Rejected) != 0 {
+		err = &RejectedError{Rejected: response.Rejected}
+	}
+	return response.Upload, err
 }
 
-func (c *Api) UploadFileToServer(fileBody []byte) (err error) {
-	resp, err := c.apiRequest(
-		"upload",
-		fileBody,
-		"",
-	)
-	if err != nil {
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		contents, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-		err = fmt.Errorf(string(contents))
-		return err
+// RejectedError is returned by SendFileActionsToServer when the server
+// refused some of the file actions. The others were still accepted.
+type RejectedError struct {
+	Rejected []structs.RejectedFileAction
+}
+
+func (e *RejectedError) Error() string {
+	var paths []string
+	for _, value := range e.Rejected {
+		paths = append(paths, value.Path+": "+value.Reason)
 	}
-	return
+	return "The server rejected " + strings.Join(paths, ", ")
 }
 
 func (c *Api) DownloadFileFromServer(
 	hash string) (s3_url string, err error) {
 	for {
-		resp, err := http.PostForm(
-			ApiEndpoint+"download/",
+		resp, err := c.postForm(
+			"download/",
 			url.Values{
-				"SessionKey": {c.SessionKey},
-				"fileHash":   {hash},
+				"fileHash": {hash},
 			},
 		)
 		if err != nil {
@@ -133,12 +147,11 @@ func (c *Api) DownloadFileFromServer(
 func (c *Api) DownloadClientFileActions(lastId int64) (
 	clientFileActionsResponse structs.ClientFileActionsResponse, err error) {
 	var lastIdString string
-	lastIdString = strconv.FormatInt(lastId, 32)
-	resp, err := http.PostForm(
-		ApiEndpoint+"clients/",
+	lastIdString = strconv.FormatInt(lastId, 10)
+	resp, err := c.postForm(
+		"clients/",
 		url.Values{
-			"SessionKey": {c.SessionKey},
-			"lastId":     {lastIdString},
+			"lastId": {lastIdString},
 		},
 	)
 	if err != nil {
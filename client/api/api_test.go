@@ -1,14 +1,17 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
+	"github.com/golangbox/gobox/UDPush"
 	"github.com/golangbox/gobox/boxtools"
 	server_api "github.com/golangbox/gobox/server/api"
 	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/s3"
 	"github.com/golangbox/gobox/structs"
 	"github.com/jinzhu/gorm"
 )
@@ -25,7 +28,17 @@ func init() {
 	model.DB.DropTableIfExists(&structs.FileAction{})
 	model.DB.DropTableIfExists(&structs.File{})
 	model.DB.DropTableIfExists(&structs.FileSystemFile{})
-	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.UploadSession{})
+	model.DB.DropTableIfExists(&structs.GCCandidate{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.DropTableIfExists(&structs.EmailToken{})
+	model.DB.DropTableIfExists(&structs.Namespace{})
+	model.DB.DropTableIfExists(&structs.NamespaceMember{})
+	model.DB.DropTableIfExists(&structs.ShareLink{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
+	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{}, &structs.Block{}, &structs.UploadSession{}, &structs.GCCandidate{}, &structs.Blob{}, &structs.DataKey{}, &structs.EmailToken{}, &structs.Namespace{}, &structs.NamespaceMember{}, &structs.ShareLink{}, &structs.TrashedFile{})
 
 	user, _ = boxtools.NewUser("max.t.mcdonnell@gmail", "password")
 
@@ -37,7 +50,7 @@ func init() {
 
 	apiClient = New(client.SessionKey)
 
-	go server_api.ServeServerRoutes("8000")
+	go server_api.ServeServerRoutes("8000", &UDPush.Pusher{}, s3.NewFromEnv())
 }
 
 func TestSendFileActionsToServer(t *testing.T) {
@@ -73,7 +86,11 @@ func TestDownloadFileFromServer(t *testing.T) {
 
 func TestUploadFileToServer(t *testing.T) {
 	file := []byte("this is a file")
-	err := apiClient.UploadFileToServer(file)
+	err := apiClient.UploadFileToServer(
+		"fc45acaffc35a3aa674f7c0d5a03d22350b4f2ff4bf45ccebad077e5af80e512",
+		int64(len(file)),
+		bytes.NewReader(file),
+	)
 	if err != nil {
 		t.Error(err)
 	}
@@ -105,3 +122,26 @@ func TestUploadFileToServer(t *testing.T) {
 		t.Error(fmt.Errorf("S3 file contents don't match"))
 	}
 }
+
+func TestDownloadClientFileActionsPastTen(t *testing.T) {
+	other, _ := boxtools.NewClient(user, "other", false)
+	fileActions, _ := boxtools.GenerateSliceOfRandomFileActions(1, 1, 12)
+	for i := range fileActions {
+		fileActions[i].IsCreate = true
+	}
+	otherClient := New(other.SessionKey)
+	_, err := otherClient.SendFileActionsToServer(fileActions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, _ := boxtools.LatestFileActionId()
+
+	// ids from 10 on have letters in them in any base but 10
+	response, err := apiClient.DownloadClientFileActions(latest - 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.LastId != latest || len(response.FileActions) != 2 {
+		t.Error("Syncing from past id 10 should get the changes since")
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+// E2EParams fetches the user's end to end encryption parameters. They are
+// empty if no client has turned it on yet.
+func (c *Api) E2EParams() (params structs.E2EParams, err error) {
+	req, err := c.newRequest("GET", "e2e/", nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	return readE2EParams(resp)
+}
+
+// SetE2EParams turns on end to end encryption for the user. It fails if
+// another client got there first, in which case its parameters should be
+// fetched and used instead.
+func (c *Api) SetE2EParams(params structs.E2EParams) (
+	saved structs.E2EParams, err error) {
+	resp, err := c.postForm(
+		"e2e/",
+		url.Values{
+			"Salt":  {params.Salt},
+			"Check": {params.Check},
+		},
+	)
+	if err != nil {
+		return
+	}
+	return readE2EParams(resp)
+}
+
+func readE2EParams(resp *http.Response) (params structs.E2EParams, err error) {
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", resp.Status, contents)
+		return
+	}
+	err = json.Unmarshal(contents, &params)
+	return
+}
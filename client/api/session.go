@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+// ErrCodeRequired is returned by Login for accounts with two-factor
+// authentication on, when no code was given.
+var ErrCodeRequired = errors.New("a code from your authenticator app or a recovery code is required")
+
+// Login starts a session for a device called name on the account with
+// email and password. code is only needed if the account has two-factor
+// authentication on.
+func Login(email, password, name, code string) (session structs.Session,
+	err error) {
+	return startSession("login/", url.Values{
+		"email":    {email},
+		"password": {password},
+		"name":     {name},
+		"code":     {code},
+	})
+}
+
+// SignUp creates an account and starts a session for a device called
+// name on it.
+func SignUp(email, password, name string) (session structs.Session, err error) {
+	return startSession("sign-up/", url.Values{
+		"email":    {email},
+		"password": {password},
+		"name":     {name},
+	})
+}
+
+func startSession(endpoint string, values url.Values) (
+	session structs.Session, err error) {
+	resp, err := http.PostForm(ApiEndpoint+endpoint, values)
+	if err != nil {
+		return
+	}
+	return readSession(resp)
+}
+
+// SSOLoginURL is where to send the user's browser to sign in a device
+// called name through single sign-on. The session is handed to returnTo,
+// a url on the loopback interface, as its session parameter, which
+// DecodeSSOSession reads.
+func SSOLoginURL(name, returnTo string) string {
+	return ApiEndpoint + "sso/login/?" + url.Values{
+		"name":      {name},
+		"return_to": {returnTo},
+	}.Encode()
+}
+
+func DecodeSSOSession(encoded string) (session structs.Session, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &session)
+	return
+}
+
+func readSession(resp *http.Response) (session structs.Session, err error) {
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusPreconditionRequired {
+		return session, ErrCodeRequired
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", contents)
+		return
+	}
+	err = json.Unmarshal(contents, &session)
+	return
+}
+
+// Refresh pushes the expiry of the session back to a full lifetime.
+func (c *Api) Refresh() (session structs.Session, err error) {
+	return c.sessionRequest("session/refresh/")
+}
+
+// Rotate swaps the session key for a new one, which c uses from then on.
+// The old key stops working right away.
+func (c *Api) Rotate() (session structs.Session, err error) {
+	session, err = c.sessionRequest("session/rotate/")
+	if err != nil {
+		return
+	}
+	c.SessionKey = session.SessionKey
+	return
+}
+
+// Revoke ends the session, the key can't be used again.
+func (c *Api) Revoke() (err error) {
+	resp, err := c.postForm("session/revoke/", url.Values{})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		contents, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s: %s", resp.Status, contents)
+	}
+	return
+}
+
+func (c *Api) sessionRequest(endpoint string) (session structs.Session, err error) {
+	resp, err := c.postForm(endpoint, url.Values{})
+	if err != nil {
+		return
+	}
+	return readSession(resp)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+// EnrollTOTP starts turning on two-factor authentication, returning the
+// secret to add to an authenticator app. Nothing changes at login until a
+// code from the app is passed to ConfirmTOTP.
+func (c *Api) EnrollTOTP() (enrollment structs.TOTPEnrollment, err error) {
+	resp, err := c.postForm("2fa/enroll/", url.Values{})
+	if err != nil {
+		return
+	}
+	err = readTOTPResponse(resp, &enrollment)
+	return
+}
+
+// ConfirmTOTP turns two-factor authentication on, and returns the user's
+// recovery codes.
+func (c *Api) ConfirmTOTP(code string) (recoveryCodes []string, err error) {
+	return c.recoveryCodes("2fa/confirm/", code)
+}
+
+// NewRecoveryCodes replaces the user's recovery codes. code is from the
+// authenticator app, or one of the old recovery codes.
+func (c *Api) NewRecoveryCodes(code string) (recoveryCodes []string, err error) {
+	return c.recoveryCodes("2fa/recovery-codes/", code)
+}
+
+// DisableTOTP turns two-factor authentication off.
+func (c *Api) DisableTOTP(code string) (err error) {
+	resp, err := c.postForm("2fa/disable/", url.Values{"code": {code}})
+	if err != nil {
+		return
+	}
+	return readTOTPResponse(resp, nil)
+}
+
+func (c *Api) recoveryCodes(endpoint, code string) (recoveryCodes []string,
+	err error) {
+	resp, err := c.postForm(endpoint, url.Values{"code": {code}})
+	if err != nil {
+		return
+	}
+	err = readTOTPResponse(resp, &recoveryCodes)
+	return
+}
+
+func readTOTPResponse(resp *http.Response, v interface{}) (err error) {
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, contents)
+	}
+	if v == nil {
+		return
+	}
+	return json.Unmarshal(contents, v)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+const uploadAttempts = 5
+
+// uploadRejected is returned when the server refused the upload itself,
+// as opposed to the connection failing, so there's no point retrying.
+type uploadRejected struct {
+	message string
+}
+
+func (e uploadRejected) Error() string {
+	return e.message
+}
+
+// UploadFileToServer sends size bytes from body to the server, which
+// checks them against hash before storing them. The upload goes through
+// an upload session, so when the connection drops it picks up from the
+// last part the server received rather than from the start.
+func (c *Api) UploadFileToServer(hash string, size int64,
+	body io.ReaderAt) (err error) {
+	for attempt := 0; attempt < uploadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second * time.Duration(1<<uint(attempt-1)))
+		}
+		err = c.uploadInSession(hash, size, body)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(uploadRejected); ok {
+			return
+		}
+	}
+	return
+}
+
+func (c *Api) uploadInSession(hash string, size int64,
+	body io.ReaderAt) (err error) {
+	status, err := c.uploadSessionRequest("POST", "uploads/", url.Values{
+		"fileHash": {hash},
+		"fileSize": {strconv.FormatInt(size, 10)},
+	})
+	if err != nil || status.Complete {
+		return
+	}
+
+	received := make(map[int64]bool)
+	for _, part := range status.ReceivedParts {
+		received[part] = true
+	}
+	partCount := (size + status.PartSize - 1) / status.PartSize
+	if size == 0 {
+		// an empty blob is still sent as one empty part
+		partCount = 1
+	}
+	for part := int64(0); part < partCount; part++ {
+		if received[part] {
+			continue
+		}
+		offset := part * status.PartSize
+		length := status.PartSize
+		if size-offset < length {
+			length = size - offset
+		}
+		err = c.uploadPart(status.Id, part,
+			io.NewSectionReader(body, offset, length), length)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = c.uploadSessionRequest(
+		"POST",
+		"uploads/"+strconv.FormatInt(status.Id, 10)+"/commit/",
+		url.Values{},
+	)
+	return
+}
+
+func (c *Api) uploadPart(id int64, part int64, body io.Reader,
+	length int64) (err error) {
+	req, err := c.newRequest(
+		"PUT",
+		"uploads/"+strconv.FormatInt(id, 10)+"/parts/"+
+			strconv.FormatInt(part, 10),
+		body,
+	)
+	if err != nil {
+		return
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return uploadResponseError(resp)
+}
+
+func (c *Api) uploadSessionRequest(method string, endpoint string,
+	values url.Values) (status structs.UploadSessionStatus, err error) {
+	req, err := c.newRequest(method, endpoint+"?"+values.Encode(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = uploadResponseError(resp)
+	if err != nil {
+		return
+	}
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &status)
+	return
+}
+
+func uploadResponseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	contents, _ := ioutil.ReadAll(resp.Body)
+	message := fmt.Sprintf("Upload failed: %s %s", resp.Status, contents)
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotAcceptable:
+		return uploadRejected{message}
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,117 @@
+// Package chunker splits files into content defined chunks.
+//
+// Chunk boundaries are picked with a gear rolling hash over the file's
+// bytes, so inserting or removing data only moves the boundaries near the
+// edit. Every other chunk keeps its hash, and only the chunks that changed
+// need to be uploaded or downloaded again.
+package chunker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+const (
+	// MinSize is the smallest chunk that will be cut, except for the last
+	// chunk of a file.
+	MinSize = 256 * 1024
+	// MaxSize forces a boundary when no content defined one was found.
+	MaxSize = 4 * 1024 * 1024
+	// boundaryMask gives chunks an average size of around 1MB.
+	boundaryMask = 1<<20 - 1
+)
+
+// gear maps every byte value to a pseudo random number. It has to be the
+// same on every client, so it is filled from a fixed seed.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x676f626f78)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads a stream and returns it one chunk at a time.
+type Chunker struct {
+	r        *bufio.Reader
+	buf      []byte
+	fileHash hash.Hash
+	offset   int64
+}
+
+func New(r io.Reader) *Chunker {
+	return &Chunker{
+		r:        bufio.NewReaderSize(r, 64*1024),
+		buf:      make([]byte, 0, MaxSize),
+		fileHash: sha256.New(),
+	}
+}
+
+// Next returns the next chunk's block and contents. The contents are only
+// valid until the next call. Next returns io.EOF once the stream is done.
+func (c *Chunker) Next() (block structs.Block, data []byte, err error) {
+	c.buf = c.buf[:0]
+	var rolling uint64
+	for len(c.buf) < MaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return block, nil, err
+		}
+		c.buf = append(c.buf, b)
+		rolling = (rolling << 1) + gear[b]
+		if len(c.buf) >= MinSize && rolling&boundaryMask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return block, nil, io.EOF
+	}
+	c.fileHash.Write(c.buf)
+	sum := sha256.Sum256(c.buf)
+	block = structs.Block{
+		Hash:   hex.EncodeToString(sum[:]),
+		Offset: c.offset,
+		Size:   int64(len(c.buf)),
+	}
+	c.offset += block.Size
+	return block, c.buf, nil
+}
+
+// FileHash returns the sha256 of everything read so far.
+func (c *Chunker) FileHash() string {
+	return hex.EncodeToString(c.fileHash.Sum(nil))
+}
+
+// Split chunks all of r, returning the blocks in order along with the
+// sha256 and size of the whole stream. An empty stream has no blocks.
+func Split(r io.Reader) (blocks []structs.Block, fileHash string,
+	size int64, err error) {
+	c := New(r)
+	for {
+		block, _, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+		block.Position = int64(len(blocks))
+		blocks = append(blocks, block)
+		size += block.Size
+	}
+	return blocks, c.FileHash(), size, nil
+}
@@ -0,0 +1,90 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestSplitSmallFile(t *testing.T) {
+	data := []byte("this is a file")
+	blocks, fileHash, size, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+	if len(blocks) != 1 || blocks[0].Hash != expected {
+		t.Error("A small file should be a single block hashed like the file")
+	}
+	if fileHash != expected || size != int64(len(data)) {
+		t.Error("Wrong file hash or size")
+	}
+
+	blocks, _, size, err = Split(bytes.NewReader(nil))
+	if err != nil || len(blocks) != 0 || size != 0 {
+		t.Error("An empty file should have no blocks")
+	}
+}
+
+func TestSplitBounds(t *testing.T) {
+	data := randomBytes(20*1024*1024, 1)
+	blocks, _, size, err := Split(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Error("Block sizes don't add up to the file size")
+	}
+	var offset int64
+	for i, block := range blocks {
+		if block.Offset != offset || block.Position != int64(i) {
+			t.Error("Blocks aren't contiguous")
+		}
+		if block.Size > MaxSize {
+			t.Error("Block larger than MaxSize")
+		}
+		if block.Size < MinSize && i != len(blocks)-1 {
+			t.Error("Block smaller than MinSize")
+		}
+		sum := sha256.Sum256(data[offset : offset+block.Size])
+		if hex.EncodeToString(sum[:]) != block.Hash {
+			t.Error("Block hash doesn't match its contents")
+		}
+		offset += block.Size
+	}
+}
+
+func TestSplitIsContentDefined(t *testing.T) {
+	data := randomBytes(16*1024*1024, 2)
+	before, _, _, _ := Split(bytes.NewReader(data))
+
+	// insert a few bytes near the start of the file
+	edited := append([]byte{}, data[:1000]...)
+	edited = append(edited, []byte("inserted")...)
+	edited = append(edited, data[1000:]...)
+	after, _, _, _ := Split(bytes.NewReader(edited))
+
+	hashes := make(map[string]bool)
+	for _, block := range before {
+		hashes[block.Hash] = true
+	}
+	changed := 0
+	for _, block := range after {
+		if !hashes[block.Hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("An insert changed %d of %d blocks", changed, len(after))
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -13,9 +16,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golangbox/gobox/client/api"
+	"github.com/golangbox/gobox/client/chunker"
+	"github.com/golangbox/gobox/client/e2e"
 	"github.com/golangbox/gobox/client/watcher"
 	"github.com/golangbox/gobox/structs"
 )
@@ -30,11 +37,61 @@ import (
 
 var client api.Api
 
+// e2eKey encrypts file contents before they leave the client, if end to
+// end encryption is on.
+var e2eKey *e2e.Key
+
 const (
 	dataDirectoryBasename = ".Gobox"
+	sessionFileBasename   = "session"
 	serverEndpoint        = "http://requestb.in/1mv9fa41"
 )
 
+const (
+	downloadAttempts = 5
+	staleDownloadAge = time.Hour * 24
+	e2ePassphraseEnv = "GOBOX_E2E_PASSPHRASE"
+	// sessions expire after 30 days unless they're refreshed
+	sessionRefreshInterval = time.Hour * 24
+)
+
+var goboxTmpDirectory = filepath.Join(dataDirectoryBasename, "tmp")
+
+// downloadLocks has a lock for each hash being downloaded. Downloads of
+// the same contents share a tmp file, so they take turns.
+var (
+	downloadLocksMutex sync.Mutex
+	downloadLocks      = make(map[string]*downloadLock)
+)
+
+type downloadLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockDownload waits until no other download of hash is running, and
+// returns the function that lets the next one go.
+func lockDownload(hash string) (unlock func()) {
+	downloadLocksMutex.Lock()
+	lock, ok := downloadLocks[hash]
+	if !ok {
+		lock = &downloadLock{}
+		downloadLocks[hash] = lock
+	}
+	lock.users++
+	downloadLocksMutex.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		downloadLocksMutex.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(downloadLocks, hash)
+		}
+		downloadLocksMutex.Unlock()
+	}
+}
+
 func writeError(err error, change structs.StateChange, function string) {
 	change.Error <- structs.ErrorMessage{
 		Error:    err,
@@ -87,7 +144,7 @@ func findChangedFilesOnInit(
 				out <- change
 				return
 			}
-			h, err := getSha256FromFilename(fp)
+			h, err := fileHash(fp)
 			if err != nil {
 				return
 			}
@@ -166,6 +223,7 @@ func serverActions(UDPing <-chan bool, fileActionIdPath string,
 				writeError(err, structs.StateChange{}, "serverActions")
 			}
 			fileActionId = clientFileActionResponse.LastId
+			go reuploadBlocks(clientFileActionResponse.Reupload)
 			for _, fileAction := range clientFileActionResponse.FileActions {
 				change := createServerStateChange(fileAction)
 				fmt.Println("In server actions hash: ", change.File.Hash)
@@ -200,7 +258,9 @@ func initUDPush(sessionKey string) (notification chan bool, err error) {
 		for {
 			read, err := conn.Read(response)
 			if err != nil {
+				// closed by the server, e.g. when the device is unlinked
 				fmt.Println(err)
+				return
 			}
 			fmt.Println("Message read from socket: ", read, string(response))
 			notification <- true
@@ -248,6 +308,20 @@ func createGoboxLocalDirectory(path string) {
 	}
 }
 
+// removeStaleDownloads clears out unfinished downloads nobody came back
+// for.
+func removeStaleDownloads(path string) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		if time.Since(fi.ModTime()) > staleDownloadAge {
+			os.Remove(filepath.Join(path, fi.Name()))
+		}
+	}
+}
+
 func writeFileSystemStateToLocalFile(fileSystemState map[string]structs.File, path string) error {
 	jsonBytes, err := json.Marshal(fileSystemState)
 	if err != nil {
@@ -305,12 +379,13 @@ func fetchFileActionID(path string) (id int64, err error) {
 
 func getSha256FromFilename(filename string) (sha256String string,
 	err error) {
-	file, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		return "", fmt.Errorf("Error reading file for sha256: %s", err)
 	}
+	defer file.Close()
 	h := sha256.New()
-	_, err = h.Write(file)
+	_, err = io.Copy(h, file)
 	if err != nil {
 		return "", fmt.Errorf("Error writing file to hash for sha256: %s", err)
 	}
@@ -321,6 +396,131 @@ func getSha256FromFilename(filename string) (sha256String string,
 	return sha256String, nil
 }
 
+// fileHash returns the hash the server knows the file at path by.
+func fileHash(path string) (string, error) {
+	h, err := getSha256FromFilename(path)
+	if err != nil || e2eKey == nil {
+		return h, err
+	}
+	return e2eKey.FileHash(h), nil
+}
+
+// setUpE2E derives the end to end encryption key from passphrase, and
+// turns end to end encryption on for the user if this is the first client
+// to use it. It returns a nil key if it's off and no passphrase is given.
+func setUpE2E(passphrase string) (key *e2e.Key, err error) {
+	params, err := client.E2EParams()
+	if err != nil {
+		return
+	}
+	if params.Salt == "" {
+		if passphrase == "" {
+			return nil, nil
+		}
+		var salt []byte
+		salt, err = e2e.NewSalt()
+		if err != nil {
+			return
+		}
+		key, err = e2e.DeriveKey(passphrase, salt)
+		if err != nil {
+			return
+		}
+		params, err = client.SetE2EParams(structs.E2EParams{
+			Salt:  hex.EncodeToString(salt),
+			Check: key.Check(),
+		})
+		if err != nil {
+			// another client may have set it up first
+			params, err = client.E2EParams()
+			if err != nil {
+				return
+			}
+		}
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf(
+			"Files are end to end encrypted, set %s to the passphrase",
+			e2ePassphraseEnv)
+	}
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return
+	}
+	key, err = e2e.DeriveKey(passphrase, salt)
+	if err != nil {
+		return
+	}
+	if key.Check() != params.Check {
+		return nil, fmt.Errorf("Wrong end to end encryption passphrase")
+	}
+	return
+}
+
+// splitFile splits f into blocks and hashes it, the way the server will
+// know it. With end to end encryption blocks are sealed, and named and
+// laid out by their ciphertext.
+func splitFile(f *os.File) (blocks []structs.Block, hash string, size int64,
+	err error) {
+	blocks, hash, size, err = chunker.Split(f)
+	if err != nil || e2eKey == nil {
+		return
+	}
+	hash = e2eKey.FileHash(hash)
+	var offset int64
+	for i, block := range blocks {
+		var sealed []byte
+		sealed, err = sealBlock(f, block.Offset, block.Size)
+		if err != nil {
+			return
+		}
+		blocks[i].Hash = e2e.Name(sealed)
+		blocks[i].Offset = offset
+		blocks[i].Size = int64(len(sealed))
+		offset += blocks[i].Size
+	}
+	return
+}
+
+// plainBlocks returns where blocks are in the file itself. Without end to
+// end encryption that's where the server has them.
+func plainBlocks(blocks []structs.Block) []structs.Block {
+	if e2eKey == nil {
+		return blocks
+	}
+	plain := make([]structs.Block, len(blocks))
+	var offset int64
+	for i, block := range blocks {
+		plain[i] = block
+		plain[i].Offset = offset
+		plain[i].Size = e2e.PlainSize(block.Size)
+		offset += plain[i].Size
+	}
+	return plain
+}
+
+func sealBlock(r io.ReaderAt, offset int64, size int64) ([]byte, error) {
+	plain := make([]byte, size)
+	_, err := r.ReadAt(plain, offset)
+	if err != nil && !(err == io.EOF && size == 0) {
+		return nil, err
+	}
+	return e2eKey.Seal(plain), nil
+}
+
+// blockContents returns what gets uploaded for block, given where it is
+// in f, and its size.
+func blockContents(f *os.File, block structs.Block) (io.ReaderAt, int64, error) {
+	if e2eKey == nil {
+		return io.NewSectionReader(f, block.Offset, block.Size), block.Size, nil
+	}
+	sealed, err := sealBlock(f, block.Offset, block.Size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(sealed), int64(len(sealed)), nil
+}
+
 func makeFileAction(change structs.StateChange) (fa structs.FileAction) {
 	fa.IsCreate = change.IsCreate
 	fa.CreatedAt = change.File.CreatedAt
@@ -350,34 +550,119 @@ func fileActionSender(change structs.StateChange) {
 			return
 		}
 		// need to fix this to just get responses for one file
-		go uploader(change.File.Path, change, fileActions[0])
+		go uploader(change.File.Path, change, fileActions[0], needed)
 
 	}
 	return
 }
 
-func uploader(path string, change structs.StateChange, fa structs.FileAction) {
+// uploader sends the server the blocks of the file it asked for. Blocks
+// are read straight out of the file, so nothing is held in memory.
+func uploader(path string, change structs.StateChange, fa structs.FileAction,
+	needed []string) {
 	select {
 	case <-change.Quit:
 		gracefulQuit(change)
 		return
 	default:
-		buf, err := ioutil.ReadFile(path)
-		if err != nil {
-			writeError(err, change, "uploader")
-			return
+		neededBlocks := make(map[string]bool)
+		for _, hash := range needed {
+			neededBlocks[hash] = true
 		}
-		err = client.UploadFileToServer(buf)
+		f, err := os.Open(path)
 		if err != nil {
 			writeError(err, change, "uploader")
 			return
 		}
+		defer f.Close()
+		for _, block := range plainBlocks(fileBlocks(change.File)) {
+			if !neededBlocks[block.Hash] {
+				continue
+			}
+			// a block can appear more than once in a file
+			delete(neededBlocks, block.Hash)
+			select {
+			case <-change.Quit:
+				gracefulQuit(change)
+				return
+			default:
+			}
+			contents, size, err := blockContents(f, block)
+			if err == nil {
+				err = client.UploadFileToServer(block.Hash, size, contents)
+			}
+			if err != nil {
+				writeError(err, change, "uploader")
+				return
+			}
+		}
 		change.Done <- fa
 		close(change.Error)
 	}
 	return
 }
 
+// reuploadBlocks sends the server blocks it lost or found damaged, if the
+// local file still holds them. Blocks that don't check out locally are
+// skipped, another client may have a good copy.
+func reuploadBlocks(requests []structs.ReuploadRequest) {
+	for _, request := range requests {
+		f, err := os.Open(request.Path)
+		if err != nil {
+			continue
+		}
+		contents, found := findBlock(f, request)
+		if !found {
+			f.Close()
+			continue
+		}
+		err = client.UploadFileToServer(request.Hash, request.Size, contents)
+		f.Close()
+		if err != nil {
+			fmt.Println("Couldn't reupload", request.Path, err)
+		}
+	}
+}
+
+// findBlock returns the contents of the block request asks for, if f
+// still holds it. With end to end encryption the server only knows where
+// the block is in the ciphertext, so the file is split again to find it.
+func findBlock(f *os.File, request structs.ReuploadRequest) (
+	contents io.ReaderAt, found bool) {
+	if e2eKey == nil {
+		section := io.NewSectionReader(f, request.Offset, request.Size)
+		h := sha256.New()
+		_, err := io.Copy(h, section)
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != request.Hash {
+			return nil, false
+		}
+		return section, true
+	}
+	blocks, _, _, err := splitFile(f)
+	if err != nil {
+		return nil, false
+	}
+	for _, block := range plainBlocks(blocks) {
+		if block.Hash != request.Hash {
+			continue
+		}
+		contents, _, err = blockContents(f, block)
+		return contents, err == nil
+	}
+	return nil, false
+}
+
+// fileBlocks returns the blocks a file is made of. Files from a server
+// that doesn't split files are a single block.
+func fileBlocks(file structs.File) []structs.Block {
+	if len(file.Blocks) != 0 || file.Size == 0 {
+		return file.Blocks
+	}
+	return []structs.Block{
+		structs.Block{Hash: file.Hash, Size: file.Size},
+	}
+}
+
 func gracefulQuit(change structs.StateChange) {
 	close(change.Done)
 	close(change.Error)
@@ -389,12 +674,25 @@ func hasher(change structs.StateChange) {
 		gracefulQuit(change)
 		return
 	default:
-		h, err := getSha256FromFilename(change.File.Path)
+		f, err := os.Open(change.File.Path)
+		if err != nil {
+			writeError(err, change, "hasher")
+			return
+		}
+		blocks, h, size, err := splitFile(f)
+		f.Close()
 		if err != nil {
 			writeError(err, change, "hasher")
 			return
 		}
 		change.File.Hash = h
+		change.File.Size = size
+		change.File.Blocks = blocks
+		if change.IsCreate && h == change.PreviousHash {
+			// nothing changed, e.g. we just downloaded this file
+			writeDone(change, makeFileAction(change))
+			return
+		}
 		go fileActionSender(change)
 	}
 	return
@@ -457,47 +755,254 @@ func serverDeleter(change structs.StateChange) {
 	writeDone(change, makeFileAction(change))
 }
 
+// downloader builds the file in .Gobox/tmp, checks it against the hash the
+// server gave us and only then renames it over change.File.Path, so a
+// crash or a bad response never leaves a half written file behind for the
+// watcher to pick up. Only one download of a hash runs at a time, since
+// the tmp file is named after it.
 func downloader(change structs.StateChange) {
 	fmt.Println("Change: ", change.File.Hash)
+	unlock := lockDownload(change.File.Hash)
+	defer unlock()
 	select {
 	case <-change.Quit:
 		gracefulQuit(change)
 		return
 	default:
-		// this could take a long time
-		s3_url, err := client.DownloadFileFromServer(change.File.Hash)
+		// this could take a long time. An unfinished tmp file is kept,
+		// so the next attempt can carry on from where this one stopped
+		tmpFilename := filepath.Join(goboxTmpDirectory, change.File.Hash)
+		err := assembleFile(change.File, tmpFilename, change.Quit)
 		if err != nil {
 			writeError(err, change, "downloader")
+			return
+		}
+		h, err := fileHash(tmpFilename)
+		if err == nil && h != change.File.Hash {
+			err = fmt.Errorf("Downloaded %s doesn't match hash %s",
+				change.File.Path, change.File.Hash)
 		}
-		resp, err := http.Get(s3_url)
 		if err != nil {
+			os.Remove(tmpFilename)
 			writeError(err, change, "downloader")
+			return
+		}
+		if !change.File.Modified.IsZero() {
+			err = os.Chtimes(tmpFilename, time.Now(), change.File.Modified)
+			if err != nil {
+				writeError(err, change, "downloader")
+				return
+			}
+		}
+		select {
+		case <-change.Quit:
+			os.Remove(tmpFilename)
+			gracefulQuit(change)
+			return
+		default:
+			err = os.MkdirAll(filepath.Dir(change.File.Path), 0755)
+			if err == nil {
+				err = os.Rename(tmpFilename, change.File.Path)
+			}
+			if err != nil {
+				writeError(err, change, "downloader")
+				return
+			}
+			writeDone(change, makeFileAction(change))
+		}
+	}
+	return
+}
+
+// assembleFile writes file's blocks in order to path. Blocks that the
+// local copy of the file already has are copied out of it, only the rest
+// are downloaded. Whatever path already holds from an earlier attempt is
+// kept as long as its blocks check out.
+func assembleFile(file structs.File, path string, quit <-chan bool) (err error) {
+	localBlocks := make(map[string]structs.Block)
+	local, err := os.Open(file.Path)
+	if err == nil {
+		defer local.Close()
+		blocks, _, _, err := splitFile(local)
+		if err == nil {
+			for _, block := range plainBlocks(blocks) {
+				localBlocks[block.Hash] = block
+			}
+		}
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+	fi, err := out.Stat()
+	if err != nil {
+		return
+	}
+	existing := fi.Size()
+
+	var offset int64
+	for _, block := range plainBlocks(fileBlocks(file)) {
+		select {
+		case <-quit:
+			return fmt.Errorf("Download of %s cancelled", file.Path)
+		default:
+		}
+		have := existing - offset
+		if have < 0 {
+			have = 0
+		} else if have > block.Size {
+			have = block.Size
+		}
+		err = writeBlock(out, offset, have, block, localBlocks, local)
+		if err != nil && have > 0 {
+			// what an earlier attempt left behind is no good
+			existing = offset
+			err = writeBlock(out, offset, 0, block, localBlocks, local)
 		}
-		contents, err := ioutil.ReadAll(resp.Body)
-		fmt.Println(contents)
 		if err != nil {
-			writeError(err, change, "downloader")
+			return
+		}
+		offset += block.Size
+	}
+	err = out.Truncate(offset)
+	if err != nil {
+		return
+	}
+	return out.Sync()
+}
+
+// writeBlock makes sure out holds block at offset. The first have bytes
+// are already there, the rest are copied from the local file if it has the
+// block, or downloaded. The block is checked against its hash once it's
+// complete.
+func writeBlock(out *os.File, offset int64, have int64, block structs.Block,
+	localBlocks map[string]structs.Block, local *os.File) (err error) {
+	if e2eKey != nil {
+		return writeSealedBlock(out, offset, have, block, localBlocks, local)
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(out, offset, have))
+	if err != nil {
+		return
+	}
+	_, err = out.Seek(offset+have, 0)
+	if err != nil {
+		return
+	}
+	w := io.MultiWriter(out, h)
+	if have < block.Size {
+		if localBlock, found := localBlocks[block.Hash]; found {
+			_, err = io.Copy(w, io.NewSectionReader(
+				local, localBlock.Offset+have, localBlock.Size-have))
+		} else {
+			err = downloadBlock(block.Hash, have, w)
 		}
-		//tmpFilename := filepath.Join(".Gobox/tmp/", change.File.Hash)
-		err = ioutil.WriteFile(change.File.Path, contents, 0644)
 		if err != nil {
-			writeError(err, change, "downloader")
+			return
+		}
+	}
+	if hex.EncodeToString(h.Sum(nil)) != block.Hash {
+		return fmt.Errorf("Block %s doesn't match its hash", block.Hash)
+	}
+	return
+}
+
+// writeSealedBlock is writeBlock for end to end encrypted blocks. block is
+// where the block goes in the file, its Hash names the ciphertext. Blocks
+// can only be checked whole, so one an earlier attempt left half written
+// is fetched again.
+func writeSealedBlock(out *os.File, offset int64, have int64,
+	block structs.Block, localBlocks map[string]structs.Block,
+	local *os.File) (err error) {
+	if have == block.Size {
+		sealed, err := sealBlock(out, offset, block.Size)
+		if err == nil && e2e.Name(sealed) == block.Hash {
+			return nil
 		}
-		//select {
-		//case <-change.Quit:
-		//gracefulQuit(change)
-		//return
-		//default:
-		//err = os.Rename(tmpFilename, change.File.Path)
-		//if err != nil {
-		//writeError(err, change, "downloader")
-		//}
-		//}
-	}
-	fmt.Println("look")
+	}
+	var plain []byte
+	if localBlock, found := localBlocks[block.Hash]; found {
+		plain = make([]byte, localBlock.Size)
+		_, err = local.ReadAt(plain, localBlock.Offset)
+		if err == io.EOF && localBlock.Size == 0 {
+			err = nil
+		}
+		if err == nil && e2e.Name(e2eKey.Seal(plain)) != block.Hash {
+			err = fmt.Errorf("Block %s changed locally", block.Hash)
+		}
+	} else {
+		var sealed bytes.Buffer
+		err = downloadBlock(block.Hash, 0, &sealed)
+		if err == nil && e2e.Name(sealed.Bytes()) != block.Hash {
+			err = fmt.Errorf("Block %s doesn't match its hash", block.Hash)
+		}
+		if err == nil {
+			plain, err = e2eKey.Open(sealed.Bytes())
+		}
+	}
+	if err != nil {
+		return
+	}
+	if int64(len(plain)) != block.Size {
+		return fmt.Errorf("Block %s has the wrong size", block.Hash)
+	}
+	_, err = out.WriteAt(plain, offset)
 	return
 }
 
+// downloadBlock writes the block stored under hash to out, starting at
+// offset. If the connection drops part way it asks for the rest of the
+// block with a Range request, rather than starting the block again.
+func downloadBlock(hash string, offset int64, out io.Writer) (err error) {
+	written := offset
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second * time.Duration(1<<uint(attempt-1)))
+		}
+		var n int64
+		n, err = downloadBlockFrom(hash, written, out)
+		written += n
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func downloadBlockFrom(hash string, offset int64, out io.Writer) (
+	written int64, err error) {
+	s3_url, err := client.DownloadFileFromServer(hash)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("GET", s3_url, nil)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the range was ignored, skip what we already have
+		_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+		if err != nil {
+			return
+		}
+	default:
+		return 0, fmt.Errorf("Downloading block %s: %s", hash, resp.Status)
+	}
+	return io.Copy(out, resp.Body)
+}
+
 func localDeleter(change structs.StateChange) {
 	go fileActionSender(change)
 }
@@ -611,11 +1116,187 @@ func stephen(goboxFileSystemStateFile string, stateChanges <-chan structs.StateC
 		writeFileSystemStateCounter++
 	}
 }
+
+// login asks for an email and password and starts a session with them for
+// this device, signing up first if signUp is set. The session is saved in
+// the gobox directory at path.
+func login(path string, signUp bool) (err error) {
+	stdin := bufio.NewReader(os.Stdin)
+	fmt.Print("Email: ")
+	email, err := stdin.ReadString('\n')
+	if err != nil {
+		return
+	}
+	fmt.Print("Password: ")
+	password, err := stdin.ReadString('\n')
+	if err != nil {
+		return
+	}
+	email = strings.TrimSpace(email)
+	password = strings.TrimRight(password, "\r\n")
+	name, err := os.Hostname()
+	if err != nil {
+		return
+	}
+
+	var session structs.Session
+	if signUp {
+		session, err = api.SignUp(email, password, name)
+	} else {
+		session, err = api.Login(email, password, name, "")
+		if err == api.ErrCodeRequired {
+			var code string
+			code, err = prompt(stdin, "Authentication or recovery code: ")
+			if err != nil {
+				return
+			}
+			session, err = api.Login(email, password, name, code)
+		}
+	}
+	if err != nil {
+		return
+	}
+	goboxDataDirectory := filepath.Join(path, dataDirectoryBasename)
+	createGoboxLocalDirectory(goboxDataDirectory)
+	err = writeSessionToLocalFile(session,
+		filepath.Join(goboxDataDirectory, sessionFileBasename))
+	if err != nil {
+		return
+	}
+	fmt.Printf("Logged in as %s on %s\n", session.Email, session.ClientName)
+	return
+}
+
+// loginWithSSO signs in through the server's identity provider in the
+// browser, and waits for the session to come back on a local port.
+func loginWithSSO(path string) (err error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+	sessions := make(chan structs.Session, 1)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		session, err := api.DecodeSSOSession(req.FormValue("session"))
+		if err != nil || session.SessionKey == "" {
+			http.Error(w, "Couldn't sign in.", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Signed in, you can close this window.")
+		select {
+		case sessions <- session:
+		default:
+		}
+	}))
+	fmt.Println("Open this link to sign in:")
+	fmt.Println(api.SSOLoginURL(name, "http://"+ln.Addr().String()+"/"))
+	session := <-sessions
+
+	goboxDataDirectory := filepath.Join(path, dataDirectoryBasename)
+	createGoboxLocalDirectory(goboxDataDirectory)
+	err = writeSessionToLocalFile(session,
+		filepath.Join(goboxDataDirectory, sessionFileBasename))
+	if err != nil {
+		return
+	}
+	fmt.Printf("Logged in as %s on %s\n", session.Email, session.ClientName)
+	return
+}
+
+// enrollTOTP turns on two-factor authentication for the account the
+// gobox directory at path is logged in to.
+func enrollTOTP(path string) (err error) {
+	session, err := fetchSession(
+		filepath.Join(path, dataDirectoryBasename, sessionFileBasename))
+	if err != nil {
+		return
+	}
+	c := api.New(session.SessionKey)
+	enrollment, err := c.EnrollTOTP()
+	if err != nil {
+		return
+	}
+	fmt.Println("Add this key to your authenticator app:", enrollment.Secret)
+	fmt.Println("or open", enrollment.URL)
+	code, err := prompt(bufio.NewReader(os.Stdin), "Code from the app: ")
+	if err != nil {
+		return
+	}
+	recoveryCodes, err := c.ConfirmTOTP(code)
+	if err != nil {
+		return
+	}
+	fmt.Println("Two-factor authentication is on. Keep these recovery codes " +
+		"somewhere safe, each can be used once instead of a code:")
+	for _, recoveryCode := range recoveryCodes {
+		fmt.Println(" ", recoveryCode)
+	}
+	return
+}
+
+func prompt(stdin *bufio.Reader, question string) (answer string, err error) {
+	fmt.Print(question)
+	answer, err = stdin.ReadString('\n')
+	return strings.TrimSpace(answer), err
+}
+
+// writeSessionToLocalFile saves session where only the user can read it,
+// the session key is all it takes to act as this client.
+func writeSessionToLocalFile(session structs.Session, path string) error {
+	jsonBytes, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonBytes, 0600)
+}
+
+// logout revokes the session saved in the gobox directory at path, and
+// removes it.
+func logout(path string) (err error) {
+	sessionFile := filepath.Join(path, dataDirectoryBasename, sessionFileBasename)
+	session, err := fetchSession(sessionFile)
+	if err != nil {
+		return
+	}
+	c := api.New(session.SessionKey)
+	err = c.Revoke()
+	if err != nil {
+		return
+	}
+	return os.Remove(sessionFile)
+}
+
+// refreshSession keeps the session from expiring while the client runs.
+func refreshSession(path string) {
+	for range time.Tick(sessionRefreshInterval) {
+		session, err := client.Refresh()
+		if err == nil {
+			err = writeSessionToLocalFile(session, path)
+		}
+		if err != nil {
+			fmt.Println("Couldn't refresh the session:", err)
+		}
+	}
+}
+
+func fetchSession(path string) (session structs.Session, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &session)
+	return
+}
+
 func run(path string) {
 	errChans := make([]chan interface{}, 0)
 	watcherInitScanDone := make(chan struct{})
 	serverActionsInitScanDone := make(chan struct{})
-	client = api.New("")
 	err := os.Chdir(path)
 	if err != nil {
 		fmt.Println("unable to change dir, quitting")
@@ -623,10 +1304,36 @@ func run(path string) {
 	}
 	goboxDirectory := "."
 	goboxDataDirectory := filepath.Join(goboxDirectory, dataDirectoryBasename)
+	sessionFile := filepath.Join(goboxDataDirectory, sessionFileBasename)
+	session, err := fetchSession(sessionFile)
+	if err != nil {
+		fmt.Println("Not logged in, run: ./gobox_client login", path)
+		return
+	}
+	client = api.New(session.SessionKey)
+	// a new key every run, so an old copy of the session file is no use
+	session, err = client.Rotate()
+	if err != nil {
+		fmt.Println("Session expired or was revoked, run: ./gobox_client login", path)
+		return
+	}
+	err = writeSessionToLocalFile(session, sessionFile)
+	if err != nil {
+		fmt.Println("Couldn't save the session:", err)
+		return
+	}
+	go refreshSession(sessionFile)
+	e2eKey, err = setUpE2E(os.Getenv(e2ePassphraseEnv))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	goboxFileSystemStateFile := filepath.Join(goboxDataDirectory, "fileSystemState")
 	goboxFileActionIdFile := filepath.Join(goboxDataDirectory, "fileActionId")
 
 	createGoboxLocalDirectory(goboxDataDirectory)
+	createGoboxLocalDirectory(goboxTmpDirectory)
+	removeStaleDownloads(goboxTmpDirectory)
 	initActions, err := findChangedFilesOnInit(
 		goboxFileSystemStateFile,
 		goboxDirectory,
@@ -657,11 +1364,23 @@ func run(path string) {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("usage: ./gobox_client PATH_TO_GOBOX_DIRECTORY")
+	var command, path string
+	switch len(os.Args) {
+	case 2:
+		path = os.Args[1]
+	case 3:
+		command, path = os.Args[1], os.Args[2]
+	}
+	switch command {
+	case "", "login", "sign-up", "sso", "logout", "2fa":
+	default:
+		path = ""
+	}
+	if path == "" {
+		fmt.Println("usage: ./gobox_client [login | sign-up | sso | logout | 2fa] PATH_TO_GOBOX_DIRECTORY")
 		return
 	}
-	fi, err := os.Stat(os.Args[1])
+	fi, err := os.Stat(path)
 	if err != nil {
 		fmt.Println("Error reading gobox directory")
 		return
@@ -671,6 +1390,33 @@ func main() {
 		return
 	}
 
-	fmt.Println("Running : ", os.Args[1])
-	run(os.Args[1])
+	switch command {
+	case "login", "sign-up":
+		err = login(path, command == "sign-up")
+		if err != nil {
+			fmt.Println("Couldn't log in:", err)
+		}
+		return
+	case "sso":
+		err = loginWithSSO(path)
+		if err != nil {
+			fmt.Println("Couldn't log in:", err)
+		}
+		return
+	case "logout":
+		err = logout(path)
+		if err != nil {
+			fmt.Println("Couldn't log out:", err)
+		}
+		return
+	case "2fa":
+		err = enrollTOTP(path)
+		if err != nil {
+			fmt.Println("Couldn't turn on two-factor authentication:", err)
+		}
+		return
+	}
+
+	fmt.Println("Running : ", path)
+	run(path)
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"time"
 
+	"github.com/golangbox/gobox/client/chunker"
+	"github.com/golangbox/gobox/client/e2e"
+
 	"github.com/golangbox/gobox/boxtools"
 	"github.com/golangbox/gobox/structs"
 
@@ -17,13 +23,15 @@ const (
 )
 
 func TestStartWatcher(t *testing.T) {
-	_, err := startWatcher("/billybob")
+	initScanDone := make(chan struct{})
+	close(initScanDone)
+	_, err := startWatcher("/billybob", initScanDone)
 	if err == nil {
 		t.Log("startWatcher must fail on invalid directory")
 		t.FailNow()
 	}
 
-	ch, err := startWatcher(sandboxDir)
+	ch, err := startWatcher(sandboxDir, initScanDone)
 	if err != nil {
 		t.Log("startWatcher didn't work on a valid directory")
 		t.FailNow()
@@ -61,7 +69,7 @@ func TestServerActions(t *testing.T) {
 func TestFanActionsIn(t *testing.T) {
 
 	ch1, ch2 := make(chan structs.StateChange), make(chan structs.StateChange)
-	out := fanActionsIn(ch1, ch2)
+	out := fanActionsIn(ch1, ch2, make(chan structs.StateChange))
 	numRead := 0
 	go func() { ch1 <- structs.StateChange{} }()
 	go func() { ch2 <- structs.StateChange{} }()
@@ -131,3 +139,128 @@ func TestStephen(t *testing.T) {
 func TestHasherQuitsProperly(t *testing.T) {
 
 }
+
+func TestAssembleFileFromLocalBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := bytes.Repeat([]byte("gobox "), 1024)
+	blocks, h, size, _ := chunker.Split(bytes.NewReader(contents))
+	file := structs.File{
+		Path:   filepath.Join(dir, "file"),
+		Hash:   h,
+		Size:   size,
+		Blocks: blocks,
+	}
+	ioutil.WriteFile(file.Path, contents, 0644)
+
+	// a corrupt leftover from an earlier attempt must be replaced
+	tmpFilename := filepath.Join(dir, h)
+	ioutil.WriteFile(tmpFilename, []byte("garbage"), 0644)
+
+	err = assembleFile(file, tmpFilename, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembled, _ := ioutil.ReadFile(tmpFilename)
+	if !bytes.Equal(assembled, contents) {
+		t.Error("Assembled file doesn't match the original")
+	}
+}
+
+func TestAssembleSealedFileFromLocalBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e2eKey, err = e2e.DeriveKey("passphrase", []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { e2eKey = nil }()
+
+	contents := bytes.Repeat([]byte("gobox "), 1024)
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, contents, 0644)
+	f, _ := os.Open(path)
+	blocks, h, size, err := splitFile(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, plainHash, _, _ := chunker.Split(bytes.NewReader(contents))
+	if h == plainHash || size != int64(len(contents)) {
+		t.Error("Sealed file should be known by a keyed hash")
+	}
+	if len(blocks) != 1 || blocks[0].Size != int64(len(contents))+e2e.Overhead {
+		t.Error("Server should see the size of the sealed block")
+	}
+	file := structs.File{Path: path, Hash: h, Size: size, Blocks: blocks}
+
+	tmpFilename := filepath.Join(dir, h)
+	ioutil.WriteFile(tmpFilename, []byte("garbage"), 0644)
+	err = assembleFile(file, tmpFilename, make(chan bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembled, _ := ioutil.ReadFile(tmpFilename)
+	if !bytes.Equal(assembled, contents) {
+		t.Error("Assembled file doesn't match the original")
+	}
+	hash, _ := fileHash(tmpFilename)
+	if hash != h {
+		t.Error("Assembled file doesn't match its encrypted hash")
+	}
+}
+
+func TestDownloadSameHashTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(tmp string) { goboxTmpDirectory = tmp }(goboxTmpDirectory)
+	goboxTmpDirectory = filepath.Join(dir, "tmp")
+	os.Mkdir(goboxTmpDirectory, 0755)
+
+	contents := bytes.Repeat([]byte("copies "), 64*1024)
+	blocks, h, size, _ := chunker.Split(bytes.NewReader(contents))
+	for round := 0; round < 10; round++ {
+		var errs []chan interface{}
+		for _, name := range []string{"a", "b"} {
+			file := structs.File{
+				Path:   filepath.Join(dir, name),
+				Hash:   h,
+				Size:   size,
+				Blocks: blocks,
+			}
+			ioutil.WriteFile(file.Path, contents, 0644)
+			done := make(chan interface{}, 1)
+			errChan := make(chan interface{}, 1)
+			errs = append(errs, errChan)
+			go downloader(structs.StateChange{
+				File:     file,
+				IsCreate: true,
+				Quit:     make(chan bool),
+				Done:     done,
+				Error:    errChan,
+			})
+		}
+		for _, errChan := range errs {
+			if message, ok := <-errChan; ok {
+				t.Fatal("Download failed:", message.(structs.ErrorMessage).Error)
+			}
+		}
+		for _, name := range []string{"a", "b"} {
+			downloaded, _ := ioutil.ReadFile(filepath.Join(dir, name))
+			if !bytes.Equal(downloaded, contents) {
+				t.Fatal("Downloads of the same contents shouldn't share a file")
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Package e2e encrypts file contents on the client, with a key derived
+// from a passphrase the server never sees.
+//
+// Blocks are encrypted convergently: the nonce is a keyed hash of the
+// plaintext, so the same block always encrypts to the same ciphertext
+// under the same key. Blocks are then named by the sha256 of their
+// ciphertext, which lets the server verify uploads and dedup a user's
+// blocks as before, while only someone holding the key can work out which
+// name a given plaintext would get.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"code.google.com/p/go.crypto/scrypt"
+)
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+	// Overhead is how much longer a sealed block is than its plaintext.
+	Overhead = nonceSize + tagSize
+	SaltSize = 16
+)
+
+// scrypt parameters, the ones recommended for interactive logins
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var ErrCorrupt = errors.New("e2e: block failed authentication")
+
+type Key struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// DeriveKey stretches passphrase into a key. Every client of a user has
+// to use the same salt to be able to read each other's files.
+func DeriveKey(passphrase string, salt []byte) (*Key, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR,
+		scryptP, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead, mac: derived[32:]}, nil
+}
+
+// Check returns a value the server can keep to tell clients whether they
+// derived the same key as the first one did, without learning the key.
+func (k *Key) Check() string {
+	return hex.EncodeToString(k.sum("check", nil))
+}
+
+// Seal encrypts a block.
+func (k *Key) Seal(plain []byte) []byte {
+	nonce := k.sum("nonce", plain)[:nonceSize]
+	return k.aead.Seal(nonce, nonce, plain, nil)
+}
+
+// Open decrypts a block sealed with the same key.
+func (k *Key) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrCorrupt
+	}
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plain, nil
+}
+
+// Name returns the name a sealed block is stored under.
+func Name(sealed []byte) string {
+	h := sha256.Sum256(sealed)
+	return hex.EncodeToString(h[:])
+}
+
+// FileHash turns the sha256 of a file's plaintext into the hash the
+// server is told, so it can't be compared against hashes of known files.
+func (k *Key) FileHash(plainHash string) string {
+	return hex.EncodeToString(k.sum("file", []byte(plainHash)))
+}
+
+// PlainSize returns the size of the plaintext of a sealed block.
+func PlainSize(sealedSize int64) int64 {
+	if sealedSize < Overhead {
+		return 0
+	}
+	return sealedSize - Overhead
+}
+
+func (k *Key) sum(purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, k.mac)
+	mac.Write([]byte("gobox e2e " + purpose + "\x00"))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
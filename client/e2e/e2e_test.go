@@ -0,0 +1,82 @@
+package e2e
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKey(t *testing.T, passphrase string, salt []byte) *Key {
+	key, err := DeriveKey(passphrase, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, "correct horse battery staple", salt)
+
+	plain := []byte("this is a file")
+	sealed := key.Seal(plain)
+	if int64(len(sealed)) != int64(len(plain))+Overhead ||
+		PlainSize(int64(len(sealed))) != int64(len(plain)) {
+		t.Error("Sealed block has the wrong size")
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Error("Sealed block contains its plaintext")
+	}
+	opened, err := key.Open(sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Error("Sealed block didn't open to its plaintext")
+	}
+
+	if !bytes.Equal(key.Seal(plain), sealed) {
+		t.Error("Sealing the same block twice should give the same ciphertext")
+	}
+	if bytes.Equal(key.Seal([]byte("this is a fild")), sealed) {
+		t.Error("Different blocks sealed to the same ciphertext")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = key.Open(sealed)
+	if err != ErrCorrupt {
+		t.Error("A damaged block should fail to open")
+	}
+	_, err = key.Open(sealed[:Overhead-1])
+	if err != ErrCorrupt {
+		t.Error("A truncated block should fail to open")
+	}
+}
+
+func TestKeysDiffer(t *testing.T) {
+	salt, _ := NewSalt()
+	key := testKey(t, "passphrase", salt)
+	same := testKey(t, "passphrase", salt)
+	other := testKey(t, "other passphrase", salt)
+	otherSalt, _ := NewSalt()
+	salted := testKey(t, "passphrase", otherSalt)
+
+	if key.Check() != same.Check() {
+		t.Error("The same passphrase and salt should give the same key")
+	}
+	if key.Check() == other.Check() || key.Check() == salted.Check() {
+		t.Error("A different passphrase or salt should give a different key")
+	}
+
+	plain := []byte("this is a file")
+	if Name(key.Seal(plain)) == Name(other.Seal(plain)) {
+		t.Error("Block names should depend on the key")
+	}
+	if key.FileHash("abc") != same.FileHash("abc") ||
+		key.FileHash("abc") == other.FileHash("abc") {
+		t.Error("File hashes should be keyed")
+	}
+	_, err := other.Open(key.Seal(plain))
+	if err != ErrCorrupt {
+		t.Error("A block shouldn't open with another key")
+	}
+}
@@ -0,0 +1,264 @@
+// Command gobox-admin runs maintenance tasks against a gobox server's
+// database and blob store.
+//
+//	gobox-admin gc [-dry-run] [-grace 24h] [-retention 720h] [-trash-retention 720h]
+//	gobox-admin reconcile [-dry-run]
+//	gobox-admin scrub [-limit 0] [-min-age 0]
+//	gobox-admin tier [-dry-run] [-idle 2160h] [-old-versions 168h] [-limit 0]
+//	gobox-admin grant-admin email
+//	gobox-admin revoke-sessions email
+//	gobox-admin rotate-keys [-new]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/gc"
+	"github.com/golangbox/gobox/server/keys"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/scrub"
+	"github.com/golangbox/gobox/server/tiering"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+const defaultDatabase = "dbname=gobox sslmode=disable"
+
+var commands = map[string]func(args []string) error{
+	"gc":              runGC,
+	"reconcile":       runReconcile,
+	"scrub":           runScrub,
+	"tier":            runTier,
+	"grant-admin":     runGrantAdmin,
+	"revoke-sessions": runRevokeSessions,
+	"rotate-keys":     runRotateKeys,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gobox-admin <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  gc               delete blobs no file refers to anymore")
+	fmt.Fprintln(os.Stderr, "  reconcile        bring the blob index in line with the blob store")
+	fmt.Fprintln(os.Stderr, "  scrub            read blobs back and flag damaged ones")
+	fmt.Fprintln(os.Stderr, "  tier             move rarely needed blobs to the cold tier")
+	fmt.Fprintln(os.Stderr, "  grant-admin      let a user use the admin api")
+	fmt.Fprintln(os.Stderr, "  revoke-sessions  log every client of a user out")
+	fmt.Fprintln(os.Stderr, "  rotate-keys      wrap every data key with the current master key")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	database := os.Getenv("GOBOX_DATABASE")
+	if database == "" {
+		database = defaultDatabase
+	}
+	var err error
+	model.DB, err = gorm.Open("postgres", database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = command(os.Args[2:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runGC(args []string) (err error) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false,
+		"report what would be marked and deleted without changing anything")
+	grace := flags.Duration("grace", gc.DefaultGracePeriod,
+		"how long a blob stays marked before it is deleted")
+	retention := flags.Duration("retention", gc.DefaultVersionRetention,
+		"how long replaced and deleted versions are kept")
+	trashRetention := flags.Duration("trash-retention", gc.DefaultTrashRetention,
+		"how long deleted files stay in the trash")
+	flags.Parse(args)
+
+	store, err := server.NewBlobStoreFromEnv()
+	if err != nil {
+		return
+	}
+	report, err := gc.Collect(store, gc.Options{
+		GracePeriod:      *grace,
+		VersionRetention: *retention,
+		TrashRetention:   *trashRetention,
+		DryRun:           *dryRun,
+	})
+	if err != nil {
+		return
+	}
+	if *dryRun {
+		for _, hash := range report.Marked {
+			fmt.Println("would mark", hash)
+		}
+		for _, hash := range report.Swept {
+			fmt.Println("would delete", hash)
+		}
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return
+}
+
+func runReconcile(args []string) (err error) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false,
+		"report the differences without fixing the index")
+	flags.Parse(args)
+
+	store, err := server.NewBlobStoreFromEnv()
+	if err != nil {
+		return
+	}
+	report, err := blobindex.Reconcile(store, *dryRun)
+	if err != nil {
+		return
+	}
+	for _, hash := range report.Unindexed {
+		fmt.Println("unindexed", hash)
+	}
+	for _, hash := range report.Missing {
+		fmt.Println("missing", hash)
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return
+}
+
+func runScrub(args []string) (err error) {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	limit := flags.Int("limit", 0, "check at most this many blobs, 0 checks all")
+	minAge := flags.Duration("min-age", 0, "skip blobs checked more recently than this")
+	flags.Parse(args)
+
+	store, err := server.NewBlobStoreFromEnv()
+	if err != nil {
+		return
+	}
+	report, err := scrub.Scrub(store, scrub.Options{
+		Limit:  *limit,
+		MinAge: *minAge,
+	})
+	if err != nil {
+		return
+	}
+	for _, hash := range report.Corrupt {
+		fmt.Println("corrupt", hash)
+	}
+	for _, hash := range report.Missing {
+		fmt.Println("missing", hash)
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return
+}
+
+func runTier(args []string) (err error) {
+	flags := flag.NewFlagSet("tier", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false,
+		"report what would be moved without moving anything")
+	idle := flags.Duration("idle", tiering.DefaultIdleAfter,
+		"move blobs nothing has read for this long, 0 doesn't")
+	oldVersions := flags.Duration("old-versions", tiering.DefaultOldVersionsAfter,
+		"move blobs only old versions need once nothing has read them for this long, 0 doesn't")
+	limit := flags.Int("limit", 0, "move at most this many blobs, 0 moves all")
+	flags.Parse(args)
+
+	store, err := server.NewBlobStoreFromEnv()
+	if err != nil {
+		return
+	}
+	tiered := blobstore.FindTiered(store)
+	if tiered == nil {
+		return fmt.Errorf("GOBOX_COLD_BLOBSTORE isn't set")
+	}
+	report, err := tiering.Apply(tiered, tiering.Policy{
+		IdleAfter:        *idle,
+		OldVersionsAfter: *oldVersions,
+		Limit:            *limit,
+		DryRun:           *dryRun,
+	})
+	if err != nil {
+		return
+	}
+	if *dryRun {
+		for _, hash := range report.Idle {
+			fmt.Println("would move idle", hash)
+		}
+		for _, hash := range report.OldVersions {
+			fmt.Println("would move old version", hash)
+		}
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return
+}
+
+func runGrantAdmin(args []string) (err error) {
+	if len(args) != 1 {
+		usage()
+	}
+	var user structs.User
+	query := model.DB.Where("email = ?", args[0]).First(&user)
+	if query.Error != nil {
+		return fmt.Errorf("No user %s: %s", args[0], query.Error)
+	}
+	user.IsAdmin = true
+	return model.DB.Save(&user).Error
+}
+
+func runRevokeSessions(args []string) (err error) {
+	if len(args) != 1 {
+		usage()
+	}
+	var user structs.User
+	query := model.DB.Where("email = ?", args[0]).First(&user)
+	if query.Error != nil {
+		return fmt.Errorf("No user %s: %s", args[0], query.Error)
+	}
+	return boxtools.RevokeUserSessions(user)
+}
+
+func runRotateKeys(args []string) (err error) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	newKey := flags.Bool("new", false,
+		"add a new master key to the key file first")
+	flags.Parse(args)
+
+	path := os.Getenv("GOBOX_MASTER_KEY_FILE")
+	if path == "" {
+		return fmt.Errorf("GOBOX_MASTER_KEY_FILE isn't set")
+	}
+	if *newKey {
+		var masterKey keys.MasterKey
+		masterKey, err = keys.AddMasterKey(path)
+		if err != nil {
+			return
+		}
+		fmt.Println("added master key", masterKey.Id)
+	}
+	ring, err := keys.NewRingFromFile(path)
+	if err != nil {
+		return
+	}
+	rotated, err := ring.Rotate()
+	if err != nil {
+		return
+	}
+	fmt.Printf("wrapped %d data keys with the current master key\n", rotated)
+	return
+}
@@ -22,12 +22,32 @@ func init() {
 	model.DB.DropTableIfExists(&structs.FileAction{})
 	model.DB.DropTableIfExists(&structs.File{})
 	model.DB.DropTableIfExists(&structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.UploadSession{})
+	model.DB.DropTableIfExists(&structs.GCCandidate{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.DropTableIfExists(&structs.EmailToken{})
+	model.DB.DropTableIfExists(&structs.Namespace{})
+	model.DB.DropTableIfExists(&structs.NamespaceMember{})
+	model.DB.DropTableIfExists(&structs.ShareLink{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
 	model.DB.AutoMigrate(
 		&structs.User{},
 		&structs.Client{},
 		&structs.FileAction{},
 		&structs.File{},
 		&structs.FileSystemFile{},
+		&structs.Block{},
+		&structs.UploadSession{},
+		&structs.GCCandidate{},
+		&structs.Blob{},
+		&structs.DataKey{},
+		&structs.EmailToken{},
+		&structs.Namespace{},
+		&structs.NamespaceMember{},
+		&structs.ShareLink{},
+		&structs.TrashedFile{},
 	)
 
 }
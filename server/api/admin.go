@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/scrub"
+	"github.com/golangbox/gobox/structs"
+)
+
+// adminValidate is sessionValidate for routes only admins may use.
+func adminValidate(fn func(http.ResponseWriter, *http.Request, structs.Client)) http.HandlerFunc {
+	return sessionValidate(func(w http.ResponseWriter, req *http.Request,
+		client structs.Client) {
+		var user structs.User
+		query := model.DB.Model(&client).Related(&user)
+		if query.Error != nil || !user.IsAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fn(w, req, client)
+	})
+}
+
+// DamagedBlobsHandler lists every blob the scrubber flagged.
+func DamagedBlobsHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	blobs, err := blobindex.Damaged()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, blobs)
+}
+
+// ScrubHandler checks up to limit blobs right away, instead of waiting
+// for the background scrubber.
+func ScrubHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var options scrub.Options
+	if limit := req.FormValue("limit"); limit != "" {
+		var err error
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("limit must be a number."))
+			return
+		}
+	}
+	report, err := scrub.Scrub(Store, options)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if report.Damaged() {
+		// clients pick up reupload requests when they next sync
+		Pusher.Notify("")
+	}
+	writeJSON(w, report)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -1,24 +1,25 @@
 package api
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/golangbox/gobox/UDPush"
 	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
 	"github.com/golangbox/gobox/server/model"
-	"github.com/golangbox/gobox/server/s3"
 	"github.com/golangbox/gobox/structs"
 	"github.com/gorilla/mux"
-	"github.com/jinzhu/gorm"
 )
 
 var T *template.Template
@@ -29,8 +30,25 @@ func RenderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
 
 var Pusher *UDPush.Pusher
 
-func ServeServerRoutes(port string, pusher *UDPush.Pusher) {
+// Store holds the contents of every file, keyed by hash.
+var Store blobstore.BlobStore
+
+const (
+	signedUrlExpiry = time.Minute * 10
+	// reuploadRequestLimit caps how many damaged blocks a client is
+	// asked to send again per sync
+	reuploadRequestLimit = 100
+
+	minPasswordLength = 8
+	// defaultClientName names clients that didn't say what device they
+	// are
+	defaultClientName = "client"
+)
+
+func ServeServerRoutes(port string, pusher *UDPush.Pusher,
+	store blobstore.BlobStore) {
 	Pusher = pusher
+	Store = store
 	var err error
 	T, err = template.ParseGlob("server/templates/*")
 	_ = err
@@ -39,16 +57,62 @@ func ServeServerRoutes(port string, pusher *UDPush.Pusher) {
 
 	// public
 	r.HandleFunc("/", IndexHandler)
-	r.HandleFunc("/login/", LoginHandler).Methods("GET")
+	r.HandleFunc("/account/devices", DevicesPageHandler).Methods("GET")
+	r.HandleFunc("/login/", LoginHandler).Methods("POST")
 	r.HandleFunc("/sign-up/", SignUpHandler).Methods("POST")
+	r.HandleFunc("/verify-email/", VerifyEmailHandler).Methods("GET", "POST")
+	r.HandleFunc("/sso/login/", SSOLoginHandler).Methods("GET")
+	r.HandleFunc("/sso/callback/", SSOCallbackHandler).Methods("GET")
+	r.HandleFunc("/sso/second-factor/", SSOSecondFactorHandler).Methods("GET", "POST")
+	r.HandleFunc("/password-reset/", RequestPasswordResetHandler).Methods("POST")
+	r.HandleFunc("/password-reset/confirm/", ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/reset-password", ResetPasswordPageHandler).Methods("GET")
 	r.HandleFunc("/file-data/{email}", FilesHandler).Methods("POST")
-	r.HandleFunc("/download/{id}/{filename}", DownloadHandler).Methods("GET")
+	r.HandleFunc("/s/{token}", SharePageHandler).Methods("GET")
+	r.HandleFunc("/s/{token}/files/", ShareFilesHandler).Methods("POST")
+	r.HandleFunc("/s/{token}/download/", ShareDownloadHandler).Methods("POST")
+	r.HandleFunc("/blobs/{hash}", BlobHandler).Methods("GET")
 
 	// require client authentication
 	r.HandleFunc("/file-actions/", sessionValidate(FileActionsHandler)).Methods("POST")
 	r.HandleFunc("/upload/", sessionValidate(UploadHandler)).Methods("POST")
+	r.HandleFunc("/uploads/", sessionValidate(StartUploadSessionHandler)).Methods("POST")
+	r.HandleFunc("/uploads/{id}/", sessionValidate(UploadSessionStatusHandler)).Methods("GET")
+	r.HandleFunc("/uploads/{id}/parts/{part}", sessionValidate(UploadPartHandler)).Methods("PUT")
+	r.HandleFunc("/uploads/{id}/commit/", sessionValidate(CommitUploadSessionHandler)).Methods("POST")
 	r.HandleFunc("/download/", sessionValidate(FileDownloadHandler)).Methods("POST")
 	r.HandleFunc("/clients/", sessionValidate(ClientsFileActionsHandler)).Methods("POST")
+	r.HandleFunc("/e2e/", sessionValidate(E2EParamsHandler)).Methods("GET")
+	r.HandleFunc("/e2e/", sessionValidate(SetE2EParamsHandler)).Methods("POST")
+	r.HandleFunc("/session/refresh/", sessionValidate(RefreshSessionHandler)).Methods("POST")
+	r.HandleFunc("/session/rotate/", sessionValidate(RotateSessionHandler)).Methods("POST")
+	r.HandleFunc("/session/revoke/", sessionValidate(RevokeSessionHandler)).Methods("POST")
+	r.HandleFunc("/verify-email/resend/", sessionValidate(ResendVerificationHandler)).Methods("POST")
+	r.HandleFunc("/2fa/enroll/", sessionValidate(EnrollTOTPHandler)).Methods("POST")
+	r.HandleFunc("/2fa/confirm/", sessionValidate(ConfirmTOTPHandler)).Methods("POST")
+	r.HandleFunc("/2fa/recovery-codes/", sessionValidate(RecoveryCodesHandler)).Methods("POST")
+	r.HandleFunc("/2fa/disable/", sessionValidate(DisableTOTPHandler)).Methods("POST")
+	r.HandleFunc("/devices/", sessionValidate(DevicesHandler)).Methods("GET")
+	r.HandleFunc("/devices/{id}/rename/", sessionValidate(RenameDeviceHandler)).Methods("POST")
+	r.HandleFunc("/devices/{id}/unlink/", sessionValidate(UnlinkDeviceHandler)).Methods("POST")
+	r.HandleFunc("/versions/", sessionValidate(VersionsHandler)).Methods("GET")
+	r.HandleFunc("/versions/restore/", sessionValidate(RestoreVersionHandler)).Methods("POST")
+	r.HandleFunc("/trash/", sessionValidate(TrashHandler)).Methods("GET")
+	r.HandleFunc("/trash/restore/", sessionValidate(RestoreTrashHandler)).Methods("POST")
+	r.HandleFunc("/snapshots/", sessionValidate(SnapshotHandler)).Methods("GET")
+	r.HandleFunc("/snapshots/download/", sessionValidate(SnapshotDownloadHandler)).Methods("GET")
+	r.HandleFunc("/snapshots/restore/", sessionValidate(SnapshotRestoreHandler)).Methods("POST")
+	r.HandleFunc("/shares/", sessionValidate(SharesHandler)).Methods("GET")
+	r.HandleFunc("/shares/", sessionValidate(CreateShareHandler)).Methods("POST")
+	r.HandleFunc("/shares/{id}/revoke/", sessionValidate(RevokeShareHandler)).Methods("POST")
+	r.HandleFunc("/namespaces/", sessionValidate(NamespacesHandler)).Methods("GET")
+	r.HandleFunc("/namespaces/", sessionValidate(CreateNamespaceHandler)).Methods("POST")
+	r.HandleFunc("/namespaces/{id}/members/", sessionValidate(AddNamespaceMemberHandler)).Methods("POST")
+	r.HandleFunc("/namespaces/{id}/members/remove/", sessionValidate(RemoveNamespaceMemberHandler)).Methods("POST")
+
+	// require an admin client
+	r.HandleFunc("/admin/blobs/damaged/", adminValidate(DamagedBlobsHandler)).Methods("GET")
+	r.HandleFunc("/admin/scrub/", adminValidate(ScrubHandler)).Methods("POST")
 
 	// static files? (css, js, etc...)
 	// r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
@@ -78,7 +142,8 @@ func (h *httpError) check() bool {
 
 func sessionValidate(fn func(http.ResponseWriter, *http.Request, structs.Client)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		// not the whole url, older clients put their session key in it
+		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
 		client, err := verifyAndReturnClient(r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -90,7 +155,7 @@ func sessionValidate(fn func(http.ResponseWriter, *http.Request, structs.Client)
 }
 
 func verifyAndReturnClient(req *http.Request) (client structs.Client, err error) {
-	sessionKey := req.FormValue("SessionKey")
+	sessionKey := requestSessionKey(req)
 	if sessionKey == "" {
 		err = fmt.Errorf("No session key with request")
 		return
@@ -104,6 +169,15 @@ func verifyAndReturnClient(req *http.Request) (client structs.Client, err error)
 		err = fmt.Errorf("No client matching this session key")
 		return
 	}
+	if !client.RevokedAt.IsZero() {
+		err = fmt.Errorf("Session was revoked")
+		return
+	}
+	if time.Now().After(client.SessionExpiresAt) {
+		err = fmt.Errorf("Session expired")
+		return
+	}
+	err = recordLastSeen(&client, req)
 	return
 }
 
@@ -129,15 +203,33 @@ func FileActionsHandler(w http.ResponseWriter, req *http.Request,
 		value.ClientId = client.Id
 	}
 
-	fileActions, httpError.err = boxtools.WriteFileActionsToDatabase(fileActions, client)
+	var user structs.User
+	query := model.DB.Model(&client).Related(&user)
+	httpError.err = query.Error
 	httpError.code = http.StatusInternalServerError
 	if httpError.check() {
 		return
 	}
 
-	var user structs.User
-	query := model.DB.Model(&client).Related(&user)
-	httpError.err = query.Error
+	var rejected []structs.RejectedFileAction
+	fileActions, rejected, httpError.err = resolveNamespaces(fileActions, user)
+	if httpError.check() {
+		return
+	}
+
+	// files are uploaded block by block, so it's the blocks we check for.
+	// write to a map to remove any duplicate hashes
+	hashMap := make(map[string]bool)
+	for _, value := range fileActions {
+		if value.IsCreate == true {
+			for _, block := range boxtools.FileBlocks(value.File) {
+				hashMap[block.Hash] = true
+			}
+		}
+	}
+
+	fileActions, httpError.err = boxtools.WriteFileActionsToDatabase(fileActions, client)
+	httpError.code = http.StatusInternalServerError
 	if httpError.check() {
 		return
 	}
@@ -149,67 +241,62 @@ func FileActionsHandler(w http.ResponseWriter, req *http.Request,
 		fmt.Println(errs)
 	}
 
-	var hashesThatNeedToBeUploaded []string
-	hashMap := make(map[string]bool)
-	// write to a map to remove any duplicate hashes
-	for _, value := range fileActions {
-		if value.IsCreate == true {
-			hashMap[value.File.Hash] = true
-		}
-	}
+	var hashes []string
 	for key, _ := range hashMap {
-		var exists bool
-		exists, httpError.err = s3.TestKeyExistence(key)
-		httpError.code = http.StatusInternalServerError
-		if httpError.check() {
-			return
-		}
-		if exists == false {
-			hashesThatNeedToBeUploaded = append(
-				hashesThatNeedToBeUploaded,
-				key,
-			)
-		}
+		hashes = append(hashes, key)
 	}
-
-	var jsonBytes []byte
-	jsonBytes, httpError.err = json.Marshal(hashesThatNeedToBeUploaded)
+	var hashesThatNeedToBeUploaded []string
+	hashesThatNeedToBeUploaded, httpError.err = blobindex.Missing(hashes)
 	httpError.code = http.StatusInternalServerError
 	if httpError.check() {
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonBytes)
+
+	response := structs.FileActionsResponse{
+		Upload:   hashesThatNeedToBeUploaded,
+		Rejected: rejected,
+	}
+	if response.Upload == nil {
+		response.Upload = []string{}
+	}
+	if response.Rejected == nil {
+		response.Rejected = []structs.RejectedFileAction{}
+	}
+	writeJSON(w, response)
 }
+
+// UploadHandler streams the request body into the blob store. The client
+// declares the contents' hash and size up front as fileHash and fileSize,
+// and the blob is only stored under that hash if the body matches.
 func UploadHandler(w http.ResponseWriter, req *http.Request,
 	client structs.Client) {
 	httpError := httpError{responseWriter: w}
-
-	var contents []byte
-	contents, httpError.err = ioutil.ReadAll(req.Body)
-	httpError.code = http.StatusUnauthorized
-	if httpError.check() {
-		return
-	}
-
-	h := sha256.New()
-	_, httpError.err = h.Write(contents)
 	httpError.code = http.StatusInternalServerError
-	if httpError.check() {
+
+	fileHash := req.FormValue("fileHash")
+	fileSize, err := strconv.ParseInt(req.FormValue("fileSize"), 10, 64)
+	if fileHash == "" || err != nil || fileSize < 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Need fileHash and fileSize."))
 		return
 	}
-	byteString := h.Sum(nil)
-	sha256String := hex.EncodeToString(byteString)
 
 	// we have the hash, so we might as well check if it
 	// exists again before we upload
 	var exists bool
-	exists, httpError.err = s3.TestKeyExistence(sha256String)
+	exists, httpError.err = blobindex.Exists(fileHash)
 	if httpError.check() {
 		return
 	}
 	if exists == false {
-		httpError.err = s3.UploadFile(sha256String, contents)
+		err = blobstore.PutVerifiedAs(Store, client.UserId, fileHash,
+			req.Body, fileSize)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		httpError.err = blobindex.Record(Store, fileHash, fileSize)
 		if httpError.check() {
 			return
 		}
@@ -229,31 +316,26 @@ func FileDownloadHandler(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
+	// fileHash is the hash of one of the file's blocks, which for
+	// a small file is the hash of the file itself
 	fileHash := req.FormValue("fileHash")
 	if fileHash == "" {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
 
-	var file structs.File
-	query = model.DB.Where(
-		&structs.File{
-			UserId: user.Id,
-			Hash:   fileHash,
-		},
-	).First(&file)
-	if query.Error != nil {
-		if query.Error == gorm.RecordNotFound {
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(query.Error.Error()))
-		}
+	var found bool
+	found, httpError.err = boxtools.UserHasBlock(user, fileHash)
+	if httpError.check() {
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	var exists bool
-	exists, httpError.err = s3.TestKeyExistence(fileHash)
+	exists, httpError.err = blobindex.Exists(fileHash)
 	if httpError.check() {
 		return
 	}
@@ -264,7 +346,7 @@ func FileDownloadHandler(w http.ResponseWriter, req *http.Request,
 	}
 
 	var url string
-	url, httpError.err = s3.GenerateSignedUrl(fileHash)
+	url, httpError.err = Store.SignedURL(fileHash, signedUrlExpiry)
 	if httpError.check() {
 		return
 	}
@@ -284,6 +366,12 @@ func ClientsFileActionsHandler(w http.ResponseWriter, req *http.Request,
 			return
 		}
 	}
+	lastId, err := strconv.ParseInt(lastIdString, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("lastId must be a number."))
+		return
+	}
 
 	var user structs.User
 	query := model.DB.Model(&client).Related(&user)
@@ -306,31 +394,67 @@ func ClientsFileActionsHandler(w http.ResponseWriter, req *http.Request,
 
 	var fileActions []structs.FileAction
 	query = model.DB.Where("client_id in (?)", clientIds).
-		Where("Id > ?", lastIdString).
+		Where("namespace_id = 0").
+		Where("Id > ?", lastId).
 		Find(&fileActions)
 	httpError.err = query.Error
 	if httpError.check() {
 		return
 	}
 
-	var highestId int64
+	highestId := lastId
 	for _, value := range fileActions {
 		if value.Id > highestId {
 			highestId = value.Id
 		}
 	}
 
-	fileActions = boxtools.RemoveRedundancyFromFileActions(fileActions)
+	var memberships []structs.NamespaceMember
+	memberships, httpError.err = boxtools.Memberships(user)
+	if httpError.check() {
+		return
+	}
+	mounts := make(map[int64]structs.NamespaceMember)
+	for _, member := range memberships {
+		mounts[member.NamespaceId] = member
+		var shared []structs.FileAction
+		var sharedId int64
+		shared, sharedId, httpError.err = namespaceActions(member, client, lastId)
+		if httpError.check() {
+			return
+		}
+		fileActions = append(fileActions, shared...)
+		if sharedId > highestId {
+			highestId = sharedId
+		}
+	}
 
+	// files are needed to find redundant actions, which compares paths
 	for key, value := range fileActions {
 		var file structs.File
 		_ = model.DB.First(&file, value.FileId)
+		httpError.err = boxtools.LoadFileBlocks(&file)
+		if httpError.check() {
+			return
+		}
+		if member, ok := mounts[value.NamespaceId]; ok {
+			file.Path = boxtools.MountedPath(member, file.Path)
+		}
 		fileActions[key].File = file
 	}
 
+	fileActions = boxtools.RemoveRedundancyFromFileActions(fileActions)
+
+	var reupload []structs.ReuploadRequest
+	reupload, httpError.err = blobindex.ReuploadRequests(user, reuploadRequestLimit)
+	if httpError.check() {
+		return
+	}
+
 	responseStruct := structs.ClientFileActionsResponse{
 		LastId:      highestId,
 		FileActions: fileActions,
+		Reupload:    reupload,
 	}
 
 	var responseJsonBytes []byte
@@ -340,8 +464,15 @@ func ClientsFileActionsHandler(w http.ResponseWriter, req *http.Request,
 	}
 	w.Write(responseJsonBytes)
 
-	model.DB.Save(&client)
-
+	// the client has everything up to lastId, and is about to apply the
+	// rest of what it was sent
+	err = model.DB.Exec(
+		"UPDATE clients SET last_synched_file_action_id = ?, last_synched_at = ? WHERE id = ?",
+		highestId, time.Now(), client.Id,
+	).Error
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 func FilesHandler(w http.ResponseWriter, req *http.Request) {
@@ -365,48 +496,216 @@ func FilesHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(jsonBytes)
 }
 
-func DownloadHandler(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	id := vars["id"]
-	intId, _ := strconv.Atoi(id)
-	int64Id := int64(intId)
-
-	var file structs.File
-	query := model.DB.First(&file, int64Id)
-	_ = query
-	url, err := s3.GenerateSignedUrl(file.Hash)
-	resp, err := http.Get(url)
-	// keyBytes, err := ioutil.ReadAll(resp.Body)
-	w.Header().Add("Content-Type", "application/octet-stream")
-	io.Copy(w, resp.Body)
-	_ = err
-	// w.Write(keyBytes)
+// BlobHandler serves blobs for backends that sign urls pointing back at
+// this server. The url signature stands in for a session key.
+func BlobHandler(w http.ResponseWriter, req *http.Request) {
+	verifier, ok := Store.(blobstore.Verifier)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hash := mux.Vars(req)["hash"]
+	err := verifier.Verify(
+		hash,
+		req.FormValue("expires"),
+		req.FormValue("signature"),
+	)
+	if err == blobstore.ErrSignedURLUnsupported {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if serveCompressed(w, req, hash) {
+		return
+	}
+	object, err := Store.Stat(hash)
+	if err != nil {
+		if err == blobstore.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	serveBlocks(w, req, "", object.LastModified, hash, []structs.Block{
+		structs.Block{Hash: hash, Size: object.Size},
+	})
+}
+
+// encodedGetter is implemented by stores that can hand out a blob's
+// stored bytes without decoding them.
+type encodedGetter interface {
+	GetEncoded(key string) (io.ReadCloser, string, error)
+}
+
+// serveCompressed sends a gzip compressed blob as it is stored, for
+// clients that accept gzip and want all of it. It reports whether it
+// handled the request.
+func serveCompressed(w http.ResponseWriter, req *http.Request,
+	hash string) bool {
+	store, ok := Store.(encodedGetter)
+	if !ok || req.Header.Get("Range") != "" ||
+		!strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		return false
+	}
+	var blob structs.Blob
+	query := model.DB.Where("hash = ?", hash).First(&blob)
+	if query.Error != nil || blob.Codec != blobstore.CodecGzip {
+		return false
+	}
+	rc, codec, err := store.GetEncoded(hash)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	if codec != blobstore.CodecGzip {
+		return false
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "private")
+	if req.Header.Get("If-None-Match") == `"`+hash+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, rc)
+	return true
+}
 
-	// w.Write()
-	// fmt.Println(query.Error)
+// serveBlocks writes blocks out as a single file. Contents never change
+// under a hash, so the hash is used as the ETag, and http.ServeContent
+// takes care of Range, If-None-Match and Content-Length.
+func serveBlocks(w http.ResponseWriter, req *http.Request, name string,
+	modified time.Time, hash string, blocks []structs.Block) {
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "private")
+	reader := newBlockReader(blocks)
+	defer reader.Close()
+	http.ServeContent(w, req, name, modified, reader)
 }
 
 func IndexHandler(w http.ResponseWriter, req *http.Request) {
 	RenderTemplate(w, "index", nil)
 }
 
-func SignUpHandler(w http.ResponseWriter, req *http.Request) {
-	// wants username and pass1 and pass2 posted as a form?
-	// returns 200 or  some sort of error to client?
+func DevicesPageHandler(w http.ResponseWriter, req *http.Request) {
+	RenderTemplate(w, "devices", nil)
+}
 
+// SignUpHandler creates a user from the posted email and password, and a
+// client for the device named name, and returns the client's session.
+func SignUpHandler(w http.ResponseWriter, req *http.Request) {
+	email := normalizeEmail(req.FormValue("email"))
+	password := req.FormValue("password")
+	if _, err := mail.ParseAddress(email); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("A valid email is required."))
+		return
+	}
+	if err := checkPassword(password); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var count int
+	query := model.DB.Model(structs.User{}).Where("email = ?", email).Count(&count)
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	if count > 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("There's already an account for that email."))
+		return
+	}
+	user, err := boxtools.NewUser(email, password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// the account works either way, the user can ask for another email
+	err = sendVerificationEmail(user)
+	if err != nil {
+		log.Println(err)
+	}
+	startSession(w, user, req.FormValue("name"))
 }
 
+// LoginHandler checks the posted email and password, and code if the user
+// has two-factor authentication on, and returns a new session for the
+// device named name.
 func LoginHandler(w http.ResponseWriter, req *http.Request) {
-	httpError := httpError{responseWriter: w}
-	httpError.code = http.StatusInternalServerError
+	user, err := boxtools.ValidateUserPassword(
+		normalizeEmail(req.FormValue("email")), req.FormValue("password"))
+	if err != nil || user.Id == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Wrong email or password."))
+		return
+	}
+	if user.TOTPEnabled {
+		code := req.FormValue("code")
+		if code == "" {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			w.Write([]byte("A code from your authenticator app or a recovery code is required."))
+			return
+		}
+		ok, err := boxtools.ValidateSecondFactor(&user, code)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Wrong code."))
+			return
+		}
+	}
+	startSession(w, user, req.FormValue("name"))
+}
 
-	var user structs.User
-	model.DB.First(&user)
-	client, err := boxtools.NewClient(user, "stephen", false)
-	httpError.err = err
-	if httpError.check() {
+// startSession creates a client for user's device and writes its session
+// back.
+func startSession(w http.ResponseWriter, user structs.User, name string) {
+	session, err := newSession(user, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, session)
+}
+
+func newSession(user structs.User, name string) (session structs.Session,
+	err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultClientName
+	}
+	client, err := boxtools.NewClient(user, name, false)
+	if err != nil {
 		return
 	}
+	return structs.Session{
+		ClientId:   client.Id,
+		ClientName: client.Name,
+		Email:      user.Email,
+		SessionKey: client.SessionKey,
+		ExpiresAt:  client.SessionExpiresAt,
+	}, nil
+}
 
-	w.Write([]byte(client.SessionKey))
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
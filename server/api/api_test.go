@@ -1,19 +1,38 @@
 package api
 
 import (
+	"archive/zip"
 	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golangbox/gobox/UDPush"
 	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/mail"
 	"github.com/golangbox/gobox/server/model"
-	"github.com/golangbox/gobox/server/s3"
+	"github.com/golangbox/gobox/server/oidc"
+	"github.com/golangbox/gobox/server/oidc/oidctest"
+	"github.com/golangbox/gobox/server/totp"
 	"github.com/golangbox/gobox/structs"
 	"github.com/jinzhu/gorm"
 )
@@ -29,12 +48,32 @@ func init() {
 	model.DB.DropTableIfExists(&structs.FileAction{})
 	model.DB.DropTableIfExists(&structs.File{})
 	model.DB.DropTableIfExists(&structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.UploadSession{})
+	model.DB.DropTableIfExists(&structs.GCCandidate{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.DropTableIfExists(&structs.EmailToken{})
+	model.DB.DropTableIfExists(&structs.Namespace{})
+	model.DB.DropTableIfExists(&structs.NamespaceMember{})
+	model.DB.DropTableIfExists(&structs.ShareLink{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
 	model.DB.AutoMigrate(
 		&structs.User{},
 		&structs.Client{},
 		&structs.FileAction{},
 		&structs.File{},
 		&structs.FileSystemFile{},
+		&structs.Block{},
+		&structs.UploadSession{},
+		&structs.GCCandidate{},
+		&structs.Blob{},
+		&structs.DataKey{},
+		&structs.EmailToken{},
+		&structs.Namespace{},
+		&structs.NamespaceMember{},
+		&structs.ShareLink{},
+		&structs.TrashedFile{},
 	)
 
 	user, _ = boxtools.NewUser("max.t.mcdonnell@gmail", "password")
@@ -45,7 +84,7 @@ func init() {
 		fmt.Println(err)
 	}
 
-	go ServeServerRoutes("8000")
+	go ServeServerRoutes("8000", &UDPush.Pusher{}, blobstore.NewMemoryStore())
 }
 
 // func httpErrorCheck(err error, statusCode int, w http.ResponseWriter)
@@ -77,9 +116,16 @@ func TestClientsFileActionsHandler(t *testing.T) {
 
 func TestUploadHandler(t *testing.T) {
 	file := []byte("These are the file contents")
+	h := sha256.New()
+	h.Write(file)
+	byteString := h.Sum(nil)
+	sha256String := hex.EncodeToString(byteString)
+
 	resp, _ := http.Post(
-		"http://localhost:8000/upload/?sessionKey="+client.SessionKey,
-		"",
+		"http://localhost:8000/upload/?sessionKey="+client.SessionKey+
+			"&fileHash="+sha256String+
+			"&fileSize="+strconv.Itoa(len(file)),
+		"application/octet-stream",
 		bytes.NewBuffer(file),
 	)
 	contents, _ := ioutil.ReadAll(resp.Body)
@@ -87,22 +133,38 @@ func TestUploadHandler(t *testing.T) {
 		err := fmt.Errorf(string(contents))
 		t.Error(err)
 	}
-	h := sha256.New()
-	h.Write(file)
-	byteString := h.Sum(nil)
-	sha256String := hex.EncodeToString(byteString)
-
-	url, _ := s3.GenerateSignedUrl(sha256String)
-
-	resp, _ = http.Get(url)
 
-	contents, _ = ioutil.ReadAll(resp.Body)
+	r, err := Store.Get(sha256String)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ = ioutil.ReadAll(r)
+	r.Close()
 
 	if string(contents) != string(file) {
 		t.Fail()
 	}
 }
 
+func TestUploadHandlerWrongHash(t *testing.T) {
+	file := []byte("These are not the contents you declared")
+	wrongHash := "fc45acaffc35a3aa674f7c0d5a03d22350b4f2ff4bf45ccebad077e5af80e512"
+	resp, _ := http.Post(
+		"http://localhost:8000/upload/?sessionKey="+client.SessionKey+
+			"&fileHash="+wrongHash+
+			"&fileSize="+strconv.Itoa(len(file)),
+		"application/octet-stream",
+		bytes.NewBuffer(file),
+	)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Upload with the wrong hash should be rejected")
+	}
+	exists, _ := Store.Exists(wrongHash)
+	if exists {
+		t.Error("Blob with the wrong hash was stored")
+	}
+}
+
 func TestApiCallWithWrongAndNoAuth(t *testing.T) {
 	resp, err := http.PostForm(
 		"http://localhost:8000/file-actions/",
@@ -174,3 +236,1376 @@ func TestFileDownloadHandler(t *testing.T) {
 	_ = url
 	//not sure how we check to see if the url is valid
 }
+
+func TestUploadSession(t *testing.T) {
+	file := bytes.Repeat([]byte("resumable "), uploadPartSize/5)
+	h := sha256.New()
+	h.Write(file)
+	sha256String := hex.EncodeToString(h.Sum(nil))
+	request := func(method, endpoint string, values url.Values,
+		body io.Reader) *http.Response {
+		if body == nil {
+			body = strings.NewReader(values.Encode())
+		}
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+client.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := request("POST", "uploads/", url.Values{
+		"fileHash": {sha256String},
+		"fileSize": {strconv.Itoa(len(file))},
+	}, nil)
+	contents, _ := ioutil.ReadAll(resp.Body)
+	var status structs.UploadSessionStatus
+	json.Unmarshal(contents, &status)
+	if resp.StatusCode != http.StatusOK || len(status.ReceivedParts) != 0 {
+		t.Fatal("Couldn't start an upload session")
+	}
+
+	// send the second part only, as if the connection dropped
+	idString := strconv.FormatInt(status.Id, 10)
+	resp = request("PUT", "uploads/"+idString+"/parts/1", nil,
+		bytes.NewReader(file[uploadPartSize:]))
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Couldn't upload a part")
+	}
+
+	resp = request("POST", "uploads/"+idString+"/commit/", nil, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Session with a missing part was committed")
+	}
+
+	resp = request("GET", "uploads/"+idString+"/", nil, nil)
+	contents, _ = ioutil.ReadAll(resp.Body)
+	json.Unmarshal(contents, &status)
+	if len(status.ReceivedParts) != 1 || status.ReceivedParts[0] != 1 {
+		t.Error("Session should only have part 1")
+	}
+
+	request("PUT", "uploads/"+idString+"/parts/0", nil,
+		bytes.NewReader(file[:uploadPartSize]))
+	resp = request("POST", "uploads/"+idString+"/commit/", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Couldn't commit the session")
+	}
+	exists, _ := Store.Exists(sha256String)
+	if !exists {
+		t.Error("Committed blob wasn't stored")
+	}
+
+	resp = request("POST", "uploads/", url.Values{
+		"fileHash": {"huge"},
+		"fileSize": {strconv.FormatInt(1<<62, 10)},
+	}, nil)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("A session larger than MaxUploadSize shouldn't be started")
+	}
+}
+
+func TestServeBlocksRange(t *testing.T) {
+	blocks := []structs.Block{}
+	for _, contents := range []string{"first block ", "second block ", "third"} {
+		h := sha256.New()
+		h.Write([]byte(contents))
+		hash := hex.EncodeToString(h.Sum(nil))
+		Store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+		blocks = append(blocks, structs.Block{Hash: hash, Size: int64(len(contents))})
+	}
+
+	req, _ := http.NewRequest("GET", "/download/1/file.txt", nil)
+	req.Header.Set("Range", "bytes=6-17")
+	w := httptest.NewRecorder()
+	serveBlocks(w, req, "file.txt", time.Now(), "filehash", blocks)
+	if w.Code != http.StatusPartialContent {
+		t.Error("Range request should get a partial response")
+	}
+	if w.Body.String() != "block second" {
+		t.Errorf("Range spanning blocks returned %q", w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "12" {
+		t.Error("Wrong Content-Length")
+	}
+
+	req, _ = http.NewRequest("GET", "/download/1/file.txt", nil)
+	req.Header.Set("If-None-Match", `"filehash"`)
+	w = httptest.NewRecorder()
+	serveBlocks(w, req, "file.txt", time.Now(), "filehash", blocks)
+	if w.Code != http.StatusNotModified {
+		t.Error("Matching ETag should get a 304")
+	}
+}
+
+func TestTieredBlobDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer := &blobstore.URLSigner{
+		BaseURL: "http://localhost:8000",
+		Secret:  []byte("secret"),
+	}
+	hot, err := blobstore.NewDiskStore(dir, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold := blobstore.NewMemoryStore()
+	defer func(store blobstore.BlobStore) { Store = store }(Store)
+	Store = blobstore.NewTieredStore(hot, cold, nil)
+
+	contents := "a cold blob"
+	h := sha256.Sum256([]byte(contents))
+	hash := hex.EncodeToString(h[:])
+	cold.Put(hash, strings.NewReader(contents), int64(len(contents)))
+	signed, err := Store.SignedURL(hash, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != contents {
+		t.Error("A tiered store's signed urls should download the blob")
+	}
+	resp, err = http.Get(strings.Replace(signed, "signature=", "signature=0", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("A tampered url should be refused")
+	}
+}
+
+func TestE2EParams(t *testing.T) {
+	e2eUser, _ := boxtools.NewUser("e2e@gobox.test", "password")
+	e2eClient, _ := boxtools.NewClient(e2eUser, "test", false)
+	request := func(method string, values url.Values) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/e2e/",
+			strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+e2eClient.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	getParams := func() (params structs.E2EParams) {
+		resp := request("GET", nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(contents, &params)
+		return
+	}
+	if params := getParams(); params.Salt != "" || params.Check != "" {
+		t.Error("A new user shouldn't have end to end encryption set up")
+	}
+
+	resp := request("POST", url.Values{
+		"Salt":  {"73616c74"},
+		"Check": {"636865636b"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Couldn't set up end to end encryption")
+	}
+	if params := getParams(); params.Salt != "73616c74" || params.Check != "636865636b" {
+		t.Error("End to end encryption parameters weren't saved")
+	}
+
+	resp = request("POST", url.Values{
+		"Salt":  {"6f74686572"},
+		"Check": {"636865636b"},
+	})
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("End to end encryption parameters were changed")
+	}
+}
+
+func TestSignUpAndLogin(t *testing.T) {
+	postSession := func(endpoint string, values url.Values) (
+		session structs.Session, code int) {
+		resp, _ := http.PostForm("http://localhost:8000/"+endpoint, values)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(contents, &session)
+		return session, resp.StatusCode
+	}
+
+	session, code := postSession("sign-up/", url.Values{
+		"email":    {" New.User@gobox.test"},
+		"password": {"hunter22"},
+		"name":     {"laptop"},
+	})
+	if code != http.StatusOK || session.SessionKey == "" {
+		t.Fatal("Couldn't sign up")
+	}
+	if session.Email != "new.user@gobox.test" || session.ClientName != "laptop" {
+		t.Error("Sign up should return the session of the named client")
+	}
+	var signedUp structs.Client
+	model.DB.Where("session_key = ?", session.SessionKey).First(&signedUp)
+	if signedUp.Id != session.ClientId || signedUp.IsServer {
+		t.Error("Sign up should create a client for the device")
+	}
+
+	_, code = postSession("sign-up/", url.Values{
+		"email":    {"new.user@gobox.test"},
+		"password": {"hunter22"},
+	})
+	if code != http.StatusConflict {
+		t.Error("Signing up twice with the same email should fail")
+	}
+	_, code = postSession("sign-up/", url.Values{
+		"email":    {"not an email"},
+		"password": {"hunter22"},
+	})
+	if code != http.StatusNotAcceptable {
+		t.Error("Sign up with a bad email should be refused")
+	}
+	_, code = postSession("sign-up/", url.Values{
+		"email":    {"short@gobox.test"},
+		"password": {"short"},
+	})
+	if code != http.StatusNotAcceptable {
+		t.Error("Sign up with a short password should be refused")
+	}
+
+	login, code := postSession("login/", url.Values{
+		"email":    {"new.user@gobox.test"},
+		"password": {"hunter22"},
+		"name":     {"phone"},
+	})
+	if code != http.StatusOK || login.SessionKey == "" ||
+		login.SessionKey == session.SessionKey || login.ClientName != "phone" {
+		t.Error("Login should start a new session for the device")
+	}
+	for _, password := range []string{"wrong password", ""} {
+		_, code = postSession("login/", url.Values{
+			"email":    {"new.user@gobox.test"},
+			"password": {password},
+		})
+		if code != http.StatusUnauthorized {
+			t.Error("Login with the wrong password should fail")
+		}
+	}
+	_, code = postSession("login/", url.Values{
+		"email":    {"nobody@gobox.test"},
+		"password": {"hunter22"},
+	})
+	if code != http.StatusUnauthorized {
+		t.Error("Login for an unknown email should fail")
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	sessionClient, _ := boxtools.NewClient(user, "sessions", false)
+	request := func(endpoint, sessionKey string) (
+		session structs.Session, code int) {
+		req, _ := http.NewRequest("POST", "http://localhost:8000/"+endpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+sessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &session)
+		return session, resp.StatusCode
+	}
+
+	refreshed, code := request("session/refresh/", sessionClient.SessionKey)
+	if code != http.StatusOK || refreshed.SessionKey != sessionClient.SessionKey ||
+		!refreshed.ExpiresAt.After(sessionClient.SessionExpiresAt) {
+		t.Error("Refresh should extend the session")
+	}
+	var seen structs.Client
+	model.DB.First(&seen, sessionClient.Id)
+	if seen.LastSeenIP == "" || seen.LastSeenAt.IsZero() {
+		t.Error("Requests should record where the client was last seen")
+	}
+	resp, err := http.PostForm("http://localhost:8000/session/refresh/?SessionKey="+
+		sessionClient.SessionKey, url.Values{"SessionKey": {sessionClient.SessionKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Session keys should only be taken from the Authorization header")
+	}
+
+	Pusher.Initialize("test")
+	pushed, device := net.Pipe()
+	defer device.Close()
+	Pusher.Attach(UDPush.Watcher{SessionKey: sessionClient.SessionKey, Connection: pushed})
+	rotated, code := request("session/rotate/", sessionClient.SessionKey)
+	if code != http.StatusOK || rotated.SessionKey == sessionClient.SessionKey {
+		t.Fatal("Rotate should return a new session key")
+	}
+	_, code = request("session/refresh/", sessionClient.SessionKey)
+	if code != http.StatusUnauthorized {
+		t.Error("The old key should stop working after a rotation")
+	}
+
+	_, code = request("session/revoke/", rotated.SessionKey)
+	if code != http.StatusOK {
+		t.Error("Couldn't revoke the session")
+	}
+	_, code = request("session/refresh/", rotated.SessionKey)
+	if code != http.StatusUnauthorized {
+		t.Error("A revoked key should stop working")
+	}
+	if len(Pusher.Watchers) != 0 {
+		t.Error("Revoking a rotated session should drop its push connection")
+	}
+
+	expiredClient, _ := boxtools.NewClient(user, "expired", false)
+	model.DB.Exec("UPDATE clients SET session_expires_at = ? WHERE id = ?",
+		time.Now().Add(-time.Minute), expiredClient.Id)
+	_, code = request("session/refresh/", expiredClient.SessionKey)
+	if code != http.StatusUnauthorized {
+		t.Error("An expired key should stop working")
+	}
+}
+
+func TestDevices(t *testing.T) {
+	deviceUser, _ := boxtools.NewUser("devices@gobox.test", "password")
+	laptop, _ := boxtools.NewClient(deviceUser, "laptop", false)
+	phone, _ := boxtools.NewClient(deviceUser, "phone", false)
+	boxtools.NewClient(deviceUser, "server", true)
+	fileActions, _ := boxtools.GenerateSliceOfRandomFileActions(1, 1, 3)
+	for _, value := range fileActions {
+		value.ClientId = phone.Id
+		model.DB.Create(&value)
+	}
+	request := func(method, endpoint string, values url.Values) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint,
+			strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+laptop.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	devices := func() (devices []structs.Device) {
+		resp := request("GET", "devices/", nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &devices)
+		return
+	}
+
+	listed := devices()
+	if len(listed) != 2 || listed[0].Id != laptop.Id || listed[1].Id != phone.Id {
+		t.Fatal("Devices should list the user's clients, without the server")
+	}
+	if !listed[0].Current || listed[1].Current {
+		t.Error("Only the requesting device should be current")
+	}
+	if listed[0].Behind != 3 || listed[1].Behind != 0 {
+		t.Error("Devices should say how many file actions they haven't synced")
+	}
+
+	resp := request("POST", "clients/", url.Values{"lastId": {"0"}})
+	resp.Body.Close()
+	listed = devices()
+	if listed[0].Behind != 0 || listed[0].LastSynchedAt.IsZero() ||
+		listed[0].LastSynchedFileActionId == 0 {
+		t.Error("Syncing should be recorded on the device")
+	}
+
+	resp = request("POST", "devices/"+strconv.FormatInt(phone.Id, 10)+"/rename/",
+		url.Values{"name": {"old phone"}})
+	if resp.StatusCode != http.StatusOK || devices()[1].Name != "old phone" {
+		t.Error("Couldn't rename a device")
+	}
+	resp = request("POST", "devices/"+strconv.FormatInt(client.Id, 10)+"/rename/",
+		url.Values{"name": {"mine now"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Another user's device shouldn't be found")
+	}
+
+	resp = request("POST", "devices/"+strconv.FormatInt(phone.Id, 10)+"/unlink/", nil)
+	if resp.StatusCode != http.StatusOK || len(devices()) != 1 {
+		t.Error("Couldn't unlink a device")
+	}
+	var unlinked structs.Client
+	model.DB.First(&unlinked, phone.Id)
+	if _, err := verifyAndReturnClient(&http.Request{
+		Header: http.Header{"Authorization": {"Bearer " + unlinked.SessionKey}},
+	}); err == nil {
+		t.Error("An unlinked device's session should stop working")
+	}
+}
+
+func TestSharedFolders(t *testing.T) {
+	owner, _ := boxtools.NewUser("owner@gobox.test", "password")
+	ownerLaptop, _ := boxtools.NewClient(owner, "laptop", false)
+	ownerPhone, _ := boxtools.NewClient(owner, "phone", false)
+	editor, _ := boxtools.NewUser("editor@gobox.test", "password")
+	editorLaptop, _ := boxtools.NewClient(editor, "laptop", false)
+	viewer, _ := boxtools.NewUser("viewer@gobox.test", "password")
+	viewerLaptop, _ := boxtools.NewClient(viewer, "laptop", false)
+	request := func(device structs.Client, method, endpoint string,
+		body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+device.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	form := func(device structs.Client, endpoint string, values url.Values) int {
+		resp := request(device, "POST", endpoint, strings.NewReader(values.Encode()))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	var sent structs.FileActionsResponse
+	create := func(device structs.Client, path string) structs.File {
+		file, _ := boxtools.GenerateRandomFile(0)
+		file.Path = path
+		file.Size = 1
+		jsonBytes, _ := json.Marshal([]structs.FileAction{{IsCreate: true, File: file}})
+		resp := request(device, "POST", "file-actions/", bytes.NewBuffer(jsonBytes))
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		sent = structs.FileActionsResponse{}
+		json.Unmarshal(contents, &sent)
+		return file
+	}
+	sync := func(device structs.Client, lastId int64) (
+		response structs.ClientFileActionsResponse, paths []string) {
+		resp := request(device, "POST", "clients/", strings.NewReader(
+			url.Values{"lastId": {strconv.FormatInt(lastId, 10)}}.Encode()))
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &response)
+		for _, value := range response.FileActions {
+			paths = append(paths, value.File.Path)
+		}
+		sort.Strings(paths)
+		return
+	}
+
+	shared := create(ownerLaptop, "./Project/plan.txt")
+	create(ownerLaptop, "./notes.txt")
+	resp := request(ownerLaptop, "POST", "namespaces/",
+		strings.NewReader(url.Values{"path": {"./Project"}}.Encode()))
+	contents, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var folder structs.SharedFolder
+	json.Unmarshal(contents, &folder)
+	if resp.StatusCode != http.StatusOK || folder.Name != "Project" ||
+		folder.Path != "./Project" || folder.Role != structs.RoleOwner {
+		t.Fatal("Couldn't share a folder")
+	}
+	members := "namespaces/" + strconv.FormatInt(folder.Id, 10) + "/members/"
+	if form(ownerLaptop, "namespaces/", url.Values{"path": {"./Project/docs"}}) !=
+		http.StatusConflict {
+		t.Error("A folder in a shared folder shouldn't be shared again")
+	}
+	if form(ownerLaptop, members, url.Values{
+		"email": {"editor@gobox.test"}, "role": {structs.RoleEditor},
+	}) != http.StatusOK {
+		t.Fatal("The owner should be able to add an editor")
+	}
+	form(ownerLaptop, members, url.Values{
+		"email": {"viewer@gobox.test"}, "role": {structs.RoleViewer},
+	})
+	if form(editorLaptop, members, url.Values{
+		"email": {"someone@gobox.test"}, "role": {structs.RoleEditor},
+	}) != http.StatusForbidden {
+		t.Error("Only the owner should be able to add members")
+	}
+
+	synced, paths := sync(editorLaptop, 0)
+	if len(paths) != 1 || paths[0] != "./Project/plan.txt" ||
+		synced.FileActions[0].File.Hash != shared.Hash {
+		t.Fatal("A new member should get the files in the shared folder")
+	}
+	if found, _ := boxtools.UserHasBlock(editor, shared.Hash); !found {
+		t.Error("Members should be able to fetch the shared folder's blocks")
+	}
+	if found, _ := boxtools.UserHasBlock(user, shared.Hash); found {
+		t.Error("Others shouldn't be able to fetch the shared folder's blocks")
+	}
+
+	ownerSynced, _ := sync(ownerLaptop, 0)
+	create(editorLaptop, "./Project/review.txt")
+	create(viewerLaptop, "./Project/vandalism.txt")
+	if len(sent.Rejected) != 1 || sent.Rejected[0].Path != "./Project/vandalism.txt" ||
+		sent.Rejected[0].Code != http.StatusForbidden {
+		t.Error("A viewer's change should be rejected back to their device")
+	}
+	_, paths = sync(ownerLaptop, ownerSynced.LastId)
+	if len(paths) != 1 || paths[0] != "./Project/review.txt" {
+		t.Error("Editors' changes should reach the other members, but not viewers'")
+	}
+	_, paths = sync(ownerPhone, 0)
+	for _, value := range paths {
+		if value == "./Project/vandalism.txt" {
+			t.Error("A viewer shouldn't be able to change the shared folder")
+		}
+	}
+	_, paths = sync(editorLaptop, synced.LastId)
+	if len(paths) != 0 {
+		t.Error("Devices shouldn't be sent their own changes")
+	}
+
+	resp = request(viewerLaptop, "GET", "namespaces/", nil)
+	contents, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var folders []structs.SharedFolder
+	json.Unmarshal(contents, &folders)
+	if len(folders) != 1 || folders[0].Role != structs.RoleViewer ||
+		len(folders[0].Members) != 3 {
+		t.Error("Members should see the shared folder and who it's shared with")
+	}
+	remove := members + "remove/"
+	if form(editorLaptop, remove, url.Values{"email": {"viewer@gobox.test"}}) !=
+		http.StatusForbidden {
+		t.Error("Only the owner should be able to remove other members")
+	}
+	if form(ownerLaptop, remove, url.Values{"email": {"owner@gobox.test"}}) !=
+		http.StatusConflict {
+		t.Error("The owner shouldn't be able to leave")
+	}
+	if form(viewerLaptop, remove, url.Values{"email": {"viewer@gobox.test"}}) !=
+		http.StatusOK {
+		t.Error("Members should be able to leave")
+	}
+	_, paths = sync(viewerLaptop, 0)
+	if len(paths) != 0 {
+		t.Error("Former members shouldn't get the shared folder's changes")
+	}
+}
+
+func TestForeignNamespaceId(t *testing.T) {
+	owner, _ := boxtools.NewUser("private@gobox.test", "password")
+	ownerLaptop, _ := boxtools.NewClient(owner, "laptop", false)
+	outsider, _ := boxtools.NewUser("outsider@gobox.test", "password")
+	outsiderLaptop, _ := boxtools.NewClient(outsider, "laptop", false)
+	send := func(device structs.Client, fileActions []structs.FileAction) {
+		jsonBytes, _ := json.Marshal(fileActions)
+		req, _ := http.NewRequest("POST", "http://localhost:8000/file-actions/",
+			bytes.NewBuffer(jsonBytes))
+		req.Header.Set("Authorization", "Bearer "+device.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	secret, _ := boxtools.GenerateRandomFile(0)
+	secret.Path = "./Private/secret.txt"
+	send(ownerLaptop, []structs.FileAction{{IsCreate: true, File: secret}})
+	namespace, err := boxtools.ShareFolder(owner, "./Private", "Private")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planted, _ := boxtools.GenerateRandomFile(0)
+	planted.Path = "./planted.txt"
+	secret.Path = "./secret.txt"
+	send(outsiderLaptop, []structs.FileAction{
+		{IsCreate: true, NamespaceId: namespace.Id, File: planted},
+		{IsCreate: false, NamespaceId: namespace.Id, File: secret},
+	})
+	var fileActions []structs.FileAction
+	model.DB.Where("namespace_id = ? AND client_id = ?", namespace.Id,
+		outsiderLaptop.Id).Find(&fileActions)
+	if len(fileActions) != 0 {
+		t.Error("Non-members shouldn't be able to write to a namespace's journal")
+	}
+	var fileSystemFiles []structs.FileSystemFile
+	model.DB.Where("namespace_id = ?", namespace.Id).Find(&fileSystemFiles)
+	if len(fileSystemFiles) != 1 || fileSystemFiles[0].Path != "./secret.txt" {
+		t.Error("Non-members shouldn't be able to change a namespace's files")
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	sharer, _ := boxtools.NewUser("sharer@gobox.test", "password")
+	laptop, _ := boxtools.NewClient(sharer, "laptop", false)
+	request := func(method, endpoint string, values url.Values,
+		body io.Reader) *http.Response {
+		if body == nil {
+			body = strings.NewReader(values.Encode())
+		}
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+laptop.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	var fileActions []structs.FileAction
+	for filePath, contents := range map[string]string{
+		"./report.txt":        "the report",
+		"./photos/beach.jpg":  "a beach",
+		"./photos/2015/x.jpg": "an x",
+	} {
+		h := sha256.Sum256([]byte(contents))
+		hash := hex.EncodeToString(h[:])
+		Store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+		fileActions = append(fileActions, structs.FileAction{
+			IsCreate: true,
+			File: structs.File{
+				Name: filepath.Base(filePath),
+				Path: filePath,
+				Hash: hash,
+				Size: int64(len(contents)),
+			},
+		})
+	}
+	jsonBytes, _ := json.Marshal(fileActions)
+	request("POST", "file-actions/", nil, bytes.NewBuffer(jsonBytes)).Body.Close()
+	share := func(values url.Values) (share structs.Share, code int) {
+		resp := request("POST", "shares/", values, nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &share)
+		return share, resp.StatusCode
+	}
+	open := func(method, endpoint string, values url.Values) (string, int) {
+		var resp *http.Response
+		var err error
+		if method == "GET" {
+			resp, err = http.Get("http://localhost:8000/" + endpoint)
+		} else {
+			resp, err = http.PostForm("http://localhost:8000/"+endpoint, values)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(contents), resp.StatusCode
+	}
+
+	report, code := share(url.Values{"path": {"./report.txt"}, "max_downloads": {"1"}})
+	if code != http.StatusOK || report.IsFolder || report.Token == "" ||
+		!strings.HasSuffix(report.URL, "/s/"+report.Token) {
+		t.Fatal("Couldn't share a file")
+	}
+	partial := func(header, value string) (string, int) {
+		req, _ := http.NewRequest("GET", "http://localhost:8000/s/"+report.Token, nil)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(contents), resp.StatusCode
+	}
+	h := sha256.Sum256([]byte("the report"))
+	if contents, code := partial("Range", "bytes=4-"); code != http.StatusPartialContent ||
+		contents != "report" {
+		t.Error("A file link should serve ranges")
+	}
+	if _, code := partial("If-None-Match", `"`+hex.EncodeToString(h[:])+`"`); code !=
+		http.StatusNotModified {
+		t.Error("A file link should answer conditional requests")
+	}
+	contents, code := open("GET", "s/"+report.Token, nil)
+	if code != http.StatusOK || contents != "the report" {
+		t.Error("Ranges and re-fetches shouldn't count as downloads")
+	}
+	_, code = open("GET", "s/"+report.Token, nil)
+	if code != http.StatusGone {
+		t.Error("A link should stop working after its last download")
+	}
+	if _, code = share(url.Values{"path": {"./missing.txt"}}); code != http.StatusNotFound {
+		t.Error("Sharing a path with nothing at it should fail")
+	}
+
+	photos, code := share(url.Values{"path": {"./photos"}, "password": {"sesame"}})
+	if code != http.StatusOK || !photos.IsFolder || !photos.HasPassword {
+		t.Fatal("Couldn't share a folder")
+	}
+	if _, code = open("POST", "s/"+photos.Token+"/files/", nil); code != http.StatusUnauthorized {
+		t.Error("A link with a password shouldn't open without it")
+	}
+	contents, code = open("POST", "s/"+photos.Token+"/files/",
+		url.Values{"password": {"sesame"}})
+	var listing structs.ShareListing
+	json.Unmarshal([]byte(contents), &listing)
+	if code != http.StatusOK || listing.Name != "photos" || len(listing.Files) != 2 ||
+		listing.Files[0].Path != "2015/x.jpg" || listing.Files[1].Path != "beach.jpg" {
+		t.Error("A folder link should list the files in the folder")
+	}
+	contents, code = open("POST", "s/"+photos.Token+"/download/",
+		url.Values{"password": {"sesame"}, "path": {"beach.jpg"}})
+	if code != http.StatusOK || contents != "a beach" {
+		t.Error("A file in a shared folder should download")
+	}
+	contents, code = open("POST", "s/"+photos.Token+"/download/",
+		url.Values{"password": {"sesame"}})
+	archive, err := zip.NewReader(strings.NewReader(contents), int64(len(contents)))
+	if code != http.StatusOK || err != nil || len(archive.File) != 2 ||
+		archive.File[0].Name != "2015/x.jpg" {
+		t.Fatal("A shared folder should download as a zip")
+	}
+	entry, _ := archive.File[0].Open()
+	unzipped, _ := ioutil.ReadAll(entry)
+	if string(unzipped) != "an x" {
+		t.Error("The zip has the wrong contents")
+	}
+
+	expired, _ := share(url.Values{"path": {"./report.txt"}, "expires": {"1ns"}})
+	if _, code = open("GET", "s/"+expired.Token, nil); code != http.StatusGone {
+		t.Error("An expired link shouldn't work")
+	}
+	resp := request("POST", "shares/"+strconv.FormatInt(photos.Id, 10)+"/revoke/", nil, nil)
+	resp.Body.Close()
+	_, code = open("POST", "s/"+photos.Token+"/files/", url.Values{"password": {"sesame"}})
+	if resp.StatusCode != http.StatusOK || code != http.StatusNotFound {
+		t.Error("A revoked link shouldn't work")
+	}
+	resp = request("GET", "shares/", nil, nil)
+	listed, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var shares []structs.Share
+	json.Unmarshal(listed, &shares)
+	if len(shares) != 2 || shares[0].Downloads != 1 || shares[0].Token != "" {
+		t.Error("Shares should list the user's links that weren't revoked")
+	}
+	if _, code = open("GET", "download/1/file.txt", nil); code != http.StatusNotFound &&
+		code != http.StatusMethodNotAllowed {
+		t.Error("Files shouldn't be downloadable by id")
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	writer, _ := boxtools.NewUser("versions@gobox.test", "password")
+	laptop, _ := boxtools.NewClient(writer, "laptop", false)
+	phone, _ := boxtools.NewClient(writer, "phone", false)
+	other, _ := boxtools.NewClient(user, "other", false)
+	request := func(device structs.Client, method, endpoint string,
+		body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+device.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	write := func(contents string, previousHash string, stored bool) string {
+		h := sha256.Sum256([]byte(contents))
+		hash := hex.EncodeToString(h[:])
+		if stored {
+			Store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+			blobindex.Record(Store, hash, int64(len(contents)))
+		}
+		jsonBytes, _ := json.Marshal([]structs.FileAction{{
+			IsCreate:     true,
+			PreviousHash: previousHash,
+			File: structs.File{
+				Name: "essay.txt",
+				Path: "./essay.txt",
+				Hash: hash,
+				Size: int64(len(contents)),
+			},
+		}})
+		request(laptop, "POST", "file-actions/", bytes.NewBuffer(jsonBytes)).Body.Close()
+		return hash
+	}
+	versions := func() (versions []structs.FileVersion) {
+		resp := request(laptop, "GET", "versions/?path=./essay.txt", nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &versions)
+		return
+	}
+	restore := func(device structs.Client, id int64) int {
+		resp := request(device, "POST", "versions/restore/", strings.NewReader(
+			url.Values{"id": {strconv.FormatInt(id, 10)}}.Encode()))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	lost := write("first draft", "", false)
+	draft := write("second draft", lost, true)
+	overwritten := write("oops", draft, true)
+	listed := versions()
+	if len(listed) != 3 || listed[0].Hash != overwritten || !listed[0].Current ||
+		listed[1].Hash != draft || listed[1].Current || listed[1].Device != "laptop" ||
+		listed[1].Email != "versions@gobox.test" {
+		t.Fatal("Versions should list the path's changes, newest first")
+	}
+	resp := request(phone, "POST", "clients/",
+		strings.NewReader(url.Values{"lastId": {"0"}}.Encode()))
+	contents, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var synced structs.ClientFileActionsResponse
+	json.Unmarshal(contents, &synced)
+
+	if restore(other, listed[1].FileActionId) != http.StatusNotFound {
+		t.Error("Another user's versions shouldn't be restorable")
+	}
+	if restore(laptop, listed[2].FileActionId) != http.StatusGone {
+		t.Error("A version whose contents were collected can't be restored")
+	}
+	if restore(laptop, listed[1].FileActionId) != http.StatusOK {
+		t.Fatal("Couldn't restore a version")
+	}
+	listed = versions()
+	if len(listed) != 4 || listed[0].Hash != draft || !listed[0].Current ||
+		listed[0].Device != "Server" {
+		t.Error("A restore should be the path's newest version")
+	}
+	resp = request(phone, "POST", "clients/", strings.NewReader(
+		url.Values{"lastId": {strconv.FormatInt(synced.LastId, 10)}}.Encode()))
+	contents, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	synced = structs.ClientFileActionsResponse{}
+	json.Unmarshal(contents, &synced)
+	if len(synced.FileActions) != 1 || synced.FileActions[0].File.Hash != draft ||
+		synced.FileActions[0].PreviousHash != overwritten {
+		t.Error("Devices should get a restore as a create")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	owner, _ := boxtools.NewUser("trash@gobox.test", "password")
+	laptop, _ := boxtools.NewClient(owner, "laptop", false)
+	phone, _ := boxtools.NewClient(owner, "phone", false)
+	request := func(device structs.Client, method, endpoint string,
+		body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+device.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	send := func(device structs.Client, isCreate bool, filePath, contents string) {
+		h := sha256.Sum256([]byte(contents))
+		hash := hex.EncodeToString(h[:])
+		Store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+		blobindex.Record(Store, hash, int64(len(contents)))
+		jsonBytes, _ := json.Marshal([]structs.FileAction{{
+			IsCreate: isCreate,
+			File: structs.File{
+				Name: filepath.Base(filePath),
+				Path: filePath,
+				Hash: hash,
+				Size: int64(len(contents)),
+			},
+		}})
+		request(device, "POST", "file-actions/", bytes.NewBuffer(jsonBytes)).Body.Close()
+	}
+	trash := func(query string) (items []structs.TrashItem) {
+		resp := request(laptop, "GET", "trash/?"+query, nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &items)
+		return
+	}
+	restore := func(values url.Values) (result structs.TrashRestore) {
+		resp := request(laptop, "POST", "trash/restore/",
+			strings.NewReader(values.Encode()))
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &result)
+		return
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		send(laptop, true, "./"+name+".txt", name)
+	}
+	send(laptop, false, "./c.txt", "c")
+	since := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	send(phone, false, "./a.txt", "a")
+	send(phone, false, "./b.txt", "b")
+
+	items := trash("")
+	if len(items) != 3 || items[0].Path != "./b.txt" || items[0].Device != "phone" ||
+		items[0].Hash == "" {
+		t.Fatal("Deleted files should be in the trash, newest first")
+	}
+	phoneItems := trash(url.Values{
+		"device": {strconv.FormatInt(phone.Id, 10)},
+		"since":  {since},
+	}.Encode())
+	if len(phoneItems) != 2 {
+		t.Error("The trash should narrow down to what a device deleted")
+	}
+
+	send(laptop, true, "./b.txt", "a new b")
+	result := restore(url.Values{
+		"device": {strconv.FormatInt(phone.Id, 10)},
+		"since":  {since},
+	})
+	if len(result.Restored) != 1 || result.Restored[0] != "./a.txt" ||
+		len(result.Conflicts) != 1 || result.Conflicts[0] != "./b.txt" {
+		t.Error("Restoring should skip paths that have a file again")
+	}
+	var count int
+	model.DB.Model(structs.FileSystemFile{}).
+		Where("user_id = ? AND path = ?", owner.Id, "./a.txt").Count(&count)
+	if count != 1 {
+		t.Error("A restored file should be back in the user's tree")
+	}
+	resp := request(phone, "POST", "clients/", strings.NewReader(
+		url.Values{"lastId": {"0"}}.Encode()))
+	contents, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var synced structs.ClientFileActionsResponse
+	json.Unmarshal(contents, &synced)
+	restored := false
+	for _, value := range synced.FileActions {
+		restored = restored || (value.IsCreate && value.File.Path == "./a.txt")
+	}
+	if !restored {
+		t.Error("Devices should be sent the restored file")
+	}
+
+	items = trash("")
+	if len(items) != 2 {
+		t.Fatal("Restored files should leave the trash")
+	}
+	result = restore(url.Values{"id": {strconv.FormatInt(items[1].Id, 10)}})
+	if len(result.Restored) != 1 || result.Restored[0] != "./c.txt" {
+		t.Error("Couldn't restore a file by id")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	owner, _ := boxtools.NewUser("snapshots@gobox.test", "password")
+	laptop, _ := boxtools.NewClient(owner, "laptop", false)
+	request := func(method, endpoint string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8000/"+endpoint, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+laptop.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	send := func(isCreate bool, filePath, contents string) {
+		h := sha256.Sum256([]byte(contents))
+		hash := hex.EncodeToString(h[:])
+		Store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+		blobindex.Record(Store, hash, int64(len(contents)))
+		jsonBytes, _ := json.Marshal([]structs.FileAction{{
+			IsCreate: isCreate,
+			File: structs.File{
+				Name: filepath.Base(filePath),
+				Path: filePath,
+				Hash: hash,
+				Size: int64(len(contents)),
+			},
+		}})
+		request("POST", "file-actions/", bytes.NewBuffer(jsonBytes)).Body.Close()
+	}
+	snapshot := func(query string) (snapshot structs.Snapshot) {
+		resp := request("GET", "snapshots/?"+query, nil)
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &snapshot)
+		return
+	}
+	restore := func(values url.Values) (result structs.SnapshotRestore) {
+		resp := request("POST", "snapshots/restore/",
+			strings.NewReader(values.Encode()))
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &result)
+		return
+	}
+
+	// a folder with history from before the owner joins it
+	sharer, _ := boxtools.NewUser("snapshots-sharer@gobox.test", "password")
+	sharerLaptop, _ := boxtools.NewClient(sharer, "laptop", false)
+	teamFile, _ := boxtools.GenerateRandomFile(0)
+	teamFile.Path = "./Team/t.txt"
+	fileActions, _ := boxtools.WriteFileActionsToDatabase(
+		[]structs.FileAction{{IsCreate: true, File: teamFile}}, sharerLaptop)
+	boxtools.ApplyFileActionsToFileSystemFileTable(fileActions, sharer)
+	team, _ := boxtools.ShareFolder(sharer, "./Team", "Team")
+
+	send(true, "./a.txt", "a")
+	send(true, "./docs/b.txt", "b")
+	before, _ := boxtools.LatestFileActionId()
+	id := strconv.FormatInt(before, 10)
+	send(false, "./a.txt", "a")
+	send(true, "./a.txt", "encrypted a")
+	send(false, "./docs/b.txt", "b")
+	send(true, "./c.txt", "c")
+
+	taken := snapshot(url.Values{"id": {id}}.Encode())
+	if taken.FileActionId != before || len(taken.Files) != 2 ||
+		taken.Files[0].Path != "./a.txt" || taken.Files[1].Path != "./docs/b.txt" ||
+		taken.Files[0].Size != 1 {
+		t.Fatal("A snapshot should be the tree as it was at the change")
+	}
+	if len(snapshot(url.Values{"id": {id}, "path": {"./docs"}}.Encode()).Files) != 1 {
+		t.Error("A snapshot should narrow down to a folder")
+	}
+	at := time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	now := snapshot(url.Values{"at": {at}}.Encode())
+	if len(now.Files) != 2 || now.Files[0].Hash == taken.Files[0].Hash {
+		t.Error("A snapshot at a time should be the tree as it was then")
+	}
+	resp := request("GET", "snapshots/", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Error("A snapshot needs an id or a time")
+	}
+
+	resp = request("GET", "snapshots/download/?"+url.Values{"id": {id}}.Encode(), nil)
+	contents, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	archive, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil || len(archive.File) != 2 || archive.File[0].Name != "a.txt" {
+		t.Fatal("A snapshot should download as a zip")
+	}
+	entry, _ := archive.File[0].Open()
+	contents, _ = ioutil.ReadAll(entry)
+	entry.Close()
+	if string(contents) != "a" {
+		t.Error("The zip should have the files' contents at the time")
+	}
+	resp = request("GET", "snapshots/download/?"+
+		url.Values{"id": {id}, "path": {"./docs/b.txt"}}.Encode(), nil)
+	contents, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	archive, err = zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != "b.txt" {
+		t.Error("A file's snapshot should zip it without its folders")
+	}
+
+	result := restore(url.Values{"id": {id}, "prune": {"true"}})
+	if len(result.Restored) != 2 || len(result.Deleted) != 1 ||
+		result.Deleted[0] != "./c.txt" || result.Unchanged != 0 {
+		t.Fatal("Restoring a snapshot should put back and prune files")
+	}
+	restored := snapshot(url.Values{"at": {
+		time.Now().Add(time.Second).UTC().Format(time.RFC3339)}}.Encode())
+	if len(restored.Files) != 2 || restored.Files[0].Hash != taken.Files[0].Hash {
+		t.Error("The tree should be back the way it was")
+	}
+	var count int
+	model.DB.Model(structs.TrashedFile{}).
+		Where("user_id = ? AND path = ?", owner.Id, "./c.txt").Count(&count)
+	if count != 1 {
+		t.Error("Pruned files should go to the trash")
+	}
+	result = restore(url.Values{"id": {id}})
+	if len(result.Restored) != 0 || result.Unchanged != 2 {
+		t.Error("Files that haven't changed shouldn't be restored again")
+	}
+
+	joined, _ := boxtools.LatestFileActionId()
+	model.DB.Create(&structs.NamespaceMember{
+		NamespaceId:    team.Id,
+		UserId:         owner.Id,
+		Role:           structs.RoleEditor,
+		Path:           "./Team",
+		JoinedActionId: joined,
+	})
+	if len(snapshot(url.Values{"id": {id}}.Encode()).Files) != 2 {
+		t.Error("A snapshot from before joining a shared folder shouldn't have it")
+	}
+	result = restore(url.Values{"id": {id}, "prune": {"true"}})
+	if len(result.Restored) != 0 || len(result.Deleted) != 0 {
+		t.Error("Restoring a snapshot shouldn't touch folders joined since")
+	}
+	at = time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	shared := snapshot(url.Values{"at": {at}, "path": {"./Team"}}.Encode())
+	if len(shared.Files) != 1 || shared.Files[0].Path != "./Team/t.txt" {
+		t.Error("A snapshot from after joining a shared folder should have it")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	totpUser, _ := boxtools.NewUser("totp@gobox.test", "hunter22")
+	totpClient, _ := boxtools.NewClient(totpUser, "laptop", false)
+	post := func(endpoint string, values url.Values, v interface{}) int {
+		req, _ := http.NewRequest("POST", "http://localhost:8000/"+endpoint,
+			strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+totpClient.SessionKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if v != nil {
+			json.Unmarshal(contents, v)
+		}
+		return resp.StatusCode
+	}
+	login := func(code string) int {
+		return post("login/", url.Values{
+			"email":    {"totp@gobox.test"},
+			"password": {"hunter22"},
+			"code":     {code},
+		}, nil)
+	}
+
+	var enrollment structs.TOTPEnrollment
+	if post("2fa/enroll/", url.Values{}, &enrollment) != http.StatusOK ||
+		enrollment.Secret == "" {
+		t.Fatal("Couldn't enroll")
+	}
+	if login("") != http.StatusOK {
+		t.Error("Enrolling shouldn't change login until it's confirmed")
+	}
+	if post("2fa/confirm/", url.Values{"code": {"000000"}}, nil) != http.StatusForbidden {
+		t.Error("Confirming with a wrong code should fail")
+	}
+	now := time.Now()
+	code, _ := totp.Code(enrollment.Secret, now)
+	var recoveryCodes []string
+	if post("2fa/confirm/", url.Values{"code": {code}}, &recoveryCodes) != http.StatusOK ||
+		len(recoveryCodes) != boxtools.RecoveryCodeCount {
+		t.Fatal("Couldn't confirm the enrollment")
+	}
+
+	if login("") != http.StatusPreconditionRequired {
+		t.Error("Login should ask for a code")
+	}
+	if login(code) != http.StatusUnauthorized {
+		t.Error("A code shouldn't work twice")
+	}
+	next, _ := totp.Code(enrollment.Secret, now.Add(totp.Step))
+	if login(next) != http.StatusOK {
+		t.Error("Login with a code should work")
+	}
+	if login(recoveryCodes[0]) != http.StatusOK {
+		t.Error("Login with a recovery code should work")
+	}
+	if login(recoveryCodes[0]) != http.StatusUnauthorized {
+		t.Error("A recovery code shouldn't work twice")
+	}
+
+	if post("2fa/disable/", url.Values{"code": {"000000"}}, nil) != http.StatusForbidden {
+		t.Error("Turning 2fa off should take a code")
+	}
+	if post("2fa/disable/", url.Values{"code": {recoveryCodes[1]}}, nil) != http.StatusOK ||
+		login("") != http.StatusOK {
+		t.Error("Couldn't turn 2fa off")
+	}
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(mailer mail.Mailer) { Mailer = mailer }(Mailer)
+	Mailer = &mail.LogMailer{Dir: dir}
+	mailedToken := func() string {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+		sort.Strings(files)
+		if len(files) == 0 {
+			t.Fatal("Nothing was mailed")
+		}
+		contents, _ := ioutil.ReadFile(files[len(files)-1])
+		match := regexp.MustCompile("token=([0-9a-f]{64})").FindSubmatch(contents)
+		if match == nil {
+			t.Fatal("No token in the mail")
+		}
+		return string(match[1])
+	}
+	post := func(endpoint string, values url.Values) int {
+		resp, err := http.PostForm("http://localhost:8000/"+endpoint, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	post("sign-up/", url.Values{
+		"email":    {"verify@gobox.test"},
+		"password": {"hunter22"},
+	})
+	token := mailedToken()
+	resp, _ := http.Get("http://localhost:8000/verify-email/?token=" + token)
+	resp.Body.Close()
+	var verified structs.User
+	model.DB.Where("email = ?", "verify@gobox.test").First(&verified)
+	if resp.StatusCode != http.StatusOK || verified.EmailVerifiedAt.IsZero() {
+		t.Error("Following the mailed link should verify the email")
+	}
+	if post("verify-email/", url.Values{"token": {token}}) != http.StatusNotFound {
+		t.Error("A verification link should only work once")
+	}
+
+	sessionClient, _ := boxtools.NewClient(verified, "laptop", false)
+	if post("password-reset/", url.Values{"email": {"nobody@gobox.test"}}) != http.StatusOK {
+		t.Error("Reset requests for unknown emails should look like any other")
+	}
+	post("password-reset/", url.Values{"email": {"Verify@gobox.test"}})
+	token = mailedToken()
+	if post("password-reset/confirm/", url.Values{
+		"token": {token}, "password": {"short"},
+	}) != http.StatusNotAcceptable {
+		t.Error("Reset should check the new password")
+	}
+	if post("password-reset/confirm/", url.Values{
+		"token": {token}, "password": {"new password"},
+	}) != http.StatusOK {
+		t.Fatal("Couldn't reset the password")
+	}
+	if post("password-reset/confirm/", url.Values{
+		"token": {token}, "password": {"another password"},
+	}) != http.StatusNotFound {
+		t.Error("A reset link should only work once")
+	}
+	if _, err := verifyAndReturnClient(&http.Request{
+		Header: http.Header{"Authorization": {"Bearer " + sessionClient.SessionKey}},
+	}); err == nil {
+		t.Error("Resetting the password should revoke existing sessions")
+	}
+	if post("login/", url.Values{
+		"email": {"verify@gobox.test"}, "password": {"new password"},
+	}) != http.StatusOK {
+		t.Error("The new password should work")
+	}
+}
+
+func TestSSO(t *testing.T) {
+	idp := oidctest.NewIdP("gobox", "secret")
+	defer idp.Close()
+	var err error
+	SSO, err = oidc.NewProvider(idp.URL, "gobox", "secret",
+		"http://localhost:8000/sso/callback/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { SSO = nil }()
+	var browser *http.Client
+	read := func(resp *http.Response, err error) (structs.Session, *http.Response) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var session structs.Session
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(contents, &session)
+		return session, resp
+	}
+	signIn := func(query url.Values) (structs.Session, *http.Response) {
+		jar, _ := cookiejar.New(nil)
+		browser = &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Host == "127.0.0.1:9" ||
+					req.URL.Path == "/sso/second-factor/" {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		return read(browser.Get("http://localhost:8000/sso/login/?" + query.Encode()))
+	}
+	secondFactor := func(code string) (structs.Session, *http.Response) {
+		return read(browser.PostForm("http://localhost:8000/sso/second-factor/",
+			url.Values{"code": {code}}))
+	}
+
+	existing, _ := boxtools.NewUser("sso@gobox.test", "password")
+	idp.SignIn(oidctest.User{Subject: "1", Email: "SSO@gobox.test", EmailVerified: true})
+	session, resp := signIn(url.Values{"name": {"laptop"}})
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("A user who hasn't verified their email shouldn't be linked")
+	}
+	model.DB.Exec("UPDATE users SET email_verified_at = ? WHERE id = ?",
+		time.Now(), existing.Id)
+	session, resp = signIn(url.Values{"name": {"laptop"}})
+	if resp.StatusCode != http.StatusOK || session.SessionKey == "" ||
+		session.ClientName != "laptop" {
+		t.Fatal("Couldn't sign in through the IdP")
+	}
+	var linked structs.User
+	model.DB.First(&linked, existing.Id)
+	if session.Email != "sso@gobox.test" || linked.OIDCSubject == "" ||
+		linked.EmailVerifiedAt.IsZero() {
+		t.Error("Signing in should link the user with the same email")
+	}
+
+	secret, _ := totp.GenerateSecret()
+	model.DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = ? WHERE id = ?",
+		secret, true, existing.Id)
+	session, resp = signIn(url.Values{"name": {"phone"}})
+	if resp.StatusCode != http.StatusFound || session.SessionKey != "" ||
+		resp.Header.Get("Location") != "/sso/second-factor/" {
+		t.Fatal("Signing in should ask for a code when 2fa is on")
+	}
+	if _, resp = secondFactor("000000"); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("A wrong code shouldn't finish the sign in")
+	}
+	code, _ := totp.Code(secret, time.Now())
+	session, resp = secondFactor(code)
+	if resp.StatusCode != http.StatusOK || session.ClientName != "phone" {
+		t.Error("The right code should finish the sign in")
+	}
+	if _, resp = secondFactor(code); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("A sign in should only finish once")
+	}
+
+	idp.SignIn(oidctest.User{Subject: "2", Email: "new.sso@gobox.test", EmailVerified: true})
+	_, resp = signIn(url.Values{"return_to": {"http://127.0.0.1:9/"}})
+	returned, _ := url.Parse(resp.Header.Get("Location"))
+	session, err = decodeTestSession(returned.Query().Get("session"))
+	if resp.StatusCode != http.StatusFound || err != nil ||
+		session.Email != "new.sso@gobox.test" {
+		t.Error("The session should be handed to a loopback return_to")
+	}
+	var created structs.User
+	model.DB.Where("email = ?", "new.sso@gobox.test").First(&created)
+	if created.Id == 0 || created.HashedPassword != "" {
+		t.Error("Signing in should create a user without a password")
+	}
+
+	_, resp = signIn(url.Values{"return_to": {"http://evil.test/"}})
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Error("return_to should be limited to loopback urls and paths")
+	}
+	idp.SignIn(oidctest.User{Subject: "3", Email: "unverified@gobox.test"})
+	_, resp = signIn(url.Values{})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("An unverified email shouldn't be signed in")
+	}
+
+	resp, _ = http.Get("http://localhost:8000/sso/callback/?state=abc&code=def")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("A callback without the browser's cookie should be refused")
+	}
+}
+
+func decodeTestSession(encoded string) (session structs.Session, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(b, &session)
+	}
+	return
+}
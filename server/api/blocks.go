@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"io"
+
+	"github.com/golangbox/gobox/structs"
+)
+
+// blockReader reads a file's blocks from the blob store as if they were
+// one stream. It implements io.Seeker so it can be handed to
+// http.ServeContent, and only opens a block once it is read from, so
+// seeking to the end for the size or to the start of a range is free.
+type blockReader struct {
+	blocks  []structs.Block
+	size    int64
+	offset  int64
+	current io.ReadCloser
+	// currentEnd is the offset the current block ends at
+	currentEnd int64
+}
+
+func newBlockReader(blocks []structs.Block) *blockReader {
+	r := &blockReader{}
+	// offsets come from the client, so work them out again
+	for _, block := range blocks {
+		block.Offset = r.size
+		r.blocks = append(r.blocks, block)
+		r.size += block.Size
+	}
+	return r
+}
+
+func (r *blockReader) Read(p []byte) (n int, err error) {
+	for n == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		if r.current == nil {
+			block := r.blockAt(r.offset)
+			skip := r.offset - block.Offset
+			r.current, err = Store.GetRange(block.Hash, skip, block.Size-skip)
+			if err != nil {
+				r.current = nil
+				return 0, err
+			}
+			r.currentEnd = block.Offset + block.Size
+		}
+		n, err = r.current.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if r.offset != r.currentEnd {
+				return n, io.ErrUnexpectedEOF
+			}
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += r.offset
+	case 2:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, errors.New("blockReader: negative position")
+	}
+	if offset != r.offset && r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blockReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// blockAt returns the block holding the byte at offset.
+func (r *blockReader) blockAt(offset int64) structs.Block {
+	for _, block := range r.blocks {
+		if offset < block.Offset+block.Size {
+			return block
+		}
+	}
+	return r.blocks[len(r.blocks)-1]
+}
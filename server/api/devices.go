@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/golangbox/gobox/UDPush"
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/gorilla/mux"
+)
+
+// DevicesHandler lists the devices linked to the user, which are their
+// clients with a session that hasn't been revoked.
+func DevicesHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var clients []structs.Client
+	query := model.DB.Where("user_id = ? AND is_server = ?", client.UserId, false).
+		Order("id").Find(&clients)
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	devices := []structs.Device{}
+	for _, value := range clients {
+		if !value.RevokedAt.IsZero() {
+			continue
+		}
+		device := structs.Device{
+			Id:                      value.Id,
+			Name:                    value.Name,
+			LastSynchedAt:           value.LastSynchedAt,
+			LastSynchedFileActionId: value.LastSynchedFileActionId,
+			LastSeenAt:              value.LastSeenAt,
+			LastSeenIP:              value.LastSeenIP,
+			CreatedAt:               value.CreatedAt,
+			Current:                 value.Id == client.Id,
+		}
+		query = model.DB.Model(structs.FileAction{}).
+			Where("(namespace_id = 0 AND client_id IN (SELECT id FROM clients WHERE user_id = ?)) OR "+
+				"namespace_id IN (SELECT namespace_id FROM namespace_members WHERE user_id = ?)",
+				value.UserId, value.UserId).
+			Where("client_id <> ? AND id > ?", value.Id, value.LastSynchedFileActionId).
+			Count(&device.Behind)
+		if query.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(query.Error.Error()))
+			return
+		}
+		devices = append(devices, device)
+	}
+	writeJSON(w, devices)
+}
+
+// RenameDeviceHandler sets the name of one of the user's devices.
+func RenameDeviceHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	name := req.FormValue("name")
+	if name == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("A name is required."))
+		return
+	}
+	device, ok := userDevice(w, req, client)
+	if !ok {
+		return
+	}
+	err := model.DB.Exec("UPDATE clients SET name = ? WHERE id = ?",
+		name, device.Id).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// UnlinkDeviceHandler cuts one of the user's devices off: its session key
+// stops working and it stops being told about changes.
+func UnlinkDeviceHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	device, ok := userDevice(w, req, client)
+	if !ok {
+		return
+	}
+	err := unlink(device)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// userDevice loads the device in the url, writing a 404 if it isn't one
+// of client's user's devices.
+func userDevice(w http.ResponseWriter, req *http.Request,
+	client structs.Client) (device structs.Client, ok bool) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err == nil {
+		err = model.DB.Where("id = ? AND user_id = ? AND is_server = ?",
+			id, client.UserId, false).First(&device).Error
+	}
+	if err != nil || !device.RevokedAt.IsZero() {
+		w.WriteHeader(http.StatusNotFound)
+		return device, false
+	}
+	return device, true
+}
+
+// unlink revokes device's session and drops its connection to the
+// pusher, if it has one.
+func unlink(device structs.Client) error {
+	err := boxtools.RevokeSession(device)
+	if err != nil {
+		return err
+	}
+	Pusher.Detach(UDPush.Watcher{SessionKey: device.SessionKey})
+	return nil
+}
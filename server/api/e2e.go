@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+)
+
+// E2EParamsHandler returns the user's end to end encryption parameters,
+// both empty if no client has turned it on.
+func E2EParamsHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var user structs.User
+	err := model.DB.Model(&client).Related(&user).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, structs.E2EParams{Salt: user.E2ESalt, Check: user.E2ECheck})
+}
+
+// SetE2EParamsHandler turns on end to end encryption for the user. The
+// parameters can only be set once, changing them would make every file
+// already uploaded unreadable.
+func SetE2EParamsHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	salt := req.FormValue("Salt")
+	check := req.FormValue("Check")
+	if salt == "" || check == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Salt and Check are required."))
+		return
+	}
+	// only one client can set them up, if two try at once the other one
+	// has to use these parameters rather than its own. gorm names the
+	// columns e2_e_salt and e2_e_check.
+	query := model.DB.Exec(
+		"UPDATE users SET e2_e_salt = ?, e2_e_check = ? WHERE id = ? AND COALESCE(e2_e_salt, '') = ''",
+		salt, check, client.UserId)
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	if query.RowsAffected != 1 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("End to end encryption is already set up."))
+		return
+	}
+	writeJSON(w, structs.E2EParams{Salt: salt, Check: check})
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/mail"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+)
+
+// Mailer sends verification and password reset emails.
+var Mailer mail.Mailer = &mail.LogMailer{}
+
+// BaseURL is what links in emails start with.
+var BaseURL = "http://127.0.0.1:8000"
+
+const (
+	verifyEmailPurpose    = "verify-email"
+	resetPasswordPurpose  = "reset-password"
+	verifyEmailLifetime   = time.Hour * 24 * 7
+	resetPasswordLifetime = time.Hour
+)
+
+var errInvalidToken = errors.New("This link is invalid or has expired.")
+
+// VerifyEmailHandler marks the user's email as verified, given the token
+// from the link they were sent. It answers GET so the link can be
+// followed straight from the email.
+func VerifyEmailHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := useEmailToken(req.FormValue("token"), verifyEmailPurpose)
+	if err == errInvalidToken {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err == nil {
+		err = markEmailVerified(user)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Thanks, " + user.Email + " is verified."))
+}
+
+// ResendVerificationHandler mails the user a new verification link.
+func ResendVerificationHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var user structs.User
+	err := model.DB.Model(&client).Related(&user).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !user.EmailVerifiedAt.IsZero() {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Your email is already verified."))
+		return
+	}
+	err = sendVerificationEmail(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RequestPasswordResetHandler mails a password reset link to email. It
+// answers the same whether or not there's an account for email, so it
+// can't be used to find out who has one.
+func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request) {
+	var user structs.User
+	query := model.DB.Where("email = ?", normalizeEmail(req.FormValue("email"))).
+		First(&user)
+	if query.Error == nil && user.Id != 0 {
+		token, err := newEmailToken(user, resetPasswordPurpose, resetPasswordLifetime)
+		if err == nil {
+			err = Mailer.Send(mail.Message{
+				To:      user.Email,
+				Subject: "Reset your GoBox password",
+				Body: "Someone asked to reset the password for your GoBox account. " +
+					"If it was you, follow this link within an hour:\n\n" +
+					BaseURL + "/reset-password?" + url.Values{"token": {token}}.Encode() +
+					"\n\nIf it wasn't, you can ignore this email.\n",
+			})
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("If there's an account for that email, a reset link is on its way."))
+}
+
+func ResetPasswordPageHandler(w http.ResponseWriter, req *http.Request) {
+	RenderTemplate(w, "reset", nil)
+}
+
+// ResetPasswordHandler sets a new password given the token from a reset
+// link. Every session the user had is revoked, since whoever forgot or
+// leaked the old password may not be the only one holding a key.
+func ResetPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	password := req.FormValue("password")
+	err := checkPassword(password)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	user, err := useEmailToken(req.FormValue("token"), resetPasswordPurpose)
+	if err == errInvalidToken {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err == nil {
+		err = boxtools.SetUserPassword(user, password)
+	}
+	if err == nil {
+		err = boxtools.RevokeUserSessions(user)
+	}
+	if err == nil {
+		// other reset links mailed before this one
+		err = model.DB.Exec(
+			"UPDATE email_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at < ?",
+			time.Now(), user.Id, resetPasswordPurpose, time.Unix(0, 0),
+		).Error
+	}
+	if err == nil && user.EmailVerifiedAt.IsZero() {
+		// getting the link shows the address is theirs
+		err = markEmailVerified(user)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Your password has been reset, log in again on your devices."))
+}
+
+func sendVerificationEmail(user structs.User) error {
+	token, err := newEmailToken(user, verifyEmailPurpose, verifyEmailLifetime)
+	if err != nil {
+		return err
+	}
+	return Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your GoBox email",
+		Body: "Follow this link to verify the email for your GoBox account:\n\n" +
+			BaseURL + "/verify-email/?" + url.Values{"token": {token}}.Encode() + "\n",
+	})
+}
+
+func markEmailVerified(user structs.User) error {
+	return model.DB.Exec("UPDATE users SET email_verified_at = ? WHERE id = ?",
+		time.Now(), user.Id).Error
+}
+
+// newEmailToken creates a token for user that useEmailToken accepts once,
+// for purpose, until lifetime from now.
+func newEmailToken(user structs.User, purpose string,
+	lifetime time.Duration) (token string, err error) {
+	token, err = boxtools.GenerateRandomSha256()
+	if err != nil {
+		return
+	}
+	err = model.DB.Create(&structs.EmailToken{
+		UserId:      user.Id,
+		Purpose:     purpose,
+		HashedToken: hashToken(token),
+		ExpiresAt:   time.Now().Add(lifetime),
+	}).Error
+	return
+}
+
+// useEmailToken returns the user token was created for, and marks it used.
+// It returns errInvalidToken if token isn't for purpose, has expired or
+// was used already.
+func useEmailToken(token, purpose string) (user structs.User, err error) {
+	if token == "" {
+		return user, errInvalidToken
+	}
+	var emailToken structs.EmailToken
+	query := model.DB.Where("hashed_token = ? AND purpose = ?",
+		hashToken(token), purpose).First(&emailToken)
+	if query.Error != nil || emailToken.Id == 0 ||
+		time.Now().After(emailToken.ExpiresAt) {
+		return user, errInvalidToken
+	}
+	// only one request can mark it used
+	query = model.DB.Exec(
+		"UPDATE email_tokens SET used_at = ? WHERE id = ? AND used_at < ?",
+		time.Now(), emailToken.Id, time.Unix(0, 0))
+	if query.Error != nil {
+		return user, query.Error
+	}
+	if query.RowsAffected != 1 {
+		return user, errInvalidToken
+	}
+	err = model.DB.First(&user, emailToken.UserId).Error
+	return
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Passwords must be at least %d characters.",
+			minPasswordLength)
+	}
+	return nil
+}
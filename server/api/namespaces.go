@@ -0,0 +1,333 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/gorilla/mux"
+)
+
+// resolveNamespaces moves the actions on files in user's shared folders
+// into the namespaces' journals, with paths relative to the namespace.
+// Changes viewers make are rejected, since they can't change the files.
+// The NamespaceId clients send is ignored: only the path decides which
+// namespace an action is in.
+func resolveNamespaces(fileActions []structs.FileAction, user structs.User) (
+	resolved []structs.FileAction, rejected []structs.RejectedFileAction,
+	err error) {
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, value := range fileActions {
+		value.NamespaceId = 0
+		value.File.NamespaceId = 0
+		member, relative := boxtools.ResolvePath(memberships, value.File.Path)
+		if member != nil {
+			if !boxtools.CanWrite(member.Role) {
+				rejected = append(rejected, structs.RejectedFileAction{
+					Path:   value.File.Path,
+					Code:   http.StatusForbidden,
+					Reason: "Viewers can't change this shared folder.",
+				})
+				continue
+			}
+			value.NamespaceId = member.NamespaceId
+			value.File.Path = relative
+		}
+		resolved = append(resolved, value)
+	}
+	return resolved, rejected, nil
+}
+
+// namespaceActions returns what's changed in member's namespace since
+// lastId, leaving out what client did itself. Members that joined after
+// lastId get the files in the namespace instead of its history. The
+// second value is the newest journal entry that has been accounted for.
+func namespaceActions(member structs.NamespaceMember, client structs.Client,
+	lastId int64) (fileActions []structs.FileAction, highestId int64, err error) {
+	if lastId < member.JoinedActionId {
+		var fileSystemFiles []structs.FileSystemFile
+		query := model.DB.Where("namespace_id = ?", member.NamespaceId).
+			Find(&fileSystemFiles)
+		if query.Error != nil {
+			return nil, 0, query.Error
+		}
+		for _, value := range fileSystemFiles {
+			fileActions = append(fileActions, structs.FileAction{
+				NamespaceId: member.NamespaceId,
+				IsCreate:    true,
+				FileId:      value.FileId,
+			})
+		}
+		lastId = member.JoinedActionId
+	}
+	var journal []structs.FileAction
+	query := model.DB.Where("namespace_id = ? AND client_id <> ? AND id > ?",
+		member.NamespaceId, client.Id, lastId).
+		Order("id").
+		Find(&journal)
+	if query.Error != nil {
+		return nil, 0, query.Error
+	}
+	highestId = lastId
+	for _, value := range journal {
+		if value.Id > highestId {
+			highestId = value.Id
+		}
+	}
+	return append(fileActions, journal...), highestId, nil
+}
+
+// NamespacesHandler lists the user's shared folders and who they're
+// shared with.
+func NamespacesHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	memberships, err := boxtools.Memberships(structs.User{Id: client.UserId})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	folders := []structs.SharedFolder{}
+	for _, value := range memberships {
+		folder, err := sharedFolder(value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		folders = append(folders, folder)
+	}
+	writeJSON(w, folders)
+}
+
+// CreateNamespaceHandler shares the folder at path, which becomes a
+// namespace owned by the user. Nobody else is a member until the owner
+// adds them.
+func CreateNamespaceHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	folder := path.Clean(req.FormValue("path"))
+	if folder == "." || folder == "/" || strings.HasPrefix(folder, "../") ||
+		folder == ".." || path.IsAbs(folder) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("path must be a folder in your gobox."))
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		name = path.Base(folder)
+	}
+	user := structs.User{Id: client.UserId}
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, value := range memberships {
+		if path.Clean(value.Path) == folder ||
+			boxtools.InFolder(folder, value.Path) ||
+			boxtools.InFolder(value.Path, folder) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("This folder is or has a shared folder in it."))
+			return
+		}
+	}
+	namespace, err := boxtools.ShareFolder(user, folder, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var member structs.NamespaceMember
+	err = model.DB.Where("namespace_id = ? AND user_id = ?", namespace.Id, user.Id).
+		First(&member).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	shared, err := sharedFolder(member)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, shared)
+}
+
+// AddNamespaceMemberHandler shares the namespace in the url with the user
+// with email, as an editor or viewer, or changes the role of a member.
+// New members find it in a folder named after it in their tree.
+func AddNamespaceMemberHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	role := req.FormValue("role")
+	if role != structs.RoleEditor && role != structs.RoleViewer {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("role must be editor or viewer."))
+		return
+	}
+	owner, ok := userMembership(w, req, client)
+	if !ok {
+		return
+	}
+	if owner.Role != structs.RoleOwner {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Only the owner can share this folder."))
+		return
+	}
+	var user structs.User
+	query := model.DB.Where("email = ?", normalizeEmail(req.FormValue("email"))).
+		First(&user)
+	if query.Error != nil || user.Id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("There's no user with that email."))
+		return
+	}
+
+	var member structs.NamespaceMember
+	model.DB.Where("namespace_id = ? AND user_id = ?", owner.NamespaceId, user.Id).
+		First(&member)
+	if member.Id != 0 {
+		if member.Role == structs.RoleOwner {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("The owner's role can't be changed."))
+			return
+		}
+		err := model.DB.Exec("UPDATE namespace_members SET role = ? WHERE id = ?",
+			role, member.Id).Error
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var namespace structs.Namespace
+	err := model.DB.First(&namespace, owner.NamespaceId).Error
+	var folder string
+	if err == nil {
+		folder, err = boxtools.FreeFolder(user, namespace.Name)
+	}
+	var latest int64
+	if err == nil {
+		latest, err = boxtools.LatestFileActionId()
+	}
+	if err == nil {
+		member = structs.NamespaceMember{
+			NamespaceId:    namespace.Id,
+			UserId:         user.Id,
+			Role:           role,
+			Path:           folder,
+			JoinedActionId: latest,
+		}
+		err = model.DB.Create(&member).Error
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// the new member's devices pick the folder up on their next sync
+	Pusher.Notify("")
+	w.WriteHeader(http.StatusOK)
+}
+
+// RemoveNamespaceMemberHandler stops sharing the namespace in the url
+// with the user with email. The owner can remove anyone but themselves,
+// and other members can leave. Their devices keep the copies they have.
+func RemoveNamespaceMemberHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	current, ok := userMembership(w, req, client)
+	if !ok {
+		return
+	}
+	var user structs.User
+	model.DB.Where("email = ?", normalizeEmail(req.FormValue("email"))).First(&user)
+	var member structs.NamespaceMember
+	if user.Id != 0 {
+		model.DB.Where("namespace_id = ? AND user_id = ?", current.NamespaceId, user.Id).
+			First(&member)
+	}
+	if member.Id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("That user isn't a member of this folder."))
+		return
+	}
+	if current.Role != structs.RoleOwner && member.Id != current.Id {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Only the owner can remove other members."))
+		return
+	}
+	if member.Role == structs.RoleOwner {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("The owner can't be removed."))
+		return
+	}
+	err := model.DB.Exec("DELETE FROM namespace_members WHERE id = ?", member.Id).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// userMembership loads the client's user's membership of the namespace
+// in the url, writing a 404 if they aren't a member.
+func userMembership(w http.ResponseWriter, req *http.Request,
+	client structs.Client) (member structs.NamespaceMember, ok bool) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err == nil {
+		err = model.DB.Where("namespace_id = ? AND user_id = ?", id, client.UserId).
+			First(&member).Error
+	}
+	if err != nil || member.Id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return member, false
+	}
+	return member, true
+}
+
+// sharedFolder is how member sees their namespace.
+func sharedFolder(member structs.NamespaceMember) (folder structs.SharedFolder,
+	err error) {
+	var namespace structs.Namespace
+	err = model.DB.First(&namespace, member.NamespaceId).Error
+	if err != nil {
+		return
+	}
+	var members []structs.NamespaceMember
+	err = model.DB.Where("namespace_id = ?", member.NamespaceId).Order("id").
+		Find(&members).Error
+	if err != nil {
+		return
+	}
+	folder = structs.SharedFolder{
+		Id:      namespace.Id,
+		Name:    namespace.Name,
+		Path:    member.Path,
+		Role:    member.Role,
+		Members: []structs.SharedFolderMember{},
+	}
+	for _, value := range members {
+		var user structs.User
+		err = model.DB.First(&user, value.UserId).Error
+		if err != nil {
+			return
+		}
+		folder.Members = append(folder.Members, structs.SharedFolderMember{
+			Email: user.Email,
+			Role:  value.Role,
+		})
+	}
+	return folder, nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+)
+
+// lastSeenResolution is how stale a client's LastSeenAt may get, so it
+// isn't written on every request.
+const lastSeenResolution = time.Minute
+
+// requestSessionKey reads the session key from the Authorization header.
+// Keys in the url or the form aren't accepted, they end up in logs.
+func requestSessionKey(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+func recordLastSeen(client *structs.Client, req *http.Request) error {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	now := time.Now()
+	if ip == client.LastSeenIP && now.Sub(client.LastSeenAt) < lastSeenResolution {
+		return nil
+	}
+	client.LastSeenAt = now
+	client.LastSeenIP = ip
+	return model.DB.Exec(
+		"UPDATE clients SET last_seen_at = ?, last_seen_ip = ? WHERE id = ?",
+		now, ip, client.Id,
+	).Error
+}
+
+// RefreshSessionHandler pushes the expiry of the client's session key
+// back to a full lifetime from now.
+func RefreshSessionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	client.SessionExpiresAt = time.Now().Add(boxtools.SessionLifetime)
+	saveSession(w, client)
+}
+
+// RotateSessionHandler replaces the client's session key. The old key
+// stops working right away, and the client's push connection is kept
+// under the new one, so unlinking it later still drops it.
+func RotateSessionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	oldKey := client.SessionKey
+	var err error
+	client.SessionKey, err = boxtools.GenerateRandomSha256()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	client.SessionExpiresAt = time.Now().Add(boxtools.SessionLifetime)
+	if saveSession(w, client) {
+		Pusher.Rekey(oldKey, client.SessionKey)
+	}
+}
+
+// RevokeSessionHandler revokes the client's own session, or with ClientId
+// the session of another of the user's clients.
+func RevokeSessionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	if id := req.FormValue("ClientId"); id != "" {
+		clientId, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("ClientId must be a number."))
+			return
+		}
+		var other structs.Client
+		query := model.DB.Where("id = ? AND user_id = ?", clientId, client.UserId).
+			First(&other)
+		if query.Error != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		client = other
+	}
+	err := unlink(client)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// saveSession saves client's session and writes it back, reporting
+// whether it was saved.
+func saveSession(w http.ResponseWriter, client structs.Client) bool {
+	err := model.DB.Save(&client).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	var user structs.User
+	model.DB.Model(&client).Related(&user)
+	writeJSON(w, structs.Session{
+		ClientId:   client.Id,
+		ClientName: client.Name,
+		Email:      user.Email,
+		SessionKey: client.SessionKey,
+		ExpiresAt:  client.SessionExpiresAt,
+	})
+	return true
+}
@@ -0,0 +1,464 @@
+package api
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errShareNotFound  = errors.New("This link doesn't exist.")
+	errShareExpired   = errors.New("This link has expired.")
+	errShareExhausted = errors.New("This link has been downloaded as many times as it can be.")
+	errSharePassword  = errors.New("This link needs the right password.")
+)
+
+// CreateShareHandler makes a link anyone can download the file or folder
+// at path in the user's tree with. It can have a password, an expiry
+// given as a duration like 72h, and a maximum number of downloads.
+func CreateShareHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	link := structs.ShareLink{UserId: client.UserId}
+	if expires := req.FormValue("expires"); expires != "" {
+		lifetime, err := time.ParseDuration(expires)
+		if err != nil || lifetime <= 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("expires must be a duration like 72h."))
+			return
+		}
+		link.ExpiresAt = time.Now().Add(lifetime)
+	}
+	if maxDownloads := req.FormValue("max_downloads"); maxDownloads != "" {
+		var err error
+		link.MaxDownloads, err = strconv.ParseInt(maxDownloads, 10, 64)
+		if err != nil || link.MaxDownloads < 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("max_downloads must be a number."))
+			return
+		}
+	}
+	if password := req.FormValue("password"); password != "" {
+		var err error
+		link.HashedPassword, err = boxtools.HashSecret(password)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	filePath := req.FormValue("path")
+	if filePath == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("A path is required."))
+		return
+	}
+	memberships, err := boxtools.Memberships(structs.User{Id: client.UserId})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	member, relative := boxtools.ResolvePath(memberships, filePath)
+	for i, value := range memberships {
+		if path.Clean(value.Path) == path.Clean(filePath) {
+			member, relative = &memberships[i], "."
+		}
+	}
+	link.Path = relative
+	if member != nil {
+		link.NamespaceId = member.NamespaceId
+	}
+	files, err := shareFiles(link)
+	if err == nil && len(files) == 0 {
+		link.IsFolder = true
+		files, err = shareFiles(link)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(files) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("There's nothing at that path."))
+		return
+	}
+
+	token, err := boxtools.GenerateRandomSha256()
+	if err == nil {
+		link.HashedToken = hashToken(token)
+		err = model.DB.Create(&link).Error
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	share := shareOf(link, member)
+	share.Token = token
+	share.URL = BaseURL + "/s/" + token
+	writeJSON(w, share)
+}
+
+// SharesHandler lists the user's share links that haven't been revoked.
+func SharesHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var links []structs.ShareLink
+	query := model.DB.Where("user_id = ? AND revoked_at < ?", client.UserId,
+		time.Unix(0, 0)).Order("id").Find(&links)
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	memberships, err := boxtools.Memberships(structs.User{Id: client.UserId})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	shares := []structs.Share{}
+	for _, value := range links {
+		var member *structs.NamespaceMember
+		for i := range memberships {
+			if memberships[i].NamespaceId == value.NamespaceId {
+				member = &memberships[i]
+			}
+		}
+		if value.NamespaceId != 0 && member == nil {
+			// the user has left the shared folder, so it doesn't work
+			continue
+		}
+		shares = append(shares, shareOf(value, member))
+	}
+	writeJSON(w, shares)
+}
+
+// RevokeShareHandler stops one of the user's share links working.
+func RevokeShareHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := model.DB.Exec(
+		"UPDATE share_links SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at < ?",
+		time.Now(), id, client.UserId, time.Unix(0, 0))
+	if query.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	if query.RowsAffected != 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// SharePageHandler is where share links point. A file without a password
+// is downloaded straight away, anything else gets a page that asks for
+// the password and lists the folder.
+func SharePageHandler(w http.ResponseWriter, req *http.Request) {
+	link, err := openShare(mux.Vars(req)["token"], "")
+	if err == errSharePassword || (err == nil && link.IsFolder) {
+		RenderTemplate(w, "share", nil)
+		return
+	}
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	serveShare(w, req, link, "")
+}
+
+// ShareFilesHandler lists what a share link is for, given its password
+// if it has one.
+func ShareFilesHandler(w http.ResponseWriter, req *http.Request) {
+	link, err := openShare(mux.Vars(req)["token"], req.FormValue("password"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	files, err := shareFiles(link)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	listing := structs.ShareListing{
+		Name:     shareName(link),
+		IsFolder: link.IsFolder,
+		Files:    []structs.SharedFile{},
+	}
+	for _, value := range files {
+		listing.Files = append(listing.Files, structs.SharedFile{
+			Path:     value.Path,
+			Size:     value.File.Size,
+			Modified: value.File.Modified,
+		})
+	}
+	writeJSON(w, listing)
+}
+
+// ShareDownloadHandler downloads the file a share link is for, given its
+// password if it has one. For a folder it downloads the file at path in
+// it, or without a path the whole folder as a zip.
+func ShareDownloadHandler(w http.ResponseWriter, req *http.Request) {
+	link, err := openShare(mux.Vars(req)["token"], req.FormValue("password"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	serveShare(w, req, link, req.FormValue("path"))
+}
+
+// openShare finds the link token is for, and checks it can still be used
+// and that password is right.
+func openShare(token string, password string) (link structs.ShareLink,
+	err error) {
+	if token == "" {
+		return link, errShareNotFound
+	}
+	query := model.DB.Where("hashed_token = ?", hashToken(token)).First(&link)
+	if query.Error != nil || link.Id == 0 || !link.RevokedAt.IsZero() {
+		return link, errShareNotFound
+	}
+	if link.NamespaceId != 0 {
+		var count int
+		query = model.DB.Model(structs.NamespaceMember{}).
+			Where("namespace_id = ? AND user_id = ?", link.NamespaceId, link.UserId).
+			Count(&count)
+		if query.Error != nil {
+			return link, query.Error
+		}
+		if count == 0 {
+			return link, errShareNotFound
+		}
+	}
+	if !link.ExpiresAt.IsZero() && time.Now().After(link.ExpiresAt) {
+		return link, errShareExpired
+	}
+	if link.MaxDownloads != 0 && link.Downloads >= link.MaxDownloads {
+		return link, errShareExhausted
+	}
+	if link.HashedPassword != "" &&
+		(password == "" || !boxtools.MatchesHash(link.HashedPassword, password)) {
+		return link, errSharePassword
+	}
+	return link, nil
+}
+
+func writeShareError(w http.ResponseWriter, err error) {
+	switch err {
+	case errShareNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case errShareExpired, errShareExhausted:
+		w.WriteHeader(http.StatusGone)
+	case errSharePassword:
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// serveShare counts a download of link and serves the file at filePath
+// in it, or all of it. Requests for part of a file, or for one the client
+// already has, are served without being counted.
+func serveShare(w http.ResponseWriter, req *http.Request,
+	link structs.ShareLink, filePath string) {
+	files, err := shareFiles(link)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if filePath != "" {
+		var found []structs.FileSystemFile
+		for _, value := range files {
+			if value.Path == path.Clean(filePath) {
+				found = append(found, value)
+			}
+		}
+		files = found
+	}
+	if len(files) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("That file isn't in this link."))
+		return
+	}
+
+	single := !link.IsFolder || filePath != ""
+	// zips ignore Range and have no ETag, so every one is a download
+	if !single || countsAsDownload(req, `"`+files[0].File.Hash+`"`) {
+		// only one request can take the last download
+		query := model.DB.Exec(
+			"UPDATE share_links SET downloads = downloads + 1 WHERE id = ? AND (max_downloads = 0 OR downloads < max_downloads)",
+			link.Id)
+		if query.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(query.Error.Error()))
+			return
+		}
+		if query.RowsAffected != 1 {
+			writeShareError(w, errShareExhausted)
+			return
+		}
+	}
+
+	if single {
+		file := files[0].File
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(
+			"attachment",
+			map[string]string{"filename": file.Name},
+		))
+		serveBlocks(w, req, file.Name, file.Modified, file.Hash, file.Blocks)
+		return
+	}
+
+	err = writeZip(w, shareName(link), files)
+	if err != nil {
+		log.Println("Share", link.Id, "zip:", err)
+	}
+}
+
+// countsAsDownload reports whether req, for the file with etag, gets the
+// file from its first byte. A player seeking through it or a download
+// being resumed asks for a range further in, and a client checking the
+// copy it has sends its ETag in If-None-Match.
+func countsAsDownload(req *http.Request, etag string) bool {
+	for _, value := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == etag || value == "*" {
+			return false
+		}
+	}
+	ranges := req.Header.Get("Range")
+	if ranges == "" || !strings.HasPrefix(ranges, "bytes=") {
+		return true
+	}
+	// a stale If-Range gets the whole file
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		return true
+	}
+	first := strings.Split(strings.TrimPrefix(ranges, "bytes="), ",")[0]
+	return strings.HasPrefix(strings.TrimSpace(first), "0-")
+}
+
+// writeZip sends files as a zip called name, each at its Path in it.
+// Once it has started writing, all it can do about an error is cut the
+// response short and return it.
+func writeZip(w http.ResponseWriter, name string,
+	files []structs.FileSystemFile) error {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"attachment",
+		map[string]string{"filename": name + ".zip"},
+	))
+	archive := zip.NewWriter(w)
+	for _, value := range files {
+		header := &zip.FileHeader{
+			Name:     value.Path,
+			Method:   zip.Deflate,
+			Modified: value.File.Modified,
+		}
+		entry, err := archive.CreateHeader(header)
+		if err == nil {
+			reader := newBlockReader(value.File.Blocks)
+			_, err = io.Copy(entry, reader)
+			reader.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// shareFiles returns the files link is for, with their blocks. For a
+// folder their paths are relative to it.
+func shareFiles(link structs.ShareLink) (files []structs.FileSystemFile,
+	err error) {
+	var fileSystemFiles []structs.FileSystemFile
+	query := model.DB.Where("namespace_id = ?", link.NamespaceId)
+	if link.NamespaceId == 0 {
+		query = query.Where("user_id = ?", link.UserId)
+	}
+	query = query.Order("path").Find(&fileSystemFiles)
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	folder := path.Clean(link.Path)
+	for _, value := range fileSystemFiles {
+		filePath := path.Clean(value.Path)
+		switch {
+		case !link.IsFolder && filePath == folder:
+			value.Path = path.Base(filePath)
+		case link.IsFolder && folder == ".":
+			value.Path = filePath
+		case link.IsFolder && strings.HasPrefix(filePath, folder+"/"):
+			value.Path = filePath[len(folder)+1:]
+		default:
+			continue
+		}
+		// paths come from clients, and end up in zips
+		if value.Path == ".." || strings.HasPrefix(value.Path, "../") ||
+			path.IsAbs(value.Path) {
+			continue
+		}
+		err = model.DB.First(&value.File, value.FileId).Error
+		if err != nil {
+			return nil, err
+		}
+		err = boxtools.LoadFileBlocks(&value.File)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, value)
+	}
+	return files, nil
+}
+
+// shareName is the name of the file or folder link is for.
+func shareName(link structs.ShareLink) string {
+	if path.Clean(link.Path) == "." && link.NamespaceId != 0 {
+		var namespace structs.Namespace
+		model.DB.First(&namespace, link.NamespaceId)
+		return namespace.Name
+	}
+	return path.Base(path.Clean(link.Path))
+}
+
+// shareOf is how link is shown to the user who made it, who sees
+// namespace paths where they have the shared folder in their tree.
+func shareOf(link structs.ShareLink, member *structs.NamespaceMember) structs.Share {
+	sharePath := link.Path
+	if member != nil {
+		sharePath = boxtools.MountedPath(*member, link.Path)
+	}
+	return structs.Share{
+		Id:           link.Id,
+		Path:         sharePath,
+		IsFolder:     link.IsFolder,
+		HasPassword:  link.HashedPassword != "",
+		ExpiresAt:    link.ExpiresAt,
+		MaxDownloads: link.MaxDownloads,
+		Downloads:    link.Downloads,
+		CreatedAt:    link.CreatedAt,
+	}
+}
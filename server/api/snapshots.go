@@ -0,0 +1,288 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+var errBadSnapshot = errors.New("Give the id of a change, or a time like 2015-02-09T14:39:22Z.")
+
+// SnapshotHandler lists the files in the user's tree as it was right
+// after the change with id, or at a time. path narrows it down to a
+// folder.
+func SnapshotHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	id, files, err := snapshotFiles(req, structs.User{Id: client.UserId})
+	if err == errBadSnapshot {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	snapshot := structs.Snapshot{
+		FileActionId: id,
+		Files:        []structs.SnapshotFile{},
+	}
+	for _, value := range files {
+		snapshot.Files = append(snapshot.Files, structs.SnapshotFile{
+			Path:     value.Path,
+			Hash:     value.Hash,
+			Size:     value.Size,
+			Modified: value.Modified,
+		})
+	}
+	writeJSON(w, snapshot)
+}
+
+// SnapshotDownloadHandler sends the files SnapshotHandler would list as a
+// zip, with paths relative to the folder asked for. A path that names a
+// file gets a zip with just that file in it.
+func SnapshotDownloadHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	id, files, err := snapshotFiles(req, structs.User{Id: client.UserId})
+	if err == errBadSnapshot {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	folder := path.Clean(req.FormValue("path"))
+	var entries []structs.FileSystemFile
+	for _, value := range files {
+		entry := path.Clean(value.Path)
+		switch {
+		case entry == folder:
+			// path names a file rather than a folder
+			entry = path.Base(entry)
+		case folder != ".":
+			entry = strings.TrimPrefix(entry, folder+"/")
+		}
+		// paths come from clients, and end up in zips
+		if entry == ".." || strings.HasPrefix(entry, "../") || path.IsAbs(entry) {
+			continue
+		}
+		err = boxtools.LoadFileBlocks(&value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		entries = append(entries, structs.FileSystemFile{Path: entry, File: value})
+	}
+	name := "gobox"
+	if folder != "." {
+		name = path.Base(folder)
+	}
+	err = writeZip(w, name+"-"+strconv.FormatInt(id, 10), entries)
+	if err != nil {
+		log.Println("Snapshot", id, "zip:", err)
+	}
+}
+
+// SnapshotRestoreHandler puts the user's tree, or the folder at path in
+// it, back the way it was in a snapshot. Files that are missing or have
+// changed since are restored, and with prune, files added since are
+// deleted into the trash. Shared folders the user joined after the
+// snapshot weren't in it, so they're left alone. Like any other restore,
+// these are new changes in the journal, so every device gets them the
+// next time it syncs.
+func SnapshotRestoreHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var user structs.User
+	err := model.DB.First(&user, client.UserId).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	id, files, err := snapshotFiles(req, user)
+	if err == errBadSnapshot {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	current, err := boxtools.CurrentTree(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	result := structs.SnapshotRestore{
+		Restored: []string{},
+		Deleted:  []string{},
+		Gone:     []string{},
+		ReadOnly: []string{},
+	}
+	var fileActions []structs.FileAction
+	inSnapshot := make(map[string]bool)
+	for _, value := range files {
+		inSnapshot[path.Clean(value.Path)] = true
+		now, exists := current[path.Clean(value.Path)]
+		if exists && now.Hash == value.Hash {
+			result.Unchanged++
+			continue
+		}
+		namespaceId, target, ok := snapshotTarget(memberships, value.Path)
+		if !ok {
+			result.ReadOnly = append(result.ReadOnly, value.Path)
+			continue
+		}
+		err = boxtools.LoadFileBlocks(&value)
+		var fileAction structs.FileAction
+		if err == nil {
+			fileAction, err = restoreAction(value, target, namespaceId, now.Hash)
+		}
+		if err == errContentsGone {
+			result.Gone = append(result.Gone, value.Path)
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		fileActions = append(fileActions, fileAction)
+		result.Restored = append(result.Restored, value.Path)
+	}
+
+	if req.FormValue("prune") != "" {
+		joinedAfter := make(map[int64]bool)
+		for _, value := range memberships {
+			joinedAfter[value.NamespaceId] = id < value.JoinedActionId
+		}
+		folder := path.Clean(req.FormValue("path"))
+		var added []string
+		for key, value := range current {
+			if !inSnapshot[key] && inSnapshotFolder(value.Path, folder) &&
+				!joinedAfter[value.NamespaceId] {
+				added = append(added, key)
+			}
+		}
+		sort.Strings(added)
+		for _, key := range added {
+			file := current[key]
+			namespaceId, target, ok := snapshotTarget(memberships, file.Path)
+			if !ok {
+				result.ReadOnly = append(result.ReadOnly, file.Path)
+				continue
+			}
+			result.Deleted = append(result.Deleted, file.Path)
+			file.Id = 0
+			file.Path = target
+			fileActions = append(fileActions, structs.FileAction{
+				IsCreate:     false,
+				NamespaceId:  namespaceId,
+				PreviousHash: file.Hash,
+				File:         file,
+			})
+		}
+	}
+
+	if len(fileActions) != 0 {
+		_, err = writeAsServer(user, fileActions)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	writeJSON(w, result)
+}
+
+// snapshotFiles rebuilds user's tree at the change with the id in req,
+// or the last change at its at, and returns the id and the files in the
+// folder at path in it, sorted by path.
+func snapshotFiles(req *http.Request, user structs.User) (id int64,
+	files []structs.File, err error) {
+	switch {
+	case req.FormValue("id") != "":
+		id, err = strconv.ParseInt(req.FormValue("id"), 10, 64)
+		if err != nil {
+			return 0, nil, errBadSnapshot
+		}
+	case req.FormValue("at") != "":
+		at, err := time.Parse(time.RFC3339, req.FormValue("at"))
+		if err != nil {
+			return 0, nil, errBadSnapshot
+		}
+		var fileAction structs.FileAction
+		query := model.DB.Where("created_at <= ?", at).Order("id desc").
+			First(&fileAction)
+		if query.Error != nil && query.Error != gorm.RecordNotFound {
+			return 0, nil, query.Error
+		}
+		id = fileAction.Id
+	default:
+		return 0, nil, errBadSnapshot
+	}
+
+	tree, err := boxtools.TreeAt(user, id)
+	if err != nil {
+		return
+	}
+	folder := path.Clean(req.FormValue("path"))
+	var paths []string
+	for key, value := range tree {
+		if inSnapshotFolder(value.Path, folder) {
+			paths = append(paths, key)
+		}
+	}
+	sort.Strings(paths)
+	for _, value := range paths {
+		files = append(files, tree[value])
+	}
+	return id, files, nil
+}
+
+// inSnapshotFolder reports whether filePath is folder, or in it. The
+// folder "." is the whole tree.
+func inSnapshotFolder(filePath, folder string) bool {
+	return folder == "." || path.Clean(filePath) == folder ||
+		boxtools.InFolder(filePath, folder)
+}
+
+// snapshotTarget is the namespace and the path in it that filePath, in
+// the tree of the member of memberships, is written to. ok is false if
+// it's in a shared folder they can only view.
+func snapshotTarget(memberships []structs.NamespaceMember, filePath string) (
+	namespaceId int64, target string, ok bool) {
+	member, relative := boxtools.ResolvePath(memberships, filePath)
+	if member == nil {
+		return 0, filePath, true
+	}
+	if !boxtools.CanWrite(member.Role) {
+		return 0, "", false
+	}
+	return member.NamespaceId, relative, true
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/oidc"
+	"github.com/golangbox/gobox/structs"
+)
+
+// SSO is the identity provider users can sign in with, nil if there
+// isn't one.
+var SSO *oidc.Provider
+
+const (
+	ssoCookie             = "gobox_sso"
+	ssoSecondFactorCookie = "gobox_sso_2fa"
+	// ssoLoginLifetime is how long a user has to sign in at the provider,
+	// and then to give their second factor
+	ssoLoginLifetime = time.Minute * 10
+	// ssoSecondFactorAttempts is how many wrong codes end a sign in
+	ssoSecondFactorAttempts = 5
+)
+
+var (
+	errSSOEmail      = errors.New("The identity provider didn't give a verified email.")
+	errSSOUnverified = errors.New("An account with this email exists, but hasn't verified it. Verify the email, then sign in here again.")
+)
+
+// ssoLogin is what the callback needs to finish a sign in that was
+// started by SSOLoginHandler. Once the provider has signed in a user with
+// two-factor authentication, userId is who is waiting to give a code.
+type ssoLogin struct {
+	nonce    string
+	verifier string
+	name     string
+	returnTo string
+	expires  time.Time
+	userId   int64
+	attempts int
+}
+
+type ssoLoginMap struct {
+	sync.Mutex
+	m map[string]ssoLogin
+}
+
+// put adds login under key, dropping the logins that have expired.
+func (logins *ssoLoginMap) put(key string, login ssoLogin) {
+	logins.Lock()
+	defer logins.Unlock()
+	for k, value := range logins.m {
+		if time.Now().After(value.expires) {
+			delete(logins.m, k)
+		}
+	}
+	logins.m[key] = login
+}
+
+var (
+	ssoLogins        = ssoLoginMap{m: make(map[string]ssoLogin)}
+	ssoSecondFactors = ssoLoginMap{m: make(map[string]ssoLogin)}
+)
+
+// SSOLoginHandler sends the user to the identity provider to sign in a
+// device called name. Once they have, the callback returns the session
+// the way login does, or hands it to return_to: a loopback url for
+// clients listening locally, or a path on this server for the web pages.
+func SSOLoginHandler(w http.ResponseWriter, req *http.Request) {
+	if SSO == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Single sign-on isn't set up."))
+		return
+	}
+	returnTo := req.FormValue("return_to")
+	if returnTo != "" && !validReturnTo(returnTo) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("return_to must be a loopback url or a path."))
+		return
+	}
+	login := ssoLogin{
+		name:     req.FormValue("name"),
+		returnTo: returnTo,
+		expires:  time.Now().Add(ssoLoginLifetime),
+	}
+	state, err := oidc.NewRandom()
+	if err == nil {
+		login.nonce, err = oidc.NewRandom()
+	}
+	if err == nil {
+		login.verifier, err = oidc.NewRandom()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	ssoLogins.put(state, login)
+
+	// ties the callback to this browser, so nobody can be signed in to an
+	// account that isn't theirs by following someone else's link
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    state,
+		Path:     "/sso/",
+		MaxAge:   int(ssoLoginLifetime / time.Second),
+		HttpOnly: true,
+	})
+	http.Redirect(w, req, SSO.AuthCodeURL(state, login.nonce, login.verifier),
+		http.StatusFound)
+}
+
+// SSOCallbackHandler is where the identity provider sends the user back
+// to. It creates or links the user with the email in their ID token, and
+// starts a session for their device, once users with two-factor
+// authentication have given a code.
+func SSOCallbackHandler(w http.ResponseWriter, req *http.Request) {
+	if SSO == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	state := req.FormValue("state")
+	cookie, err := req.Cookie(ssoCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This sign in wasn't started from this browser."))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoCookie, Path: "/sso/", MaxAge: -1})
+	ssoLogins.Lock()
+	login, ok := ssoLogins.m[state]
+	delete(ssoLogins.m, state)
+	ssoLogins.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This sign in has expired, start again."))
+		return
+	}
+	if message := req.FormValue("error"); message != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("The identity provider refused: " + message))
+		return
+	}
+
+	claims, err := SSO.Exchange(req.FormValue("code"), login.verifier, login.nonce)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	user, err := ssoUser(claims)
+	if err == errSSOEmail {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err == errSSOUnverified {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if user.TOTPEnabled {
+		// the provider vouches for the email, not for this server's second
+		// factor
+		ticket, err := oidc.NewRandom()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		login.userId = user.Id
+		login.expires = time.Now().Add(ssoLoginLifetime)
+		ssoSecondFactors.put(ticket, login)
+		http.SetCookie(w, &http.Cookie{
+			Name:     ssoSecondFactorCookie,
+			Value:    ticket,
+			Path:     "/sso/",
+			MaxAge:   int(ssoLoginLifetime / time.Second),
+			HttpOnly: true,
+		})
+		http.Redirect(w, req, "/sso/second-factor/", http.StatusFound)
+		return
+	}
+	finishSSO(w, req, user, login)
+}
+
+// SSOSecondFactorHandler asks users with two-factor authentication for a
+// code from their authenticator app or a recovery code, after the
+// identity provider has signed them in, then finishes the sign in the way
+// the callback would have.
+func SSOSecondFactorHandler(w http.ResponseWriter, req *http.Request) {
+	var ticket string
+	if cookie, err := req.Cookie(ssoSecondFactorCookie); err == nil {
+		ticket = cookie.Value
+	}
+	ssoSecondFactors.Lock()
+	login, ok := ssoSecondFactors.m[ticket]
+	ssoSecondFactors.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This sign in has expired, start again."))
+		return
+	}
+	if req.Method == "GET" {
+		RenderTemplate(w, "sso", nil)
+		return
+	}
+
+	var user structs.User
+	err := model.DB.First(&user, login.userId).Error
+	if err == nil {
+		ok, err = boxtools.ValidateSecondFactor(&user, req.FormValue("code"))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ssoSecondFactors.Lock()
+	current, waiting := ssoSecondFactors.m[ticket]
+	if ok || !waiting || current.attempts+1 >= ssoSecondFactorAttempts {
+		delete(ssoSecondFactors.m, ticket)
+	} else {
+		current.attempts++
+		ssoSecondFactors.m[ticket] = current
+	}
+	ssoSecondFactors.Unlock()
+	// a code is only good for one sign in, even when they race
+	if !ok || !waiting {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Wrong code."))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoSecondFactorCookie, Path: "/sso/", MaxAge: -1})
+	finishSSO(w, req, user, login)
+}
+
+// finishSSO starts a session for user's device and hands it back the way
+// login asked for.
+func finishSSO(w http.ResponseWriter, req *http.Request, user structs.User,
+	login ssoLogin) {
+	session, err := newSession(user, login.name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if login.returnTo == "" {
+		writeJSON(w, session)
+		return
+	}
+	http.Redirect(w, req, returnURL(login.returnTo, session), http.StatusFound)
+}
+
+// ssoUser returns the user claims are for, linking the user with the same
+// email the first time they sign in, or creating one. Only users who have
+// verified their email are linked: otherwise whoever signed up with it
+// first, maybe not its owner, would keep their password on the account.
+func ssoUser(claims oidc.Claims) (user structs.User, err error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return user, errSSOEmail
+	}
+	subject := SSO.Issuer + " " + claims.Subject
+	query := model.DB.Where("oidc_subject = ?", subject).First(&user)
+	if query.Error == nil && user.Id != 0 {
+		return
+	}
+	email := normalizeEmail(claims.Email)
+	user = structs.User{}
+	model.DB.Where("email = ?", email).First(&user)
+	if user.Id == 0 {
+		user, err = boxtools.NewUserWithoutPassword(email)
+		if err != nil {
+			return
+		}
+		user.EmailVerifiedAt = time.Now()
+	} else if user.OIDCSubject != "" {
+		// the provider reassigned the email to someone else
+		return user, errors.New("This email is linked to another identity.")
+	} else if user.EmailVerifiedAt.IsZero() {
+		return user, errSSOUnverified
+	}
+	user.OIDCSubject = subject
+	err = model.DB.Exec(
+		"UPDATE users SET oidc_subject = ?, email_verified_at = ? WHERE id = ?",
+		user.OIDCSubject, user.EmailVerifiedAt, user.Id).Error
+	return
+}
+
+// validReturnTo allows http urls on the loopback interface, for clients
+// listening for the session locally, and paths on this server.
+func validReturnTo(returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(returnTo, "//")
+	}
+	if u.Scheme != "http" {
+		return false
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// returnURL adds session to returnTo, in the query for loopback urls and
+// in the fragment for paths, so it doesn't end up in this server's logs.
+func returnURL(returnTo string, session structs.Session) string {
+	b, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(b)
+	u, _ := url.Parse(returnTo)
+	if u.Host == "" {
+		u.Fragment = "session=" + encoded
+		return u.String()
+	}
+	values := u.Query()
+	values.Set("session", encoded)
+	u.RawQuery = values.Encode()
+	return u.String()
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/server/totp"
+	"github.com/golangbox/gobox/structs"
+)
+
+// totpIssuer is the name authenticator apps show codes under.
+const totpIssuer = "GoBox"
+
+// EnrollTOTPHandler gives the user a new secret for their authenticator
+// app. It isn't asked for at login until ConfirmTOTPHandler has seen a
+// code from it.
+func EnrollTOTPHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var user structs.User
+	err := model.DB.Model(&client).Related(&user).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Two-factor authentication is already on."))
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err == nil {
+		err = model.DB.Exec("UPDATE users SET totp_secret = ? WHERE id = ?",
+			secret, user.Id).Error
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, structs.TOTPEnrollment{
+		Secret: secret,
+		URL:    totp.URL(secret, totpIssuer, user.Email),
+	})
+}
+
+// ConfirmTOTPHandler turns two-factor authentication on once the user
+// shows they can generate codes, and returns their recovery codes.
+func ConfirmTOTPHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var user structs.User
+	err := model.DB.Model(&client).Related(&user).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Two-factor authentication is already on."))
+		return
+	}
+	if user.TOTPSecret == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Enroll an authenticator app first."))
+		return
+	}
+	step, ok := totp.Verify(user.TOTPSecret, req.FormValue("code"), time.Now(), 0)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Wrong code."))
+		return
+	}
+	err = model.DB.Exec(
+		"UPDATE users SET totp_enabled = ?, totp_last_step = ? WHERE id = ?",
+		true, step, user.Id).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeRecoveryCodes(w, &user)
+}
+
+// RecoveryCodesHandler replaces the user's recovery codes, for when
+// they've used or lost them.
+func RecoveryCodesHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	user, ok := secondFactorUser(w, req, client)
+	if !ok {
+		return
+	}
+	writeRecoveryCodes(w, &user)
+}
+
+// DisableTOTPHandler turns two-factor authentication off. It takes a code
+// like logging in does, so a stolen session key isn't enough.
+func DisableTOTPHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	user, ok := secondFactorUser(w, req, client)
+	if !ok {
+		return
+	}
+	err := model.DB.Exec(
+		"UPDATE users SET totp_enabled = ?, totp_secret = '', totp_last_step = 0, hashed_recovery_codes = '' WHERE id = ?",
+		false, user.Id).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// secondFactorUser loads client's user and checks the code in the request
+// against their second factor, writing the error if it doesn't pass.
+func secondFactorUser(w http.ResponseWriter, req *http.Request,
+	client structs.Client) (user structs.User, ok bool) {
+	err := model.DB.Model(&client).Related(&user).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !user.TOTPEnabled {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Two-factor authentication is off."))
+		return
+	}
+	ok, err = boxtools.ValidateSecondFactor(&user, req.FormValue("code"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return user, false
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Wrong code."))
+	}
+	return
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, user *structs.User) {
+	codes, err := boxtools.NewRecoveryCodes(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, codes)
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+// TrashHandler lists the files deleted from the user's tree and their
+// shared folders, newest first. device and since narrow it down to what
+// one device deleted after a time.
+func TrashHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	user := structs.User{Id: client.UserId}
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	trashed, err := trashedFiles(req, user, memberships)
+	if err == errBadTrashFilter {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	items := []structs.TrashItem{}
+	for _, value := range trashed {
+		var file structs.File
+		model.DB.First(&file, value.FileId)
+		var device structs.Client
+		model.DB.First(&device, value.ClientId)
+		items = append(items, structs.TrashItem{
+			Id:        value.Id,
+			Path:      trashPath(value, memberships),
+			Hash:      file.Hash,
+			Size:      file.Size,
+			TrashedAt: value.TrashedAt,
+			DeviceId:  device.Id,
+			Device:    device.Name,
+		})
+	}
+	writeJSON(w, items)
+}
+
+// RestoreTrashHandler puts files back where they were deleted from: the
+// ones with the given ids, or with device, everything that device deleted
+// since a time. Only the newest deletion of each path is restored, and
+// paths that have a file at them again are left alone.
+func RestoreTrashHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	req.ParseForm()
+	if len(req.Form["id"]) == 0 && req.FormValue("device") == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Give the ids to restore, or a device."))
+		return
+	}
+	var user structs.User
+	err := model.DB.First(&user, client.UserId).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// viewers can see what was deleted from a shared folder, but not put
+	// it back
+	var writable []structs.NamespaceMember
+	for _, value := range memberships {
+		if boxtools.CanWrite(value.Role) {
+			writable = append(writable, value)
+		}
+	}
+	trashed, err := trashedFiles(req, user, writable)
+	if err == errBadTrashFilter {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	result := structs.TrashRestore{
+		Restored:  []string{},
+		Conflicts: []string{},
+		Gone:      []string{},
+	}
+	seen := make(map[string]bool)
+	for _, value := range trashed {
+		mounted := trashPath(value, memberships)
+		if seen[mounted] {
+			continue
+		}
+		seen[mounted] = true
+
+		var count int
+		query := model.DB.Model(structs.FileSystemFile{}).
+			Where("namespace_id = ? AND path = ?", value.NamespaceId, value.Path)
+		if value.NamespaceId == 0 {
+			query = query.Where("user_id = ?", user.Id)
+		}
+		err = query.Count(&count).Error
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if count != 0 {
+			result.Conflicts = append(result.Conflicts, mounted)
+			continue
+		}
+		_, err = restoreFile(user, value.FileId, value.NamespaceId)
+		if err == errContentsGone {
+			result.Gone = append(result.Gone, mounted)
+			continue
+		}
+		if err == nil {
+			err = model.DB.Exec("DELETE FROM trashed_files WHERE id = ?", value.Id).Error
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		result.Restored = append(result.Restored, mounted)
+	}
+	writeJSON(w, result)
+}
+
+var errBadTrashFilter = errors.New("id and device must be numbers, and since a time like 2015-02-09T14:39:22Z.")
+
+// trashedFiles returns what's in the trash of user and of the namespaces
+// in memberships, newest first, narrowed down by the id, device and since
+// values of req.
+func trashedFiles(req *http.Request, user structs.User,
+	memberships []structs.NamespaceMember) (trashed []structs.TrashedFile,
+	err error) {
+	var namespaceIds []int64
+	for _, value := range memberships {
+		namespaceIds = append(namespaceIds, value.NamespaceId)
+	}
+	query := model.DB.Where("user_id = ? AND namespace_id = 0", user.Id)
+	if len(namespaceIds) != 0 {
+		query = model.DB.Where("(user_id = ? AND namespace_id = 0) OR namespace_id IN (?)",
+			user.Id, namespaceIds)
+	}
+
+	req.ParseForm()
+	if len(req.Form["id"]) != 0 {
+		var ids []int64
+		for _, value := range req.Form["id"] {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errBadTrashFilter
+			}
+			ids = append(ids, id)
+		}
+		query = query.Where("id IN (?)", ids)
+	}
+	if device := req.FormValue("device"); device != "" {
+		id, err := strconv.ParseInt(device, 10, 64)
+		if err != nil {
+			return nil, errBadTrashFilter
+		}
+		query = query.Where("client_id = ?", id)
+	}
+	if since := req.FormValue("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, errBadTrashFilter
+		}
+		query = query.Where("trashed_at >= ?", t)
+	}
+	query = query.Order("trashed_at desc").Order("id desc").Find(&trashed)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	return trashed, nil
+}
+
+// trashPath is where trashed was in the tree of the member of its
+// namespace in memberships, or in its owner's tree.
+func trashPath(trashed structs.TrashedFile,
+	memberships []structs.NamespaceMember) string {
+	for _, value := range memberships {
+		if value.NamespaceId == trashed.NamespaceId && trashed.NamespaceId != 0 {
+			return boxtools.MountedPath(value, trashed.Path)
+		}
+	}
+	return trashed.Path
+}
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// UploadDirectory is where the parts of unfinished uploads are kept, one
+// directory per session.
+var UploadDirectory = filepath.Join(os.TempDir(), "gobox-uploads")
+
+// MaxUploadSize is the largest blob an upload session takes. Clients
+// upload blocks, which are at most 4MB, a little more when encrypted.
+var MaxUploadSize int64 = 8 * 1024 * 1024
+
+const uploadPartSize = 1024 * 1024
+
+// StartUploadSessionHandler starts, or picks back up, an upload of the
+// blob with the given fileHash and fileSize. The response says which parts
+// the server already has, so a client only sends what's missing.
+func StartUploadSessionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	fileHash := req.FormValue("fileHash")
+	fileSize, err := strconv.ParseInt(req.FormValue("fileSize"), 10, 64)
+	if fileHash == "" || err != nil || fileSize < 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Need fileHash and fileSize."))
+		return
+	}
+	if fileSize > MaxUploadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("fileSize is larger than " +
+			strconv.FormatInt(MaxUploadSize, 10) + " bytes."))
+		return
+	}
+
+	exists, err := blobindex.Exists(fileHash)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if exists {
+		writeUploadSessionStatus(w, structs.UploadSessionStatus{
+			Hash:     fileHash,
+			Size:     fileSize,
+			Complete: true,
+		})
+		return
+	}
+
+	// a client that lost its connection, or restarted, resumes the
+	// session it already had for this blob
+	var session structs.UploadSession
+	query := model.DB.Where(&structs.UploadSession{
+		UserId: client.UserId,
+		Hash:   fileHash,
+		Size:   fileSize,
+	}).First(&session)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(query.Error.Error()))
+		return
+	}
+	if session.Id == 0 {
+		session = structs.UploadSession{
+			UserId:   client.UserId,
+			ClientId: client.Id,
+			Hash:     fileHash,
+			Size:     fileSize,
+			PartSize: uploadPartSize,
+		}
+		err = model.DB.Create(&session).Error
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	status, err := uploadSessionStatus(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeUploadSessionStatus(w, status)
+}
+
+// UploadSessionStatusHandler reports which parts of a session have been
+// received.
+func UploadSessionStatusHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	session, ok := findUploadSession(w, req, client)
+	if !ok {
+		return
+	}
+	status, err := uploadSessionStatus(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeUploadSessionStatus(w, status)
+}
+
+// UploadPartHandler stores one numbered part of a session. Part n holds
+// the bytes starting at n * PartSize, and every part but the last is
+// exactly PartSize long. Sending a part again replaces it.
+func UploadPartHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	session, ok := findUploadSession(w, req, client)
+	if !ok {
+		return
+	}
+	part, err := strconv.ParseInt(mux.Vars(req)["part"], 10, 64)
+	if err != nil || part < 0 || part >= uploadPartCount(session) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Invalid part number."))
+		return
+	}
+
+	err = writeUploadPart(session, part, req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	model.DB.Save(&session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// CommitUploadSessionHandler joins a session's parts, and stores them
+// under the session's hash if they hash to it. The session is finished
+// either way once every part has been received.
+func CommitUploadSessionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	session, ok := findUploadSession(w, req, client)
+	if !ok {
+		return
+	}
+	status, err := uploadSessionStatus(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if int64(len(status.ReceivedParts)) != uploadPartCount(session) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Not every part has been uploaded."))
+		return
+	}
+
+	var parts []io.Reader
+	for part := int64(0); part < uploadPartCount(session); part++ {
+		f, err := os.Open(uploadPartPath(session, part))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer f.Close()
+		parts = append(parts, f)
+	}
+	err = blobstore.PutVerifiedAs(Store, session.UserId, session.Hash,
+		io.MultiReader(parts...), session.Size)
+	if err == blobstore.ErrHashMismatch {
+		// the parts are no good, the client has to start over
+		deleteUploadSession(session)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	err = blobindex.Record(Store, session.Hash, session.Size)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	deleteUploadSession(session)
+	status.Complete = true
+	writeUploadSessionStatus(w, status)
+}
+
+// ExpireUploadSessions throws away sessions that haven't received a part
+// in maxAge.
+func ExpireUploadSessions(maxAge time.Duration) (err error) {
+	var sessions []structs.UploadSession
+	query := model.DB.
+		Where("updated_at < ?", time.Now().Add(-maxAge)).
+		Find(&sessions)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	for _, session := range sessions {
+		err = deleteUploadSession(session)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func findUploadSession(w http.ResponseWriter, req *http.Request,
+	client structs.Client) (session structs.UploadSession, ok bool) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := model.DB.First(&session, id)
+	if query.Error != nil || session.UserId != client.UserId {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	return session, true
+}
+
+func uploadPartCount(session structs.UploadSession) int64 {
+	if session.Size == 0 {
+		return 1
+	}
+	return (session.Size + session.PartSize - 1) / session.PartSize
+}
+
+func uploadPartLength(session structs.UploadSession, part int64) int64 {
+	remaining := session.Size - part*session.PartSize
+	if remaining < session.PartSize {
+		return remaining
+	}
+	return session.PartSize
+}
+
+func uploadSessionDirectory(session structs.UploadSession) string {
+	return filepath.Join(UploadDirectory, strconv.FormatInt(session.Id, 10))
+}
+
+func uploadPartPath(session structs.UploadSession, part int64) string {
+	return filepath.Join(
+		uploadSessionDirectory(session),
+		strconv.FormatInt(part, 10),
+	)
+}
+
+// writeUploadPart writes a part to a temporary file first, so a part that
+// was cut off half way is never mistaken for a received one.
+func writeUploadPart(session structs.UploadSession, part int64,
+	body io.Reader) (err error) {
+	err = os.MkdirAll(uploadSessionDirectory(session), 0755)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(uploadSessionDirectory(session), "tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	length := uploadPartLength(session, part)
+	written, err := io.Copy(tmp, io.LimitReader(body, length+1))
+	closeErr := tmp.Close()
+	if err != nil {
+		return
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if written != length {
+		return fmt.Errorf("Part %d should be %d bytes, got %d", part, length, written)
+	}
+	return os.Rename(tmp.Name(), uploadPartPath(session, part))
+}
+
+// uploadSessionStatus lists the session's directory rather than looking
+// for every part, so it costs the same however big the session says the
+// blob is.
+func uploadSessionStatus(session structs.UploadSession) (
+	status structs.UploadSessionStatus, err error) {
+	status = structs.UploadSessionStatus{
+		Id:            session.Id,
+		Hash:          session.Hash,
+		Size:          session.Size,
+		PartSize:      session.PartSize,
+		ReceivedParts: []int64{},
+	}
+	infos, err := ioutil.ReadDir(uploadSessionDirectory(session))
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		// tmp files and anything else that isn't a part don't parse
+		part, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil || part < 0 || part >= uploadPartCount(session) {
+			continue
+		}
+		if fi.Size() == uploadPartLength(session, part) {
+			status.ReceivedParts = append(status.ReceivedParts, part)
+		}
+	}
+	sort.Sort(byPart(status.ReceivedParts))
+	return status, nil
+}
+
+type byPart []int64
+
+func (p byPart) Len() int           { return len(p) }
+func (p byPart) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPart) Less(i, j int) bool { return p[i] < p[j] }
+
+func deleteUploadSession(session structs.UploadSession) (err error) {
+	err = os.RemoveAll(uploadSessionDirectory(session))
+	if err != nil {
+		return
+	}
+	return model.DB.Delete(&session).Error
+}
+
+func writeUploadSessionStatus(w http.ResponseWriter,
+	status structs.UploadSessionStatus) {
+	jsonBytes, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
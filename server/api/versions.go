@@ -0,0 +1,259 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+)
+
+var errContentsGone = errors.New("This version's contents are no longer kept.")
+
+// VersionsHandler lists the changes made to the file at path in the
+// user's tree, newest first.
+func VersionsHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	filePath := req.FormValue("path")
+	if filePath == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("A path is required."))
+		return
+	}
+	user := structs.User{Id: client.UserId}
+	memberships, err := boxtools.Memberships(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	member, relative := boxtools.ResolvePath(memberships, filePath)
+
+	var fileActions []structs.FileAction
+	var current structs.FileSystemFile
+	if member != nil {
+		err = model.DB.Where("namespace_id = ?", member.NamespaceId).
+			Where("file_id IN (SELECT id FROM files WHERE namespace_id = ? AND path = ?)",
+				member.NamespaceId, relative).
+			Order("id desc").
+			Find(&fileActions).Error
+		if err == nil {
+			model.DB.Where("namespace_id = ? AND path = ?", member.NamespaceId, relative).
+				First(&current)
+		}
+	} else {
+		err = model.DB.Where("namespace_id = 0").
+			Where("client_id IN (SELECT id FROM clients WHERE user_id = ?)", user.Id).
+			Where("file_id IN (SELECT id FROM files WHERE user_id = ? AND namespace_id = 0 AND path = ?)",
+				user.Id, filePath).
+			Order("id desc").
+			Find(&fileActions).Error
+		if err == nil {
+			model.DB.Where("user_id = ? AND namespace_id = 0 AND path = ?", user.Id, filePath).
+				First(&current)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	versions := []structs.FileVersion{}
+	for i, value := range fileActions {
+		version, err := fileVersion(value)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		version.Current = i == 0 && value.IsCreate && value.FileId == current.FileId
+		versions = append(versions, version)
+	}
+	writeJSON(w, versions)
+}
+
+// RestoreVersionHandler makes the version created by the file action with
+// id the file's current one again. The restore is a new create in the
+// journal, so every device gets it the next time it syncs.
+func RestoreVersionHandler(w http.ResponseWriter, req *http.Request,
+	client structs.Client) {
+	var fileAction structs.FileAction
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+	if err == nil {
+		err = model.DB.First(&fileAction, id).Error
+	}
+	if err != nil || fileAction.Id == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	user := structs.User{Id: client.UserId}
+	if fileAction.NamespaceId != 0 {
+		var member structs.NamespaceMember
+		model.DB.Where("namespace_id = ? AND user_id = ?", fileAction.NamespaceId, user.Id).
+			First(&member)
+		if member.Id == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !boxtools.CanWrite(member.Role) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Viewers can't restore files."))
+			return
+		}
+	} else {
+		var author structs.Client
+		model.DB.First(&author, fileAction.ClientId)
+		if author.UserId != user.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	if !fileAction.IsCreate {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Only versions that were created can be restored."))
+		return
+	}
+
+	err = model.DB.First(&user, user.Id).Error
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	restored, err := restoreFile(user, fileAction.FileId, fileAction.NamespaceId)
+	if err == errContentsGone {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	version, err := fileVersion(restored)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	version.Current = true
+	writeJSON(w, version)
+}
+
+// restoreFile writes a create of the file with fileId, in the user's tree
+// or in the namespace with namespaceId, as the user's server client, and
+// applies it.
+func restoreFile(user structs.User, fileId int64, namespaceId int64) (
+	restored structs.FileAction, err error) {
+	var file structs.File
+	err = model.DB.First(&file, fileId).Error
+	if err != nil {
+		return
+	}
+	err = boxtools.LoadFileBlocks(&file)
+	if err != nil {
+		return
+	}
+
+	// devices compare this with what they have, as for any other change
+	var current structs.FileSystemFile
+	query := model.DB.Where("namespace_id = ? AND path = ?", namespaceId, file.Path)
+	if namespaceId == 0 {
+		query = query.Where("user_id = ?", user.Id)
+	}
+	query.First(&current)
+	var previousHash string
+	if current.FileId != 0 {
+		var previous structs.File
+		model.DB.First(&previous, current.FileId)
+		previousHash = previous.Hash
+	}
+
+	fileAction, err := restoreAction(file, file.Path, namespaceId, previousHash)
+	if err != nil {
+		return
+	}
+	fileActions, err := writeAsServer(user, []structs.FileAction{fileAction})
+	if err != nil {
+		return
+	}
+	return fileActions[0], nil
+}
+
+// restoreAction is a create of file, with its blocks loaded, at filePath
+// in the namespace with namespaceId or in the user's tree. It returns
+// errContentsGone if any of the file's blobs have been collected.
+func restoreAction(file structs.File, filePath string, namespaceId int64,
+	previousHash string) (fileAction structs.FileAction, err error) {
+	var hashes []string
+	for _, block := range boxtools.FileBlocks(file) {
+		hashes = append(hashes, block.Hash)
+	}
+	missing, err := blobindex.Missing(hashes)
+	if err != nil {
+		return
+	}
+	if len(missing) != 0 {
+		return fileAction, errContentsGone
+	}
+	// the file is found again if it's in the same place, otherwise it's
+	// copied there
+	file.Id = 0
+	file.Path = filePath
+	return structs.FileAction{
+		IsCreate:     true,
+		NamespaceId:  namespaceId,
+		PreviousHash: previousHash,
+		File:         file,
+	}, nil
+}
+
+// writeAsServer writes fileActions as user's server client and applies
+// them, so every one of the user's devices gets them when it syncs.
+func writeAsServer(user structs.User, fileActions []structs.FileAction) (
+	written []structs.FileAction, err error) {
+	server, err := boxtools.ServerClient(user)
+	if err != nil {
+		return
+	}
+	written, err = boxtools.WriteFileActionsToDatabase(fileActions, server)
+	if err != nil {
+		return
+	}
+	errs := boxtools.ApplyFileActionsToFileSystemFileTable(written, user)
+	if len(errs) != 0 {
+		return written, errs[0]
+	}
+	Pusher.Notify(server.SessionKey)
+	return written, nil
+}
+
+// fileVersion is how fileAction is shown in the history of its file.
+func fileVersion(fileAction structs.FileAction) (version structs.FileVersion,
+	err error) {
+	var file structs.File
+	err = model.DB.First(&file, fileAction.FileId).Error
+	if err != nil {
+		return
+	}
+	var device structs.Client
+	model.DB.First(&device, fileAction.ClientId)
+	var owner structs.User
+	model.DB.First(&owner, device.UserId)
+	return structs.FileVersion{
+		FileActionId: fileAction.Id,
+		IsCreate:     fileAction.IsCreate,
+		Hash:         file.Hash,
+		Size:         file.Size,
+		Modified:     file.Modified,
+		CreatedAt:    fileAction.CreatedAt,
+		DeviceId:     device.Id,
+		Device:       device.Name,
+		Email:        owner.Email,
+	}, nil
+}
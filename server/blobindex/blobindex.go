@@ -0,0 +1,204 @@
+// Package blobindex keeps the blobs table, the server's record of which
+// blobs it holds. Asking the backing store whether a blob exists is a
+// request per hash, and with S3 a paid one, so the api server checks the
+// index instead and the index is kept in line with the store by recording
+// every blob as an upload commits. Reconcile repairs any drift.
+package blobindex
+
+import (
+	"time"
+
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+// Record notes that store now holds hash. Recording a blob that is already
+// indexed updates its size, backend and tier.
+func Record(store blobstore.BlobStore, hash string, size int64) (err error) {
+	refCount, err := countRefs(hash)
+	if err != nil {
+		return
+	}
+	codec, storedSize, err := blobstore.Encoding(store, hash, size)
+	if err != nil {
+		return
+	}
+	tier, err := blobstore.Tier(store, hash)
+	if err != nil {
+		return
+	}
+	var blob structs.Blob
+	query := model.DB.Where("hash = ?", hash).First(&blob)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	blob.Hash = hash
+	blob.Size = size
+	blob.StoredAt = time.Now()
+	blob.RefCount = refCount
+	blob.Backend = blobstore.Name(store)
+	blob.Codec = codec
+	blob.StoredSize = storedSize
+	blob.Damage = ""
+	blob.Tier = tier
+	blob.AccessedAt = blob.StoredAt
+	query = model.DB.Save(&blob)
+	if query.Error != nil && blob.Id == 0 {
+		// recorded by a concurrent upload of the same contents
+		return model.DB.Where("hash = ?", hash).First(&blob).Error
+	}
+	return query.Error
+}
+
+// Exists reports whether hash is in the index and undamaged.
+func Exists(hash string) (bool, error) {
+	var count int
+	query := model.DB.Model(structs.Blob{}).
+		Where("hash = ?", hash).
+		Where("damage = ?", "").
+		Count(&count)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return count > 0, nil
+}
+
+// Missing returns the hashes that aren't in the index, or are damaged, in
+// one query.
+func Missing(hashes []string) (missing []string, err error) {
+	if len(hashes) == 0 {
+		return
+	}
+	var found []string
+	query := model.DB.Model(structs.Blob{}).
+		Where("hash in (?)", hashes).
+		Where("damage = ?", "").
+		Pluck("hash", &found)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	indexed := make(map[string]bool)
+	for _, hash := range found {
+		indexed[hash] = true
+	}
+	for _, hash := range hashes {
+		if !indexed[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	return
+}
+
+// Remove drops hash from the index, once the blob has been deleted.
+func Remove(hash string) error {
+	return model.DB.Where("hash = ?", hash).Delete(structs.Blob{}).Error
+}
+
+// Collecting is what a blob is flagged with while the garbage collector
+// deletes it. Like any damaged blob it's reported missing meanwhile, so a
+// client that needs it after all is asked to upload it again.
+const Collecting = "being collected"
+
+// StartCollecting flags hash as being collected.
+func StartCollecting(hash string) error {
+	return model.DB.Exec("UPDATE blobs SET damage = ? WHERE hash = ?",
+		Collecting, hash).Error
+}
+
+// StopCollecting clears the flag for a blob that turned out to be needed.
+// An upload may have cleared it already.
+func StopCollecting(hash string) error {
+	return model.DB.Exec("UPDATE blobs SET damage = ? WHERE hash = ? AND damage = ?",
+		"", hash, Collecting).Error
+}
+
+// FinishCollecting drops hash from the index once its blob is deleted. If
+// an upload recorded it again meanwhile, the delete may have taken the
+// new contents with it, so the blob is flagged as damaged instead, which
+// has clients that still have it upload it again.
+func FinishCollecting(hash string) error {
+	query := model.DB.Where("hash = ? AND damage = ?", hash, Collecting).
+		Delete(structs.Blob{})
+	if query.Error != nil || query.RowsAffected != 0 {
+		return query.Error
+	}
+	return model.DB.Exec("UPDATE blobs SET damage = ? WHERE hash = ?",
+		"deleted by garbage collection while it was uploaded", hash).Error
+}
+
+// Flag records the outcome of checking blob, damage is empty if the blob
+// was fine.
+func Flag(blob structs.Blob, damage string) error {
+	blob.ScrubbedAt = time.Now()
+	blob.Damage = damage
+	return model.DB.Save(&blob).Error
+}
+
+// Damaged returns every blob flagged as damaged.
+func Damaged() (blobs []structs.Blob, err error) {
+	query := model.DB.Where("damage <> ?", "").Order("hash").Find(&blobs)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	return blobs, nil
+}
+
+// ReuploadRequests finds blocks of files in user's tree whose blobs are
+// damaged. Any of the user's clients may still have a good copy.
+func ReuploadRequests(user structs.User, limit int) (
+	requests []structs.ReuploadRequest, err error) {
+	query := model.DB.Table("blocks").
+		Select("file_system_files.path, blocks.hash, blocks.offset, blocks.size").
+		Joins("join blobs on blobs.hash = blocks.hash").
+		Joins("join file_system_files on file_system_files.file_id = blocks.file_id").
+		Where("file_system_files.user_id = ?", user.Id).
+		Where("blobs.damage <> ?", "").
+		Limit(limit).
+		Scan(&requests)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	return requests, nil
+}
+
+// AddRef counts one more file block pointing at hash. Blocks are usually
+// written before their blob is uploaded, in which case Record counts them.
+func AddRef(hash string) error {
+	return AddRefIn(&model.DB, hash)
+}
+
+// AddRefIn is AddRef as part of the transaction db.
+func AddRefIn(db *gorm.DB, hash string) error {
+	return db.Exec(
+		"UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = ?", hash,
+	).Error
+}
+
+// accessResolution is how stale a blob's AccessedAt may get, so a blob
+// that's read a lot isn't written on every read.
+const accessResolution = time.Hour
+
+// Tracker keeps the index up to date with what a blobstore.TieredStore
+// does.
+type Tracker struct{}
+
+func (Tracker) Accessed(hash string) error {
+	now := time.Now()
+	return model.DB.Exec(
+		"UPDATE blobs SET accessed_at = ? WHERE hash = ? AND accessed_at < ?",
+		now, hash, now.Add(-accessResolution),
+	).Error
+}
+
+func (Tracker) Moved(hash string, tier string) error {
+	return model.DB.Exec(
+		"UPDATE blobs SET tier = ? WHERE hash = ?", tier, hash,
+	).Error
+}
+
+func countRefs(hash string) (count int64, err error) {
+	query := model.DB.Model(structs.Block{}).Where("hash = ?", hash).Count(&count)
+	return count, query.Error
+}
@@ -0,0 +1,151 @@
+package blobindex
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	var err error
+
+	model.DB, err = gorm.Open("postgres", "dbname=goboxtest sslmode=disable")
+
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.AutoMigrate(&structs.Block{}, &structs.Blob{})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func TestRecordAndMissing(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	model.DB.Create(&structs.Block{Hash: "aaaa", Size: 4})
+	model.DB.Create(&structs.Block{Hash: "aaaa", Size: 4})
+
+	err := Record(store, "aaaa", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := Exists("aaaa")
+	if err != nil || !exists {
+		t.Error("Recorded blob should exist")
+	}
+	var blob structs.Blob
+	model.DB.Where("hash = ?", "aaaa").First(&blob)
+	if blob.RefCount != 2 || blob.Backend != "memory" || blob.Size != 4 {
+		t.Errorf("Wrong blob record %+v", blob)
+	}
+
+	err = AddRef("aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.DB.Where("hash = ?", "aaaa").First(&blob)
+	if blob.RefCount != 3 {
+		t.Error("AddRef should increment the reference count")
+	}
+
+	missing, err := Missing([]string{"aaaa", "bbbb", "cccc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 2 || missing[0] != "bbbb" || missing[1] != "cccc" {
+		t.Errorf("Expected bbbb and cccc missing, got %v", missing)
+	}
+
+	err = Remove("aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _ = Exists("aaaa")
+	if exists {
+		t.Error("Removed blob shouldn't exist")
+	}
+}
+
+func TestCollecting(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	Record(store, "dddd", 4)
+	err := StartCollecting("dddd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := Missing([]string{"dddd"}); len(missing) != 1 {
+		t.Error("A blob being collected should be reported missing")
+	}
+	StopCollecting("dddd")
+	if missing, _ := Missing([]string{"dddd"}); len(missing) != 0 {
+		t.Error("A blob that's no longer being collected should be there")
+	}
+
+	StartCollecting("dddd")
+	err = FinishCollecting("dddd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	model.DB.Model(structs.Blob{}).Where("hash = ?", "dddd").Count(&count)
+	if count != 0 {
+		t.Error("A collected blob should leave the index")
+	}
+
+	Record(store, "eeee", 4)
+	StartCollecting("eeee")
+	// uploaded again while it was being deleted
+	Record(store, "eeee", 4)
+	FinishCollecting("eeee")
+	var blob structs.Blob
+	model.DB.Where("hash = ?", "eeee").First(&blob)
+	if blob.Damage == "" {
+		t.Error("A blob uploaded while it was collected should be asked for again")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	store.Put("dddd", strings.NewReader("unindexed"), 9)
+	store.Put("eeee", strings.NewReader("resized"), 7)
+	Record(store, "eeee", 100)
+	Record(store, "ffff", 4)
+
+	report, err := Reconcile(store, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unindexed) != 1 || len(report.Missing) != 1 ||
+		len(report.Resized) != 1 {
+		t.Errorf("Wrong dry run report %+v", report)
+	}
+	exists, _ := Exists("dddd")
+	if exists {
+		t.Error("Dry run shouldn't change the index")
+	}
+
+	_, err = Reconcile(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := Missing([]string{"dddd", "eeee", "ffff"})
+	if len(missing) != 1 || missing[0] != "ffff" {
+		t.Errorf("Index should match the store, missing %v", missing)
+	}
+	var blob structs.Blob
+	model.DB.Where("hash = ?", "eeee").First(&blob)
+	if blob.Size != 7 {
+		t.Error("Reconcile should correct the size")
+	}
+
+	report, _ = Reconcile(store, true)
+	if len(report.Unindexed)+len(report.Missing)+len(report.Resized) != 0 {
+		t.Error("Nothing should be left to reconcile")
+	}
+}
@@ -0,0 +1,145 @@
+package blobindex
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+type Report struct {
+	Stored  int
+	Indexed int
+	// Unindexed are blobs in the store the index didn't know about.
+	Unindexed []string
+	// Missing are indexed blobs the store doesn't have. They are
+	// flagged if some file still refers to them, so clients get asked
+	// to upload them again, and dropped otherwise.
+	Missing []string
+	// Resized are blobs whose indexed size was wrong.
+	Resized []string
+	// Recounted are blobs whose reference count was wrong.
+	Recounted []string
+}
+
+func (r Report) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := fmt.Fprintf(w,
+		"%d blobs stored, %d indexed\n"+
+			"%d unindexed, %d missing from the store\n"+
+			"%d with the wrong size, %d with the wrong reference count\n",
+		r.Stored, r.Indexed,
+		len(r.Unindexed), len(r.Missing),
+		len(r.Resized), len(r.Recounted),
+	)
+	return int64(written), err
+}
+
+// Reconcile compares the index with what store actually holds. Blobs the
+// index is missing are added, index entries without a blob are flagged or
+// dropped, and sizes and reference counts are corrected. With dryRun
+// nothing is changed, the report only says what would be.
+func Reconcile(store blobstore.BlobStore, dryRun bool) (report Report, err error) {
+	objects, err := store.List("")
+	if err != nil {
+		return
+	}
+	report.Stored = len(objects)
+
+	var blobs []structs.Blob
+	query := model.DB.Find(&blobs)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return report, query.Error
+	}
+	report.Indexed = len(blobs)
+	indexed := make(map[string]structs.Blob)
+	for _, blob := range blobs {
+		indexed[blob.Hash] = blob
+	}
+
+	for _, object := range objects {
+		blob, ok := indexed[object.Key]
+		delete(indexed, object.Key)
+		// listed sizes are what's stored, which for a compressed blob
+		// isn't the size of its contents
+		storedSize := blob.StoredSize
+		if storedSize == 0 {
+			storedSize = blob.Size
+		}
+		if !ok {
+			report.Unindexed = append(report.Unindexed, object.Key)
+			if dryRun {
+				continue
+			}
+			object, err = store.Stat(object.Key)
+			if err != nil {
+				return
+			}
+			err = Record(store, object.Key, object.Size)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		changed := false
+		if storedSize != object.Size {
+			report.Resized = append(report.Resized, blob.Hash)
+			if !dryRun {
+				object, err = store.Stat(object.Key)
+				if err != nil {
+					return
+				}
+				blob.Size = object.Size
+				blob.Codec, blob.StoredSize, err = blobstore.Encoding(
+					store, blob.Hash, object.Size)
+				if err != nil {
+					return
+				}
+			}
+			changed = true
+		}
+		var refCount int64
+		refCount, err = countRefs(blob.Hash)
+		if err != nil {
+			return
+		}
+		if blob.RefCount != refCount {
+			report.Recounted = append(report.Recounted, blob.Hash)
+			blob.RefCount = refCount
+			changed = true
+		}
+		if changed && !dryRun {
+			err = model.DB.Save(&blob).Error
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// whatever is left was never found in the store
+	for hash, blob := range indexed {
+		report.Missing = append(report.Missing, hash)
+		if dryRun {
+			continue
+		}
+		var refCount int64
+		refCount, err = countRefs(hash)
+		if err != nil {
+			return
+		}
+		if refCount > 0 {
+			if blob.Damage != structs.BlobMissing {
+				err = Flag(blob, structs.BlobMissing)
+			}
+		} else {
+			err = Remove(hash)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+// Package blobstore defines the storage the server keeps file contents in.
+// Blobs are addressed by the hex encoded sha256 of their contents, so a
+// key is only ever written once and never changes.
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound             = errors.New("blobstore: blob not found")
+	ErrSignedURLUnsupported = errors.New("blobstore: backend can't sign urls")
+)
+
+// Object describes a stored blob as returned by List.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// BlobStore is implemented by every storage backend. The api handlers only
+// ever talk to this interface, so a backend can be swapped without
+// touching them.
+type BlobStore interface {
+	// Exists reports whether a blob is stored under key.
+	Exists(key string) (bool, error)
+	// Put stores the size bytes read from r under key, replacing anything
+	// already there.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens the blob stored under key, or returns ErrNotFound. The
+	// caller must close the returned reader.
+	Get(key string) (io.ReadCloser, error)
+	// GetRange is like Get, but only reads length bytes starting at
+	// offset. A negative length reads to the end of the blob.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes the blob stored under key, or returns ErrNotFound.
+	Stat(key string) (Object, error)
+	// SignedURL returns a url a client can fetch the blob from without
+	// a session key. The url stops working after expires.
+	SignedURL(key string, expires time.Duration) (string, error)
+	// Delete removes the blob under key. Deleting a missing key is not
+	// an error.
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix.
+	List(prefix string) ([]Object, error)
+}
+
+// namedStore is implemented by backends that report a name for the blob
+// index to record.
+type namedStore interface {
+	Name() string
+}
+
+// Name returns the name of store's backend, such as "s3" or "disk".
+func Name(store BlobStore) string {
+	if n, ok := store.(namedStore); ok {
+		return n.Name()
+	}
+	return "unknown"
+}
+
+// ownedStore is implemented by backends that treat blobs differently
+// depending on which user uploaded them.
+type ownedStore interface {
+	PutOwned(owner int64, key string, r io.Reader, size int64) error
+}
+
+// PutOwned is store.Put for a blob uploaded by the user with id owner. Owner
+// 0 is the server itself.
+func PutOwned(store BlobStore, owner int64, key string, r io.Reader,
+	size int64) error {
+	if o, ok := store.(ownedStore); ok {
+		return o.PutOwned(owner, key, r, size)
+	}
+	return store.Put(key, r, size)
+}
+
+// encodedStore is implemented by backends that may store a blob as
+// something other than its contents.
+type encodedStore interface {
+	Encoding(key string) (codec string, storedSize int64, err error)
+}
+
+// Encoding returns the codec the blob under key is stored with, empty if
+// it's stored as is, and the number of bytes it takes up in the store.
+// size is the size of the blob's contents.
+func Encoding(store BlobStore, key string, size int64) (codec string,
+	storedSize int64, err error) {
+	if e, ok := store.(encodedStore); ok {
+		return e.Encoding(key)
+	}
+	return "", size, nil
+}
+
+// limitReadCloser limits a ReadCloser to n bytes, or doesn't limit it at
+// all when n is negative.
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
@@ -0,0 +1,55 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func putString(store BlobStore, key, contents string) error {
+	return store.Put(key, strings.NewReader(contents), int64(len(contents)))
+}
+
+func getString(store BlobStore, key string) (string, error) {
+	r, err := store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	return string(contents), err
+}
+
+func TestPutVerified(t *testing.T) {
+	disk, cleanup := newTestDiskStore(t)
+	defer cleanup()
+
+	for _, store := range []BlobStore{NewMemoryStore(), disk} {
+		contents := "this is a file"
+		err := PutVerified(store, testHash, strings.NewReader(contents),
+			int64(len(contents)))
+		if err != nil {
+			t.Error(err)
+		}
+		stored, err := getString(store, testHash)
+		if err != nil || stored != contents {
+			t.Error("Verified blob wasn't stored")
+		}
+
+		wrongHash := strings.Replace(testHash, "f", "e", 1)
+		err = PutVerified(store, wrongHash, strings.NewReader(contents),
+			int64(len(contents)))
+		if err != ErrHashMismatch {
+			t.Error("Hash mismatch wasn't detected")
+		}
+		err = PutVerified(store, testHash, strings.NewReader(contents),
+			int64(len(contents)-1))
+		if err == nil {
+			t.Error("Size mismatch wasn't detected")
+		}
+		exists, _ := store.Exists(wrongHash)
+		if exists {
+			t.Error("Blob with the wrong hash was committed")
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Codecs a CompressedStore can store a blob with. CodecNone is stored as
+// is, behind a header.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+)
+
+const (
+	// a blob is compressed if a sample of it shrinks to at most
+	// compressThreshold of its size
+	compressSampleSize = 64 * 1024
+	compressThreshold  = 0.9
+	// smaller blobs aren't worth the header
+	compressMinSize = 1024
+)
+
+var ErrUnknownCodec = errors.New("blobstore: blob stored with an unknown codec")
+
+// IsCorrupt reports whether err, from reading a blob, means the stored
+// bytes are damaged rather than that the store couldn't be read.
+func IsCorrupt(err error) bool {
+	switch err.(type) {
+	case flate.CorruptInputError:
+		return true
+	}
+	return err == ErrCorrupt || err == ErrUnknownCodec ||
+		err == gzip.ErrChecksum || err == gzip.ErrHeader ||
+		err == io.ErrUnexpectedEOF
+}
+
+// encodedMagic starts every blob a CompressedStore encodes. It's followed
+// by one codec byte and the big endian size of the original contents.
+var encodedMagic = []byte("\x89GBX\r\n")
+
+const encodedHeaderSize = 6 + 1 + 8
+
+var codecs = []string{CodecNone, CodecGzip}
+
+// CompressedStore compresses blobs on their way into another store and
+// decompresses them on the way out. Whether a blob is compressed is decided
+// by how well its first compressSampleSize bytes compress.
+//
+// Blobs that aren't worth compressing are stored untouched, so blobs
+// written before compression was turned on read back as they are. The
+// only exception is a blob that happens to start with the header magic,
+// which is stored with CodecNone so it can't be mistaken for an encoded
+// one.
+//
+// The stored bytes are not the blob's contents, so signed urls point at
+// the api server, which decodes them, instead of at the inner store.
+type CompressedStore struct {
+	*URLSigner
+	Inner BlobStore
+}
+
+func NewCompressedStore(inner BlobStore, signer *URLSigner) *CompressedStore {
+	return &CompressedStore{URLSigner: signer, Inner: inner}
+}
+
+func (c *CompressedStore) Name() string {
+	return Name(c.Inner)
+}
+
+func (c *CompressedStore) Exists(key string) (bool, error) {
+	return c.Inner.Exists(key)
+}
+
+func (c *CompressedStore) Put(key string, r io.Reader, size int64) error {
+	return c.PutOwned(0, key, r, size)
+}
+
+func (c *CompressedStore) PutOwned(owner int64, key string, r io.Reader,
+	size int64) error {
+	sample := make([]byte, compressSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+
+	codec := chooseCodec(sample, size)
+	if codec == "" {
+		return PutOwned(c.Inner, owner, key, r, size)
+	}
+
+	// the encoded size has to be known up front, so encode to a
+	// temporary file first
+	tmp, err := ioutil.TempFile("", "gobox-encode")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = encode(tmp, r, codec, size)
+	if err != nil {
+		return err
+	}
+	encodedSize, err := tmp.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	return PutOwned(c.Inner, owner, key, tmp, encodedSize)
+}
+
+func (c *CompressedStore) Get(key string) (io.ReadCloser, error) {
+	rc, codec, _, err := c.getEncoded(key)
+	if err != nil {
+		return nil, err
+	}
+	return decode(rc, codec)
+}
+
+func (c *CompressedStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	codec, _, err := c.header(key)
+	if err != nil {
+		return nil, err
+	}
+	switch codec {
+	case "":
+		return c.Inner.GetRange(key, offset, length)
+	case CodecNone:
+		return c.Inner.GetRange(key, encodedHeaderSize+offset, length)
+	}
+	// compressed streams can't be entered part way
+	rc, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, rc, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return limitReadCloser(rc, length), nil
+}
+
+func (c *CompressedStore) Stat(key string) (Object, error) {
+	object, err := c.Inner.Stat(key)
+	if err != nil {
+		return object, err
+	}
+	codec, size, err := c.header(key)
+	if err != nil {
+		return object, err
+	}
+	if codec != "" {
+		object.Size = size
+	}
+	return object, nil
+}
+
+func (c *CompressedStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if c.URLSigner == nil {
+		return "", ErrSignedURLUnsupported
+	}
+	return c.SignURL(key, expires), nil
+}
+
+func (c *CompressedStore) Delete(key string) error {
+	return c.Inner.Delete(key)
+}
+
+// List returns the inner store's objects, so sizes are what is actually
+// stored rather than the size of the contents.
+func (c *CompressedStore) List(prefix string) ([]Object, error) {
+	return c.Inner.List(prefix)
+}
+
+// Encoding returns the codec key is stored with, empty if it is stored
+// untouched, and how many bytes it takes up in the inner store.
+func (c *CompressedStore) Encoding(key string) (codec string, storedSize int64, err error) {
+	object, err := c.Inner.Stat(key)
+	if err != nil {
+		return
+	}
+	_, storedSize, err = Encoding(c.Inner, key, object.Size)
+	if err != nil {
+		return
+	}
+	codec, _, err = c.header(key)
+	return codec, storedSize, err
+}
+
+// GetEncoded opens the stored bytes of key past the header, without
+// decoding them, so they can be passed on to a client that understands
+// codec.
+func (c *CompressedStore) GetEncoded(key string) (rc io.ReadCloser, codec string, err error) {
+	rc, codec, _, err = c.getEncoded(key)
+	return
+}
+
+func (c *CompressedStore) getEncoded(key string) (rc io.ReadCloser, codec string,
+	size int64, err error) {
+	inner, err := c.Inner.Get(key)
+	if err != nil {
+		return
+	}
+	br := bufio.NewReader(inner)
+	rc = struct {
+		io.Reader
+		io.Closer
+	}{br, inner}
+	peeked, _ := br.Peek(encodedHeaderSize)
+	codec, size, err = parseHeader(peeked)
+	if err != nil {
+		inner.Close()
+		return nil, "", 0, err
+	}
+	if codec != "" {
+		br.Discard(encodedHeaderSize)
+	}
+	return
+}
+
+// header reads just the header of key.
+func (c *CompressedStore) header(key string) (codec string, size int64, err error) {
+	rc, err := c.Inner.GetRange(key, 0, encodedHeaderSize)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	peeked, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return
+	}
+	return parseHeader(peeked)
+}
+
+// parseHeader returns an empty codec if b isn't an encoded header.
+func parseHeader(b []byte) (codec string, size int64, err error) {
+	if len(b) < encodedHeaderSize || !bytes.HasPrefix(b, encodedMagic) {
+		return "", 0, nil
+	}
+	index := int(b[len(encodedMagic)])
+	if index >= len(codecs) {
+		return "", 0, ErrUnknownCodec
+	}
+	size = int64(binary.BigEndian.Uint64(b[len(encodedMagic)+1:]))
+	return codecs[index], size, nil
+}
+
+func writeHeader(w io.Writer, codec string, size int64) error {
+	header := make([]byte, encodedHeaderSize)
+	copy(header, encodedMagic)
+	for i, c := range codecs {
+		if c == codec {
+			header[len(encodedMagic)] = byte(i)
+		}
+	}
+	binary.BigEndian.PutUint64(header[len(encodedMagic)+1:], uint64(size))
+	_, err := w.Write(header)
+	return err
+}
+
+// chooseCodec picks how to store a blob of size bytes starting with
+// sample. An empty codec means storing it untouched.
+func chooseCodec(sample []byte, size int64) string {
+	if size >= compressMinSize {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(sample)
+		gz.Close()
+		if float64(compressed.Len()) <= float64(len(sample))*compressThreshold {
+			return CodecGzip
+		}
+	}
+	if bytes.HasPrefix(sample, encodedMagic) {
+		return CodecNone
+	}
+	return ""
+}
+
+func encode(w io.Writer, r io.Reader, codec string, size int64) (err error) {
+	err = writeHeader(w, codec, size)
+	if err != nil {
+		return
+	}
+	r = io.LimitReader(r, size)
+	switch codec {
+	case CodecNone:
+		_, err = io.Copy(w, r)
+		return
+	case CodecGzip:
+		gz := gzip.NewWriter(w)
+		_, err = io.Copy(gz, r)
+		if err != nil {
+			return
+		}
+		return gz.Close()
+	}
+	return ErrUnknownCodec
+}
+
+func decode(rc io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "", CodecNone:
+		return rc, nil
+	case CodecGzip:
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, rc}, nil
+	}
+	rc.Close()
+	return nil, ErrUnknownCodec
+}
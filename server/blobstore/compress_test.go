@@ -0,0 +1,79 @@
+package blobstore
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	store := NewCompressedStore(inner, &URLSigner{
+		BaseURL: "http://gobox.test",
+		Secret:  []byte("secret"),
+	})
+
+	text := strings.Repeat("package main\n\nfunc main() {}\n", 1000)
+	putString(store, "text", text)
+	contents, err := getString(store, "text")
+	if err != nil || contents != text {
+		t.Error("Compressed blob didn't read back the same")
+	}
+	codec, storedSize, _ := store.Encoding("text")
+	if codec != CodecGzip || storedSize >= int64(len(text)) {
+		t.Error("Text should be stored compressed")
+	}
+	object, _ := store.Stat("text")
+	if object.Size != int64(len(text)) {
+		t.Error("Stat should report the size of the contents")
+	}
+	r, err := store.GetRange("text", 14, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(part) != "func main() " {
+		t.Errorf("GetRange of a compressed blob returned %q", part)
+	}
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+	putString(store, "random", string(random))
+	codec, _, _ = store.Encoding("random")
+	if codec != "" {
+		t.Error("Incompressible blob should be stored as is")
+	}
+	stored, _ := getString(inner, "random")
+	if stored != string(random) {
+		t.Error("Incompressible blob should be readable from the inner store")
+	}
+
+	// a blob written before compression was turned on
+	putString(inner, "old", "plain old blob")
+	contents, _ = getString(store, "old")
+	if contents != "plain old blob" {
+		t.Error("Blobs stored uncompressed should read back as they are")
+	}
+
+	// a blob that looks like it has a header
+	lookalike := string(encodedMagic) + "\x01not really compressed"
+	putString(store, "lookalike", lookalike)
+	contents, _ = getString(store, "lookalike")
+	if contents != lookalike {
+		t.Error("Blob starting with the header magic didn't read back")
+	}
+	r, _ = store.GetRange("lookalike", 2, 4)
+	part, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(part) != lookalike[2:6] {
+		t.Error("GetRange of a blob stored with CodecNone is off")
+	}
+
+	url, err := store.SignedURL("text", time.Minute)
+	if err != nil || !strings.HasPrefix(url, "http://gobox.test/blobs/text?") {
+		t.Error("Signed urls should point at the api server")
+	}
+}
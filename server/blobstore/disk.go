@@ -0,0 +1,200 @@
+package blobstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("blobstore: keys must be hex encoded")
+
+const diskTmpDirectory = "tmp"
+
+// DiskStore keeps blobs as plain files under Root, sharded two levels deep
+// by the leading characters of their hash:
+//
+//	Root/ab/cd/abcdef0123...
+//
+// Signed urls point at the api server, which serves the files itself.
+type DiskStore struct {
+	*URLSigner
+	Root string
+}
+
+func NewDiskStore(root string, signer *URLSigner) (*DiskStore, error) {
+	err := os.MkdirAll(filepath.Join(root, diskTmpDirectory), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskStore{URLSigner: signer, Root: root}, nil
+}
+
+func (d *DiskStore) path(key string) (string, error) {
+	if len(key) < 4 {
+		return "", ErrInvalidKey
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(d.Root, key[0:2], key[2:4], key), nil
+}
+
+func (d *DiskStore) Name() string {
+	return "disk"
+}
+
+func (d *DiskStore) Exists(key string) (bool, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Put writes r to a temporary file and renames it into place, so a reader
+// never sees a partially written blob.
+func (d *DiskStore) Put(key string, r io.Reader, size int64) error {
+	return d.put(key, func(w io.Writer) error {
+		written, err := io.Copy(w, io.LimitReader(r, size))
+		if err == nil && written != size {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// PutVerified hashes r while it is written to the temporary file, and only
+// renames it into place when the hash matches.
+func (d *DiskStore) PutVerified(hash string, r io.Reader, size int64) error {
+	return d.put(hash, func(w io.Writer) error {
+		return copyVerified(w, r, hash, size)
+	})
+}
+
+func (d *DiskStore) put(key string, write func(io.Writer) error) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(d.Root, diskTmpDirectory), key)
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *DiskStore) Get(key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *DiskStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.(*os.File).Seek(offset, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return limitReadCloser(f, length), nil
+}
+
+func (d *DiskStore) Stat(key string) (Object, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return Object{}, ErrNotFound
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}, nil
+}
+
+func (d *DiskStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if d.URLSigner == nil {
+		return "", ErrSignedURLUnsupported
+	}
+	return d.SignURL(key, expires), nil
+}
+
+func (d *DiskStore) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DiskStore) List(prefix string) (objects []Object, err error) {
+	err = filepath.Walk(d.Root, func(path string, fi os.FileInfo, errIn error) error {
+		if errIn != nil {
+			return errIn
+		}
+		if fi.IsDir() {
+			if path == filepath.Join(d.Root, diskTmpDirectory) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(fi.Name(), prefix) {
+			return nil
+		}
+		objects = append(objects, Object{
+			Key:          fi.Name(),
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+		})
+		return nil
+	})
+	sort.Sort(byKey(objects))
+	return objects, err
+}
@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHash = "fc45acaffc35a3aa674f7c0d5a03d22350b4f2ff4bf45ccebad077e5af80e512"
+
+func newTestDiskStore(t *testing.T) (*DiskStore, func()) {
+	root, err := ioutil.TempDir("", "gobox-blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &URLSigner{BaseURL: "http://127.0.0.1:8000", Secret: []byte("secret")}
+	store, err := NewDiskStore(root, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(root) }
+}
+
+func TestDiskStore(t *testing.T) {
+	store, cleanup := newTestDiskStore(t)
+	defer cleanup()
+
+	err := putString(store, testHash, "this is a file")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = os.Stat(filepath.Join(store.Root, "fc", "45", testHash))
+	if err != nil {
+		t.Error("Blob wasn't sharded by hash prefix")
+	}
+	exists, err := store.Exists(testHash)
+	if !exists || err != nil {
+		t.Fail()
+	}
+	contents, err := getString(store, testHash)
+	if err != nil || contents != "this is a file" {
+		t.Fail()
+	}
+	objects, err := store.List("")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(objects) != 1 || objects[0].Key != testHash {
+		t.Error("List should only return the stored blob")
+	}
+
+	err = store.Delete(testHash)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = store.Get(testHash)
+	if err != ErrNotFound {
+		t.Error("Get after delete should return ErrNotFound")
+	}
+}
+
+func TestDiskStoreRejectsPaths(t *testing.T) {
+	store, cleanup := newTestDiskStore(t)
+	defer cleanup()
+
+	err := putString(store, "../../etc/passwd", "nope")
+	if err != ErrInvalidKey {
+		t.Error("Non hex keys must be rejected")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	store, cleanup := newTestDiskStore(t)
+	defer cleanup()
+
+	signed, err := store.SignedURL(testHash, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "http://127.0.0.1:8000/blobs/"+testHash+"?") {
+		t.Error("Signed url doesn't point at /blobs/")
+	}
+	parsed, _ := url.Parse(signed)
+	expires := parsed.Query().Get("expires")
+	signature := parsed.Query().Get("signature")
+
+	if err = store.Verify(testHash, expires, signature); err != nil {
+		t.Error(err)
+	}
+	if store.Verify(testHash[1:]+"0", expires, signature) != ErrInvalidSignature {
+		t.Error("Signature must be bound to the key")
+	}
+	if store.Verify(testHash, expires+"0", signature) != ErrInvalidSignature {
+		t.Error("Signature must be bound to the expiry")
+	}
+
+	signed = store.SignURL(testHash, -time.Minute)
+	parsed, _ = url.Parse(signed)
+	err = store.Verify(testHash, parsed.Query().Get("expires"),
+		parsed.Query().Get("signature"))
+	if err != ErrURLExpired {
+		t.Error("Expired url was accepted")
+	}
+}
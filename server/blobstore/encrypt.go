@@ -0,0 +1,361 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// KeyRing hands out the data keys blobs are encrypted with. Data keys are
+// kept wrapped by a master key, so rotating the master key only means
+// wrapping every data key again, not rewriting every blob.
+type KeyRing interface {
+	// DataKey returns the key new blobs uploaded by owner are encrypted
+	// with, and its id.
+	DataKey(owner int64) (id int64, key []byte, err error)
+	// Key returns the data key with id.
+	Key(id int64) ([]byte, error)
+}
+
+var ErrCorrupt = errors.New("blobstore: blob failed authentication")
+
+const (
+	// blobs are encrypted in segments, so a range can be read without
+	// decrypting everything before it
+	encryptSegmentSize = 64 * 1024
+	encryptOverhead    = 16
+	encryptNonceSize   = 12
+	encryptVersion     = 1
+	// magic, version, data key id, contents size, nonce
+	encryptedHeaderSize = 6 + 1 + 8 + 8 + encryptNonceSize
+)
+
+var encryptedMagic = []byte("\x89GBE\r\n")
+
+// EncryptedStore encrypts blobs with AES-GCM before they reach another
+// store. Every blob is encrypted with the data key of the user who
+// uploaded it, and the key's id is kept in a header in front of it.
+//
+// Blobs without a header were written before encryption was turned on,
+// and are read back as they are.
+type EncryptedStore struct {
+	*URLSigner
+	Inner BlobStore
+	Keys  KeyRing
+}
+
+func NewEncryptedStore(inner BlobStore, keys KeyRing, signer *URLSigner) *EncryptedStore {
+	return &EncryptedStore{URLSigner: signer, Inner: inner, Keys: keys}
+}
+
+type encryptedHeader struct {
+	raw   []byte
+	keyId int64
+	size  int64
+	nonce []byte
+}
+
+func (e *EncryptedStore) Name() string {
+	return Name(e.Inner)
+}
+
+func (e *EncryptedStore) Exists(key string) (bool, error) {
+	return e.Inner.Exists(key)
+}
+
+func (e *EncryptedStore) Put(key string, r io.Reader, size int64) error {
+	return e.PutOwned(0, key, r, size)
+}
+
+func (e *EncryptedStore) PutOwned(owner int64, key string, r io.Reader,
+	size int64) error {
+	keyId, dataKey, err := e.Keys.DataKey(owner)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	header := encryptedHeader{
+		raw:   make([]byte, encryptedHeaderSize),
+		keyId: keyId,
+		size:  size,
+		nonce: make([]byte, encryptNonceSize),
+	}
+	_, err = rand.Read(header.nonce)
+	if err != nil {
+		return err
+	}
+	copy(header.raw, encryptedMagic)
+	header.raw[len(encryptedMagic)] = encryptVersion
+	binary.BigEndian.PutUint64(header.raw[7:], uint64(keyId))
+	binary.BigEndian.PutUint64(header.raw[15:], uint64(size))
+	copy(header.raw[23:], header.nonce)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptSegments(pw, io.LimitReader(r, size),
+			aead, header))
+	}()
+	err = e.Inner.Put(key, pr, encryptedSize(size))
+	pr.CloseWithError(err)
+	return err
+}
+
+func (e *EncryptedStore) Get(key string) (io.ReadCloser, error) {
+	return e.GetRange(key, 0, -1)
+}
+
+func (e *EncryptedStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	header, err := e.header(key)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return e.Inner.GetRange(key, offset, length)
+	}
+	if offset > header.size {
+		offset = header.size
+	}
+	if length < 0 || offset+length > header.size {
+		length = header.size - offset
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	dataKey, err := e.Keys.Key(header.keyId)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	first := offset / encryptSegmentSize
+	last := (offset + length - 1) / encryptSegmentSize
+	segmentSize := int64(encryptSegmentSize + encryptOverhead)
+	rc, err := e.Inner.GetRange(key,
+		encryptedHeaderSize+first*segmentSize,
+		(last-first+1)*segmentSize)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{
+		rc:        rc,
+		aead:      aead,
+		header:    *header,
+		index:     first,
+		skip:      offset - first*encryptSegmentSize,
+		remaining: length,
+	}, nil
+}
+
+func (e *EncryptedStore) Stat(key string) (Object, error) {
+	object, err := e.Inner.Stat(key)
+	if err != nil {
+		return object, err
+	}
+	header, err := e.header(key)
+	if err != nil {
+		return object, err
+	}
+	if header != nil {
+		object.Size = header.size
+	}
+	return object, nil
+}
+
+func (e *EncryptedStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if e.URLSigner == nil {
+		return "", ErrSignedURLUnsupported
+	}
+	return e.SignURL(key, expires), nil
+}
+
+func (e *EncryptedStore) Delete(key string) error {
+	return e.Inner.Delete(key)
+}
+
+// List returns the inner store's objects, with their encrypted sizes.
+func (e *EncryptedStore) List(prefix string) ([]Object, error) {
+	return e.Inner.List(prefix)
+}
+
+// Encoding reports the encrypted size of key. Encryption isn't a codec,
+// blobs are either all encrypted or, from before, not at all.
+func (e *EncryptedStore) Encoding(key string) (codec string, storedSize int64, err error) {
+	object, err := e.Inner.Stat(key)
+	return "", object.Size, err
+}
+
+// KeyId returns the id of the data key key is encrypted with, or 0 if it
+// isn't encrypted.
+func (e *EncryptedStore) KeyId(key string) (int64, error) {
+	header, err := e.header(key)
+	if err != nil || header == nil {
+		return 0, err
+	}
+	return header.keyId, nil
+}
+
+// header reads the header of key, or returns nil if it has none.
+func (e *EncryptedStore) header(key string) (*encryptedHeader, error) {
+	rc, err := e.Inner.GetRange(key, 0, encryptedHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	raw, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < encryptedHeaderSize || !bytes.HasPrefix(raw, encryptedMagic) {
+		return nil, nil
+	}
+	if raw[len(encryptedMagic)] != encryptVersion {
+		return nil, ErrCorrupt
+	}
+	return &encryptedHeader{
+		raw:   raw,
+		keyId: int64(binary.BigEndian.Uint64(raw[7:])),
+		size:  int64(binary.BigEndian.Uint64(raw[15:])),
+		nonce: raw[23:],
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentCount(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encryptSegmentSize - 1) / encryptSegmentSize
+}
+
+func encryptedSize(size int64) int64 {
+	return encryptedHeaderSize + size + segmentCount(size)*encryptOverhead
+}
+
+// segmentNonce derives a segment's nonce from the blob's, so no two
+// segments share one.
+func segmentNonce(nonce []byte, index int64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(index))
+	for i := range counter {
+		n[len(n)-8+i] ^= counter[i]
+	}
+	return n
+}
+
+// segmentData authenticates the header along with every segment, and marks
+// the final one so a truncated blob doesn't decrypt.
+func segmentData(header encryptedHeader, index int64) []byte {
+	data := make([]byte, len(header.raw)+1)
+	copy(data, header.raw)
+	if index == segmentCount(header.size)-1 {
+		data[len(header.raw)] = 1
+	}
+	return data
+}
+
+func encryptSegments(w io.Writer, r io.Reader, aead cipher.AEAD,
+	header encryptedHeader) error {
+	_, err := w.Write(header.raw)
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, encryptSegmentSize)
+	sealed := make([]byte, 0, encryptSegmentSize+encryptOverhead)
+	var total int64
+	for index := int64(0); index < segmentCount(header.size); index++ {
+		n, err := io.ReadFull(r, plain)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		total += int64(n)
+		sealed = aead.Seal(sealed[:0], segmentNonce(header.nonce, index),
+			plain[:n], segmentData(header, index))
+		_, err = w.Write(sealed)
+		if err != nil {
+			return err
+		}
+	}
+	if total != header.size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// segmentReader decrypts consecutive segments starting at index.
+type segmentReader struct {
+	rc        io.ReadCloser
+	aead      cipher.AEAD
+	header    encryptedHeader
+	index     int64
+	skip      int64
+	remaining int64
+	buf       []byte
+}
+
+func (s *segmentReader) Read(p []byte) (n int, err error) {
+	if s.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(s.buf) == 0 {
+		err = s.next()
+		if err != nil {
+			return
+		}
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n = copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.remaining -= int64(n)
+	return
+}
+
+func (s *segmentReader) next() error {
+	length := int64(encryptSegmentSize)
+	if rest := s.header.size - s.index*encryptSegmentSize; rest < length {
+		length = rest
+	}
+	sealed := make([]byte, length+encryptOverhead)
+	_, err := io.ReadFull(s.rc, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := s.aead.Open(sealed[:0], segmentNonce(s.header.nonce, s.index),
+		sealed, segmentData(s.header, s.index))
+	if err != nil {
+		return ErrCorrupt
+	}
+	s.index++
+	s.buf = plain[s.skip:]
+	s.skip = 0
+	return nil
+}
+
+func (s *segmentReader) Close() error {
+	return s.rc.Close()
+}
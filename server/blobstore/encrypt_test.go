@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// testKeyRing gives every owner their own key, kept in memory.
+type testKeyRing struct {
+	keys map[int64][]byte
+}
+
+func (r *testKeyRing) DataKey(owner int64) (int64, []byte, error) {
+	id := owner + 1
+	if _, ok := r.keys[id]; !ok {
+		key := make([]byte, 32)
+		rand.Read(key)
+		r.keys[id] = key
+	}
+	return id, r.keys[id], nil
+}
+
+func (r *testKeyRing) Key(id int64) ([]byte, error) {
+	return r.keys[id], nil
+}
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	store := NewEncryptedStore(inner, &testKeyRing{keys: make(map[int64][]byte)}, nil)
+
+	contents := make([]byte, encryptSegmentSize*2+100)
+	rand.Read(contents)
+	err := PutOwned(store, 7, "blob", bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := getString(inner, "blob")
+	if bytes.Contains([]byte(stored), contents[:64]) {
+		t.Error("Contents reached the inner store unencrypted")
+	}
+	if int64(len(stored)) != encryptedSize(int64(len(contents))) {
+		t.Error("Encrypted blob has the wrong size")
+	}
+	keyId, _ := store.KeyId("blob")
+	if keyId != 8 {
+		t.Error("Blob should be encrypted with its owner's key")
+	}
+
+	read, err := getString(store, "blob")
+	if err != nil || read != string(contents) {
+		t.Error("Encrypted blob didn't read back the same")
+	}
+	object, _ := store.Stat("blob")
+	if object.Size != int64(len(contents)) {
+		t.Error("Stat should report the size of the contents")
+	}
+
+	// a range across a segment boundary
+	offset := int64(encryptSegmentSize - 10)
+	r, err := store.GetRange("blob", offset, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(part, contents[offset:offset+30]) {
+		t.Error("GetRange across segments returned the wrong bytes")
+	}
+
+	// flip a bit in the last segment
+	damaged := []byte(stored)
+	damaged[len(damaged)-20] ^= 1
+	putString(inner, "damaged", string(damaged))
+	r, _ = store.Get("damaged")
+	_, err = ioutil.ReadAll(r)
+	if err != ErrCorrupt {
+		t.Error("Tampered blob should fail to decrypt")
+	}
+
+	// cut off the last segment
+	putString(inner, "truncated",
+		stored[:encryptedHeaderSize+2*(encryptSegmentSize+encryptOverhead)])
+	r, _ = store.Get("truncated")
+	_, err = ioutil.ReadAll(r)
+	if err != ErrCorrupt {
+		t.Error("Truncated blob should fail to decrypt")
+	}
+
+	putString(store, "empty", "")
+	read, err = getString(store, "empty")
+	if err != nil || read != "" {
+		t.Error("Empty blob didn't read back")
+	}
+
+	putString(inner, "old", "stored before encryption")
+	read, _ = getString(store, "old")
+	if read != "stored before encryption" {
+		t.Error("Unencrypted blobs should read back as they are")
+	}
+}
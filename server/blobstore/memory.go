@@ -0,0 +1,126 @@
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps blobs in a map. It is meant for tests and for running
+// the server locally, everything is lost when the process exits.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+func (m *MemoryStore) Name() string {
+	return "memory"
+}
+
+func (m *MemoryStore) Exists(key string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, exists := m.objects[key]
+	return exists, nil
+}
+
+func (m *MemoryStore) Put(key string, r io.Reader, size int64) error {
+	stored, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: stored, modified: time.Now()}
+	return nil
+}
+
+func (m *MemoryStore) Get(key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, exists := m.objects[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	// stored slices are never modified, so readers can share them
+	return ioutil.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (m *MemoryStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, exists := m.objects[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	data := object.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryStore) Stat(key string) (Object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, exists := m.objects[key]
+	if !exists {
+		return Object{}, ErrNotFound
+	}
+	return Object{
+		Key:          key,
+		Size:         int64(len(object.data)),
+		LastModified: object.modified,
+	}, nil
+}
+
+func (m *MemoryStore) SignedURL(key string, expires time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryStore) List(prefix string) (objects []Object, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for key, object := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		objects = append(objects, Object{
+			Key:          key,
+			Size:         int64(len(object.data)),
+			LastModified: object.modified,
+		})
+	}
+	sort.Sort(byKey(objects))
+	return objects, nil
+}
+
+type byKey []Object
+
+func (o byKey) Len() int           { return len(o) }
+func (o byKey) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o byKey) Less(i, j int) bool { return o[i].Key < o[j].Key }
@@ -0,0 +1,81 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+
+	err := putString(store, "abc", "contents")
+	if err != nil {
+		t.Error(err)
+	}
+	exists, err := store.Exists("abc")
+	if !exists || err != nil {
+		t.Fail()
+	}
+	contents, err := getString(store, "abc")
+	if err != nil || contents != "contents" {
+		t.Fail()
+	}
+	_, err = store.Get("missing")
+	if err != ErrNotFound {
+		t.Error("Get of a missing key should return ErrNotFound")
+	}
+
+	putString(store, "abd", "more")
+	putString(store, "xyz", "other")
+	objects, err := store.List("ab")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "abc" || objects[1].Size != 4 {
+		t.Error("List returned the wrong objects")
+	}
+
+	err = store.Delete("abc")
+	if err != nil {
+		t.Error(err)
+	}
+	exists, _ = store.Exists("abc")
+	if exists {
+		t.Error("Blob still exists after delete")
+	}
+}
+
+func TestGetRangeAndStat(t *testing.T) {
+	disk, cleanup := newTestDiskStore(t)
+	defer cleanup()
+
+	for _, store := range []BlobStore{NewMemoryStore(), disk} {
+		putString(store, testHash, "0123456789")
+
+		r, err := store.GetRange(testHash, 2, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(contents) != "234" {
+			t.Errorf("GetRange read %q", contents)
+		}
+		r, _ = store.GetRange(testHash, 7, -1)
+		contents, _ = ioutil.ReadAll(r)
+		r.Close()
+		if string(contents) != "789" {
+			t.Errorf("GetRange to the end read %q", contents)
+		}
+
+		object, err := store.Stat(testHash)
+		if err != nil || object.Size != 10 || object.Key != testHash {
+			t.Error("Stat returned the wrong object")
+		}
+		_, err = store.Stat(strings.Replace(testHash, "f", "e", 1))
+		if err != ErrNotFound {
+			t.Error("Stat of a missing key should return ErrNotFound")
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package blobstore
+
+import (
+	"io"
+	"time"
+)
+
+// Tiers a TieredStore keeps blobs in.
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// TierTracker is told what a TieredStore does, so blobs can be moved
+// between tiers by how they are used.
+type TierTracker interface {
+	// Accessed is called whenever a blob is read or a url is handed out
+	// for it.
+	Accessed(key string) error
+	// Moved is called once a blob is in tier and nowhere else.
+	Moved(key string, tier string) error
+}
+
+// TieredStore keeps blobs in a fast hot store, and blobs that are rarely
+// read in a cheaper cold one. New blobs always go to the hot store. Blobs
+// are only moved to the cold store by Demote, and are moved back as soon
+// as anything reads them, so a blob is in one tier at a time apart from
+// while it is being moved.
+type TieredStore struct {
+	Hot     BlobStore
+	Cold    BlobStore
+	Tracker TierTracker
+}
+
+func NewTieredStore(hot, cold BlobStore, tracker TierTracker) *TieredStore {
+	return &TieredStore{Hot: hot, Cold: cold, Tracker: tracker}
+}
+
+// FindTiered returns the TieredStore store wraps, or nil if it has none.
+func FindTiered(store BlobStore) *TieredStore {
+	for {
+		switch s := store.(type) {
+		case *TieredStore:
+			return s
+		case *CompressedStore:
+			store = s.Inner
+		case *EncryptedStore:
+			store = s.Inner
+		default:
+			return nil
+		}
+	}
+}
+
+func (t *TieredStore) Name() string {
+	return Name(t.Hot) + "+" + Name(t.Cold)
+}
+
+func (t *TieredStore) Exists(key string) (bool, error) {
+	exists, err := t.Hot.Exists(key)
+	if err != nil || exists {
+		return exists, err
+	}
+	return t.Cold.Exists(key)
+}
+
+func (t *TieredStore) Put(key string, r io.Reader, size int64) error {
+	return t.Hot.Put(key, r, size)
+}
+
+func (t *TieredStore) Get(key string) (io.ReadCloser, error) {
+	return t.GetRange(key, 0, -1)
+}
+
+func (t *TieredStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	err := t.promote(key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := t.Hot.GetRange(key, offset, length)
+	if err == ErrNotFound {
+		// demoted between the check and the read
+		err = t.promote(key)
+		if err != nil {
+			return nil, err
+		}
+		rc, err = t.Hot.GetRange(key, offset, length)
+	}
+	return rc, err
+}
+
+// Stat doesn't count as reading the blob, so it doesn't move it.
+func (t *TieredStore) Stat(key string) (Object, error) {
+	object, err := t.Hot.Stat(key)
+	if err == ErrNotFound {
+		return t.Cold.Stat(key)
+	}
+	return object, err
+}
+
+// SignedURL moves key to the hot store first, so the url is always for
+// the store that has it.
+func (t *TieredStore) SignedURL(key string, expires time.Duration) (string, error) {
+	err := t.promote(key)
+	if err != nil {
+		return "", err
+	}
+	return t.Hot.SignedURL(key, expires)
+}
+
+// Verify checks the urls SignedURL hands out, which are the hot store's.
+func (t *TieredStore) Verify(key, expires, signature string) error {
+	verifier, ok := t.Hot.(Verifier)
+	if !ok {
+		return ErrSignedURLUnsupported
+	}
+	return verifier.Verify(key, expires, signature)
+}
+
+func (t *TieredStore) Delete(key string) error {
+	err := t.Hot.Delete(key)
+	if err != nil {
+		return err
+	}
+	return t.Cold.Delete(key)
+}
+
+// List returns the blobs in both stores. A blob caught being moved is
+// listed once, as it is in the hot store.
+func (t *TieredStore) List(prefix string) ([]Object, error) {
+	objects, err := t.Hot.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := t.Cold.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	hot := make(map[string]bool)
+	for _, object := range objects {
+		hot[object.Key] = true
+	}
+	for _, object := range cold {
+		if !hot[object.Key] {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// Tier returns which store key is in.
+func (t *TieredStore) Tier(key string) (string, error) {
+	exists, err := t.Hot.Exists(key)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return TierHot, nil
+	}
+	exists, err = t.Cold.Exists(key)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrNotFound
+	}
+	return TierCold, nil
+}
+
+// Demote moves key from the hot store to the cold one.
+func (t *TieredStore) Demote(key string) error {
+	err := move(t.Hot, t.Cold, key)
+	if err != nil {
+		return err
+	}
+	return t.tracker().Moved(key, TierCold)
+}
+
+// promote makes sure key is in the hot store, moving it there if it is
+// only in the cold one, and records the access. Bookkeeping errors don't
+// fail the read, the worst they cause is a blob being demoted early.
+func (t *TieredStore) promote(key string) error {
+	tracker := t.tracker()
+	tracker.Accessed(key)
+	exists, err := t.Hot.Exists(key)
+	if err != nil || exists {
+		return err
+	}
+	err = move(t.Cold, t.Hot, key)
+	if err == ErrNotFound {
+		// another read may have moved it first
+		exists, err = t.Hot.Exists(key)
+		if err == nil && !exists {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	tracker.Moved(key, TierHot)
+	return nil
+}
+
+func (t *TieredStore) tracker() TierTracker {
+	if t.Tracker == nil {
+		return nopTracker{}
+	}
+	return t.Tracker
+}
+
+// move copies key from one store to another, and only deletes it from
+// the first once the copy is complete.
+func move(from, to BlobStore, key string) error {
+	object, err := from.Stat(key)
+	if err != nil {
+		return err
+	}
+	rc, err := from.Get(key)
+	if err != nil {
+		return err
+	}
+	err = to.Put(key, rc, object.Size)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return from.Delete(key)
+}
+
+type nopTracker struct{}
+
+func (nopTracker) Accessed(key string) error           { return nil }
+func (nopTracker) Moved(key string, tier string) error { return nil }
+
+// Tier returns the tier key is in, or an empty string if store doesn't
+// have tiers.
+func Tier(store BlobStore, key string) (string, error) {
+	tiered := FindTiered(store)
+	if tiered == nil {
+		return "", nil
+	}
+	return tiered.Tier(key)
+}
@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type testTracker struct {
+	accessed []string
+	tiers    map[string]string
+}
+
+func (t *testTracker) Accessed(key string) error {
+	t.accessed = append(t.accessed, key)
+	return nil
+}
+
+func (t *testTracker) Moved(key string, tier string) error {
+	t.tiers[key] = tier
+	return nil
+}
+
+func TestTieredStore(t *testing.T) {
+	hot := NewMemoryStore()
+	cold := NewMemoryStore()
+	tracker := &testTracker{tiers: make(map[string]string)}
+	store := NewTieredStore(hot, cold, tracker)
+
+	putString(store, "abc", "contents")
+	if exists, _ := hot.Exists("abc"); !exists {
+		t.Error("New blobs should go to the hot store")
+	}
+	tier, _ := store.Tier("abc")
+	if tier != TierHot {
+		t.Error("New blob should be in the hot tier")
+	}
+
+	err := store.Demote("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := hot.Exists("abc"); exists {
+		t.Error("Demoted blob is still in the hot store")
+	}
+	if tracker.tiers["abc"] != TierCold {
+		t.Error("Demotion wasn't tracked")
+	}
+	if exists, _ := store.Exists("abc"); !exists {
+		t.Error("Demoted blob should still exist")
+	}
+	object, err := store.Stat("abc")
+	if err != nil || object.Size != 8 {
+		t.Error("Stat should find blobs in the cold store")
+	}
+	if exists, _ := hot.Exists("abc"); exists {
+		t.Error("Stat shouldn't promote a blob")
+	}
+	objects, _ := store.List("")
+	if len(objects) != 1 || objects[0].Key != "abc" {
+		t.Error("List should include the cold store")
+	}
+
+	r, err := store.GetRange("abc", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(contents) != "tent" {
+		t.Errorf("GetRange of a cold blob returned %q", contents)
+	}
+	if exists, _ := hot.Exists("abc"); !exists {
+		t.Error("Reading a cold blob should promote it")
+	}
+	if exists, _ := cold.Exists("abc"); exists {
+		t.Error("Promoted blob is still in the cold store")
+	}
+	if tracker.tiers["abc"] != TierHot || len(tracker.accessed) != 1 {
+		t.Error("Promotion and access weren't tracked")
+	}
+
+	store.Demote("abc")
+	_, err = store.SignedURL("abc", time.Minute)
+	if err != ErrSignedURLUnsupported {
+		t.Error("SignedURL should come from the hot store")
+	}
+	if exists, _ := hot.Exists("abc"); !exists {
+		t.Error("Signing a url for a cold blob should promote it")
+	}
+
+	store.Demote("abc")
+	store.Delete("abc")
+	if exists, _ := store.Exists("abc"); exists {
+		t.Error("Blob still exists after delete")
+	}
+	_, err = store.Get("abc")
+	if err != ErrNotFound {
+		t.Error("Get of a missing key should return ErrNotFound")
+	}
+
+	if FindTiered(NewCompressedStore(store, nil)) != store {
+		t.Error("FindTiered should look through wrappers")
+	}
+	if FindTiered(hot) != nil {
+		t.Error("A memory store has no tiers")
+	}
+}
@@ -0,0 +1,68 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var ErrHashMismatch = errors.New("blobstore: contents don't match the declared hash")
+
+// verifyingStore is implemented by backends that can check a blob while
+// writing it to their own temporary location.
+type verifyingStore interface {
+	PutVerified(hash string, r io.Reader, size int64) error
+}
+
+// PutVerified streams r into store under hash. The contents are first
+// written to a temporary file while being hashed, and only committed to
+// the store if they are exactly size bytes long and their sha256 is hash.
+func PutVerified(store BlobStore, hash string, r io.Reader, size int64) error {
+	return PutVerifiedAs(store, 0, hash, r, size)
+}
+
+// PutVerifiedAs is PutVerified for a blob uploaded by the user with id
+// owner.
+func PutVerifiedAs(store BlobStore, owner int64, hash string, r io.Reader,
+	size int64) error {
+	if v, ok := store.(verifyingStore); ok {
+		return v.PutVerified(hash, r, size)
+	}
+	tmp, err := ioutil.TempFile("", "gobox-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = copyVerified(tmp, r, hash, size)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	return PutOwned(store, owner, hash, tmp, size)
+}
+
+// copyVerified copies r to w, failing if r doesn't hold exactly size bytes
+// hashing to hash.
+func copyVerified(w io.Writer, r io.Reader, hash string, size int64) error {
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(r, size+1))
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", ErrHashMismatch, size, written)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return ErrHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+// Package gc deletes blobs that no file refers to anymore.
+//
+// Collection is mark and sweep across runs. A run marks every stored blob
+// nothing references, and only deletes blobs that were already marked at
+// least a grace period ago and are still unreferenced. A blob that gets
+// referenced again in the meantime, by a new file action or an upload that
+// was in flight, is simply unmarked.
+package gc
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	DefaultGracePeriod      = time.Hour * 24
+	DefaultVersionRetention = time.Hour * 24 * 30
+	DefaultTrashRetention   = time.Hour * 24 * 30
+)
+
+type Options struct {
+	// GracePeriod is how long a blob stays marked before it is deleted.
+	// Blobs written more recently than this are never marked.
+	GracePeriod time.Duration
+	// VersionRetention is how long old versions of a file are kept
+	// after they were replaced or deleted.
+	VersionRetention time.Duration
+	// TrashRetention is how long deleted files stay in the trash. Each
+	// run purges older ones, after which only VersionRetention keeps
+	// their blobs.
+	TrashRetention time.Duration
+	// DryRun reports what would be marked and deleted without changing
+	// anything.
+	DryRun bool
+}
+
+type Report struct {
+	// Purged is how many files were removed from the trash.
+	Purged     int64
+	Scanned    int
+	Referenced int
+	// Marked are blobs marked as garbage in this run.
+	Marked []string
+	// Unmarked are blobs that had been marked, but are referenced again.
+	Unmarked []string
+	// Pending are marked blobs still inside their grace period.
+	Pending []string
+	// Swept are the blobs deleted in this run.
+	Swept      []string
+	BytesFreed int64
+}
+
+func (r Report) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := fmt.Fprintf(w,
+		"purged %d trashed files\n"+
+			"scanned %d blobs, %d referenced\n"+
+			"marked %d, unmarked %d, pending %d\n"+
+			"swept %d, freeing %d bytes\n",
+		r.Purged, r.Scanned, r.Referenced,
+		len(r.Marked), len(r.Unmarked), len(r.Pending),
+		len(r.Swept), r.BytesFreed,
+	)
+	return int64(written), err
+}
+
+// Collect runs one mark and sweep pass over store.
+func Collect(store blobstore.BlobStore, options Options) (report Report, err error) {
+	now := time.Now()
+	retainSince := now.Add(-options.VersionRetention)
+	trashSince := now.Add(-options.TrashRetention)
+	if !options.DryRun {
+		query := model.DB.Exec("DELETE FROM trashed_files WHERE trashed_at < ?",
+			trashSince)
+		if query.Error != nil {
+			return report, query.Error
+		}
+		report.Purged = query.RowsAffected
+	}
+
+	objects, err := store.List("")
+	if err != nil {
+		return
+	}
+	report.Scanned = len(objects)
+
+	referenced, err := ReferencedHashes(retainSince, trashSince)
+	if err != nil {
+		return
+	}
+
+	var candidates []structs.GCCandidate
+	query := model.DB.Find(&candidates)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return report, query.Error
+	}
+	marked := make(map[string]structs.GCCandidate)
+	for _, candidate := range candidates {
+		marked[candidate.Hash] = candidate
+	}
+
+	for _, object := range objects {
+		candidate, isMarked := marked[object.Key]
+		if referenced[object.Key] {
+			report.Referenced++
+			if isMarked {
+				report.Unmarked = append(report.Unmarked, object.Key)
+				err = unmark(candidate, options)
+				if err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if !isMarked {
+			if now.Sub(object.LastModified) < options.GracePeriod {
+				// probably an upload whose file action hasn't landed yet
+				continue
+			}
+			report.Marked = append(report.Marked, object.Key)
+			if !options.DryRun {
+				query = model.DB.Create(&structs.GCCandidate{
+					Hash:     object.Key,
+					MarkedAt: now,
+				})
+				if query.Error != nil {
+					return report, query.Error
+				}
+			}
+			continue
+		}
+		if now.Sub(candidate.MarkedAt) < options.GracePeriod {
+			report.Pending = append(report.Pending, object.Key)
+			continue
+		}
+
+		// a client told the blob is here would never upload it, so from
+		// now on it's reported missing
+		if !options.DryRun {
+			err = blobindex.StartCollecting(object.Key)
+			if err != nil {
+				return
+			}
+		}
+		// the reference set is a snapshot from the start of the run,
+		// check again right before deleting
+		var stillReferenced bool
+		stillReferenced, err = isReferenced(object.Key, retainSince, trashSince)
+		if err != nil {
+			return
+		}
+		if stillReferenced {
+			report.Unmarked = append(report.Unmarked, object.Key)
+			if !options.DryRun {
+				err = blobindex.StopCollecting(object.Key)
+				if err != nil {
+					return
+				}
+			}
+			err = unmark(candidate, options)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		report.Swept = append(report.Swept, object.Key)
+		report.BytesFreed += object.Size
+		if options.DryRun {
+			continue
+		}
+		err = store.Delete(object.Key)
+		if err != nil {
+			return
+		}
+		err = blobindex.FinishCollecting(object.Key)
+		if err != nil {
+			return
+		}
+		err = unmark(candidate, options)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func unmark(candidate structs.GCCandidate, options Options) error {
+	if options.DryRun {
+		return nil
+	}
+	return model.DB.Delete(&candidate).Error
+}
+
+// ReferencedHashes returns the hash of every blob that must be kept: the
+// blocks of every file in a user's tree or in the trash, of every version
+// replaced or deleted after retainSince, of every file trashed after
+// trashSince, and of every upload still in progress.
+func ReferencedHashes(retainSince time.Time, trashSince time.Time) (
+	referenced map[string]bool, err error) {
+	referenced = make(map[string]bool)
+	for _, scope := range referenceScopes(retainSince, trashSince) {
+		err = scope.addHashes(referenced)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var hashes []string
+	query := model.DB.Model(structs.UploadSession{}).Pluck("hash", &hashes)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return nil, query.Error
+	}
+	for _, hash := range hashes {
+		referenced[hash] = true
+	}
+	return
+}
+
+// LiveHashes returns the hash of every blob a file currently in a user's
+// tree is made of. Blobs that are referenced but not live only belong to
+// old versions.
+func LiveHashes() (live map[string]bool, err error) {
+	live = make(map[string]bool)
+	now := time.Now()
+	err = referenceScopes(now, now)[0].addHashes(live)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func isReferenced(hash string, retainSince time.Time, trashSince time.Time) (
+	bool, error) {
+	for _, scope := range referenceScopes(retainSince, trashSince) {
+		var count int
+		query := scope.blocks().Where("blocks.hash = ?", hash).Count(&count)
+		if query.Error != nil {
+			return false, query.Error
+		}
+		if count > 0 {
+			return true, nil
+		}
+		query = scope.files().Where("files.hash = ?", hash).Count(&count)
+		if query.Error != nil {
+			return false, query.Error
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	var count int
+	query := model.DB.Model(structs.UploadSession{}).
+		Where("hash = ?", hash).
+		Count(&count)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return count > 0, nil
+}
+
+// referenceScope is a set of files whose blobs are still needed.
+type referenceScope struct {
+	blocks func() *gorm.DB
+	files  func() *gorm.DB
+}
+
+func (scope referenceScope) addHashes(hashes map[string]bool) error {
+	var found []string
+	query := scope.blocks().Pluck("blocks.hash", &found)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	for _, hash := range found {
+		hashes[hash] = true
+	}
+	// files written before blocks existed are stored whole
+	found = nil
+	query = scope.files().Pluck("files.hash", &found)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return query.Error
+	}
+	for _, hash := range found {
+		hashes[hash] = true
+	}
+	return nil
+}
+
+// referenceScopes returns the scopes of files whose blobs are kept, live
+// files first.
+func referenceScopes(retainSince time.Time, trashSince time.Time) []referenceScope {
+	return []referenceScope{
+		// files currently in someone's tree
+		referenceScope{
+			blocks: func() *gorm.DB {
+				return model.DB.Table("blocks").
+					Joins("join file_system_files on file_system_files.file_id = blocks.file_id")
+			},
+			files: func() *gorm.DB {
+				return model.DB.Table("files").
+					Joins("join file_system_files on file_system_files.file_id = files.id")
+			},
+		},
+		// files in the trash
+		referenceScope{
+			blocks: func() *gorm.DB {
+				return model.DB.Table("blocks").
+					Joins("join trashed_files on trashed_files.file_id = blocks.file_id").
+					Where("trashed_files.trashed_at > ?", trashSince)
+			},
+			files: func() *gorm.DB {
+				return model.DB.Table("files").
+					Joins("join trashed_files on trashed_files.file_id = files.id").
+					Where("trashed_files.trashed_at > ?", trashSince)
+			},
+		},
+		// versions created within the retention period
+		referenceScope{
+			blocks: func() *gorm.DB {
+				return model.DB.Table("blocks").
+					Joins("join file_actions on file_actions.file_id = blocks.file_id").
+					Where("file_actions.created_at > ?", retainSince)
+			},
+			files: func() *gorm.DB {
+				return model.DB.Table("files").
+					Joins("join file_actions on file_actions.file_id = files.id").
+					Where("file_actions.created_at > ?", retainSince)
+			},
+		},
+		// versions replaced or deleted within the retention period
+		referenceScope{
+			blocks: func() *gorm.DB {
+				return model.DB.Table("blocks").
+					Joins("join files on files.id = blocks.file_id").
+					Joins("join file_actions on file_actions.previous_hash = files.hash").
+					Where("file_actions.created_at > ?", retainSince)
+			},
+			files: func() *gorm.DB {
+				return model.DB.Table("files").
+					Joins("join file_actions on file_actions.previous_hash = files.hash").
+					Where("file_actions.created_at > ?", retainSince)
+			},
+		},
+	}
+}
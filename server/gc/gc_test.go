@@ -0,0 +1,234 @@
+package gc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+var user structs.User
+var client structs.Client
+
+func init() {
+	var err error
+
+	model.DB, err = gorm.Open("postgres", "dbname=goboxtest sslmode=disable")
+
+	model.DB.DropTableIfExists(&structs.User{})
+	model.DB.DropTableIfExists(&structs.Client{})
+	model.DB.DropTableIfExists(&structs.FileAction{})
+	model.DB.DropTableIfExists(&structs.File{})
+	model.DB.DropTableIfExists(&structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.UploadSession{})
+	model.DB.DropTableIfExists(&structs.GCCandidate{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.DropTableIfExists(&structs.EmailToken{})
+	model.DB.DropTableIfExists(&structs.Namespace{})
+	model.DB.DropTableIfExists(&structs.NamespaceMember{})
+	model.DB.DropTableIfExists(&structs.ShareLink{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
+	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{}, &structs.Block{}, &structs.UploadSession{}, &structs.GCCandidate{}, &structs.Blob{}, &structs.DataKey{}, &structs.EmailToken{}, &structs.Namespace{}, &structs.NamespaceMember{}, &structs.ShareLink{}, &structs.TrashedFile{})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	user, _ = boxtools.NewUser("gc@gobox.test", "password")
+	client, err = boxtools.NewClient(user, "test", false)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// putBlob stores a blob under a random hash and returns the hash.
+func putBlob(t *testing.T, store blobstore.BlobStore) string {
+	hash, err := boxtools.GenerateRandomSha256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(hash, strings.NewReader(hash), int64(len(hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func applyFileAction(t *testing.T, fileAction structs.FileAction) {
+	fileActions, err := boxtools.WriteFileActionsToDatabase(
+		[]structs.FileAction{fileAction}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := boxtools.ApplyFileActionsToFileSystemFileTable(fileActions, user)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+func contains(hashes []string, hash string) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCollect(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+
+	live := putBlob(t, store)
+	applyFileAction(t, structs.FileAction{
+		IsCreate: true,
+		File:     structs.File{Path: "/live", Hash: live, Size: 64},
+	})
+
+	deleted := putBlob(t, store)
+	applyFileAction(t, structs.FileAction{
+		IsCreate: true,
+		File:     structs.File{Path: "/deleted", Hash: deleted, Size: 64},
+	})
+	applyFileAction(t, structs.FileAction{
+		IsCreate: false,
+		File:     structs.File{Path: "/deleted", Hash: deleted, Size: 64},
+	})
+
+	uploading := putBlob(t, store)
+	model.DB.Create(&structs.UploadSession{
+		UserId: user.Id,
+		Hash:   uploading,
+		Size:   64,
+	})
+
+	garbage := putBlob(t, store)
+
+	options := Options{VersionRetention: DefaultVersionRetention, DryRun: true}
+	report, err := Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Marked) != 1 || report.Marked[0] != garbage {
+		t.Error("Dry run should report only the unreferenced blob as marked")
+	}
+	var count int
+	model.DB.Model(structs.GCCandidate{}).Count(&count)
+	if count != 0 {
+		t.Error("Dry run shouldn't mark anything")
+	}
+
+	// the deleted file is past its retention now
+	options = Options{}
+	report, err = Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(report.Marked, garbage) || !contains(report.Marked, deleted) {
+		t.Error("Unreferenced blobs should be marked")
+	}
+	if len(report.Swept) != 0 {
+		t.Error("Nothing should be swept on the run that marks it")
+	}
+
+	report, err = Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Swept) != 2 {
+		t.Errorf("Expected 2 blobs swept, got %d", len(report.Swept))
+	}
+	for _, hash := range []string{garbage, deleted} {
+		exists, _ := store.Exists(hash)
+		if exists {
+			t.Errorf("%s should have been deleted", hash)
+		}
+	}
+	for _, hash := range []string{live, uploading} {
+		exists, _ := store.Exists(hash)
+		if !exists {
+			t.Errorf("%s is referenced and shouldn't have been deleted", hash)
+		}
+	}
+	model.DB.Model(structs.GCCandidate{}).Count(&count)
+	if count != 0 {
+		t.Error("Swept blobs should be unmarked")
+	}
+}
+
+func TestCollectGracePeriod(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	garbage := putBlob(t, store)
+
+	options := Options{GracePeriod: time.Hour}
+	report, err := Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Marked) != 0 {
+		t.Error("Blobs inside the grace period shouldn't be marked")
+	}
+
+	// a blob marked earlier that a file refers to again is kept
+	model.DB.Create(&structs.GCCandidate{
+		Hash:     garbage,
+		MarkedAt: time.Now().Add(-time.Hour * 2),
+	})
+	applyFileAction(t, structs.FileAction{
+		IsCreate: true,
+		File:     structs.File{Path: "/revived", Hash: garbage, Size: 64},
+	})
+	report, err = Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(report.Unmarked, garbage) || len(report.Swept) != 0 {
+		t.Error("A referenced blob should be unmarked, not swept")
+	}
+}
+
+func TestCollectTrash(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	trashed := putBlob(t, store)
+	applyFileAction(t, structs.FileAction{
+		IsCreate: true,
+		File:     structs.File{Path: "/trashed", Hash: trashed, Size: 64},
+	})
+	applyFileAction(t, structs.FileAction{
+		IsCreate: false,
+		File:     structs.File{Path: "/trashed", Hash: trashed, Size: 64},
+	})
+
+	options := Options{TrashRetention: DefaultTrashRetention}
+	report, err := Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(report.Marked, trashed) || report.Purged != 0 {
+		t.Error("A file in the trash should keep its blob")
+	}
+
+	// the trashed file is past its retention now
+	options = Options{}
+	report, err = Collect(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Purged == 0 || !contains(report.Marked, trashed) {
+		t.Error("Purging the trash should let its blobs be collected")
+	}
+	var count int
+	model.DB.Model(structs.TrashedFile{}).Where("file_id IN (SELECT id FROM files WHERE hash = ?)",
+		trashed).Count(&count)
+	if count != 0 {
+		t.Error("The trash should have been purged")
+	}
+}
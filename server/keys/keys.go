@@ -0,0 +1,305 @@
+// Package keys keeps the data keys blobs are encrypted with at rest.
+//
+// Every user gets a data key, stored in the data_keys table wrapped by a
+// master key. Master keys live in a key file, one per line as
+//
+//	<id> <hex encoded 32 byte key>
+//
+// and the last one is current. Rotating means adding a new master key to
+// the file and running Rotate, which wraps every data key with it. Older
+// master keys can be removed from the file once nothing is wrapped with
+// them, and the blobs themselves never change.
+package keys
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+const keySize = 32
+
+var (
+	ErrNoMasterKey      = errors.New("keys: no master key")
+	ErrUnknownMasterKey = errors.New("keys: data key is wrapped by an unknown master key")
+)
+
+type MasterKey struct {
+	Id  string
+	Key []byte
+}
+
+// LoadMasterKeys reads a key file. The last key in it is the current one.
+func LoadMasterKeys(path string) (masterKeys []MasterKey, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keys: malformed line in %s", path)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("keys: master key %s must be %d hex encoded bytes",
+				fields[0], keySize)
+		}
+		masterKeys = append(masterKeys, MasterKey{Id: fields[0], Key: key})
+	}
+	err = scanner.Err()
+	if err == nil && len(masterKeys) == 0 {
+		err = ErrNoMasterKey
+	}
+	return
+}
+
+// AddMasterKey generates a new master key and appends it to the key file,
+// making it the current one. The file is created if it doesn't exist.
+func AddMasterKey(path string) (masterKey MasterKey, err error) {
+	masterKey.Key = make([]byte, keySize)
+	_, err = rand.Read(masterKey.Key)
+	if err != nil {
+		return
+	}
+	masterKey.Id = strconv.FormatInt(time.Now().Unix(), 10)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", masterKey.Id, hex.EncodeToString(masterKey.Key))
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Ring is a blobstore.KeyRing backed by the data_keys table. Unwrapped
+// data keys are cached for the life of the Ring.
+type Ring struct {
+	// path is the key file, reread when a data key turns out to be
+	// wrapped by a master key that was added after the Ring was made
+	path string
+
+	mu         sync.Mutex
+	masterKeys map[string][]byte
+	current    string
+	dataKeys   map[int64][]byte
+}
+
+func NewRing(masterKeys []MasterKey) (*Ring, error) {
+	if len(masterKeys) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	r := &Ring{dataKeys: make(map[int64][]byte)}
+	r.setMasterKeys(masterKeys)
+	return r, nil
+}
+
+// NewRingFromFile makes a Ring with the master keys in the key file at
+// path.
+func NewRingFromFile(path string) (*Ring, error) {
+	masterKeys, err := LoadMasterKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRing(masterKeys)
+	if err != nil {
+		return nil, err
+	}
+	r.path = path
+	return r, nil
+}
+
+func (r *Ring) setMasterKeys(masterKeys []MasterKey) {
+	r.masterKeys = make(map[string][]byte)
+	for _, masterKey := range masterKeys {
+		r.masterKeys[masterKey.Id] = masterKey.Key
+	}
+	r.current = masterKeys[len(masterKeys)-1].Id
+}
+
+func (r *Ring) reload() error {
+	if r.path == "" {
+		return ErrUnknownMasterKey
+	}
+	masterKeys, err := LoadMasterKeys(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.setMasterKeys(masterKeys)
+	r.mu.Unlock()
+	return nil
+}
+
+// DataKey returns owner's data key, creating it the first time.
+func (r *Ring) DataKey(owner int64) (id int64, key []byte, err error) {
+	var dataKey structs.DataKey
+	query := model.DB.Where("user_id = ?", owner).Order("id").First(&dataKey)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return 0, nil, query.Error
+	}
+	if dataKey.Id != 0 {
+		key, err = r.Key(dataKey.Id)
+		return dataKey.Id, key, err
+	}
+
+	key = make([]byte, keySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return
+	}
+	dataKey = structs.DataKey{UserId: owner}
+	err = r.wrap(&dataKey, key)
+	if err != nil {
+		return
+	}
+	err = model.DB.Create(&dataKey).Error
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.dataKeys[dataKey.Id] = key
+	r.mu.Unlock()
+	return dataKey.Id, key, nil
+}
+
+// Key unwraps the data key with id.
+func (r *Ring) Key(id int64) (key []byte, err error) {
+	r.mu.Lock()
+	key, ok := r.dataKeys[id]
+	r.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	var dataKey structs.DataKey
+	err = model.DB.First(&dataKey, id).Error
+	if err != nil {
+		return
+	}
+	key, err = r.unwrap(dataKey)
+	if err == ErrUnknownMasterKey {
+		// the key file has changed since we read it
+		err = r.reload()
+		if err != nil {
+			return
+		}
+		key, err = r.unwrap(dataKey)
+	}
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.dataKeys[id] = key
+	r.mu.Unlock()
+	return key, nil
+}
+
+// Rotate wraps every data key that isn't wrapped by the current master key
+// with it, and returns how many it wrapped.
+func (r *Ring) Rotate() (rotated int, err error) {
+	r.mu.Lock()
+	current := r.current
+	r.mu.Unlock()
+	var dataKeys []structs.DataKey
+	query := model.DB.Where("master_key_id <> ?", current).Find(&dataKeys)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return 0, query.Error
+	}
+	for _, dataKey := range dataKeys {
+		var key []byte
+		key, err = r.unwrap(dataKey)
+		if err != nil {
+			return
+		}
+		err = r.wrap(&dataKey, key)
+		if err != nil {
+			return
+		}
+		err = model.DB.Save(&dataKey).Error
+		if err != nil {
+			return
+		}
+		rotated++
+	}
+	return
+}
+
+// wrap encrypts key with the current master key into dataKey. The owner is
+// authenticated along with it, so a wrapped key can't be moved to another
+// user.
+func (r *Ring) wrap(dataKey *structs.DataKey, key []byte) error {
+	r.mu.Lock()
+	current := r.current
+	masterKey := r.masterKeys[current]
+	r.mu.Unlock()
+	aead, err := masterAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	wrapped := aead.Seal(nonce, nonce, key, ownerData(dataKey.UserId))
+	dataKey.WrappedKey = hex.EncodeToString(wrapped)
+	dataKey.MasterKeyId = current
+	return nil
+}
+
+func (r *Ring) unwrap(dataKey structs.DataKey) ([]byte, error) {
+	r.mu.Lock()
+	masterKey, ok := r.masterKeys[dataKey.MasterKeyId]
+	r.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	aead, err := masterAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := hex.DecodeString(dataKey.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("keys: data key %d is truncated", dataKey.Id)
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	return aead.Open(nil, nonce, wrapped[aead.NonceSize():],
+		ownerData(dataKey.UserId))
+}
+
+func masterAEAD(masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func ownerData(owner int64) []byte {
+	return []byte("gobox data key for user " + strconv.FormatInt(owner, 10))
+}
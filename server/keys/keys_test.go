@@ -0,0 +1,95 @@
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	var err error
+
+	model.DB, err = gorm.Open("postgres", "dbname=goboxtest sslmode=disable")
+
+	model.DB.DropTableIfExists(&structs.DataKey{})
+	model.DB.AutoMigrate(&structs.DataKey{})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.keys")
+
+	first, err := AddMasterKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := NewRingFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key, err := ring.DataKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameId, sameKey, _ := ring.DataKey(1)
+	if sameId != id || !bytes.Equal(sameKey, key) {
+		t.Error("A user should keep their data key")
+	}
+	otherId, _, _ := ring.DataKey(2)
+	if otherId == id {
+		t.Error("Users should get their own data keys")
+	}
+
+	// the id is the creation time in seconds, make sure it differs
+	second := MasterKey{Id: first.Id + "b", Key: bytes.Repeat([]byte{1}, keySize)}
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	fmt.Fprintf(f, "%s %x\n", second.Id, second.Key)
+	f.Close()
+
+	rotator, err := NewRingFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotator.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 {
+		t.Errorf("Expected 2 data keys rewrapped, got %d", rotated)
+	}
+	var dataKey structs.DataKey
+	model.DB.First(&dataKey, id)
+	if dataKey.MasterKeyId != second.Id {
+		t.Error("Data key should be wrapped by the new master key")
+	}
+
+	// only the new master key is needed now
+	os.Remove(path)
+	fresh, _ := NewRing([]MasterKey{second})
+	unwrapped, err := fresh.Key(id)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Error("Rotated data key didn't unwrap to the same key")
+	}
+
+	old, _ := NewRing([]MasterKey{first})
+	_, err = old.Key(id)
+	if err != ErrUnknownMasterKey {
+		t.Error("The old master key shouldn't unwrap rotated data keys")
+	}
+}
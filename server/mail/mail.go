@@ -0,0 +1,112 @@
+// Package mail sends the emails the server needs, such as address
+// verification and password resets, through whichever Mailer is set up.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultFrom = "gobox@localhost"
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages. Send returning nil only means the message was
+// handed on, not that it arrived.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer sends messages through an SMTP server, using STARTTLS if it
+// offers it.
+type SMTPMailer struct {
+	// Addr is the server's host:port.
+	Addr string
+	From string
+	// Auth is nil for servers that don't need it.
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To},
+		format(m.From, msg))
+}
+
+// LogMailer stands in for a real mailer in development and tests. It logs
+// every message, and if Dir is set writes each one to a file there too.
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	from := m.From
+	if from == "" {
+		from = defaultFrom
+	}
+	contents := format(from, msg)
+	log.Printf("mail: to %s: %s", msg.To, msg.Subject)
+	if m.Dir == "" {
+		log.Printf("%s", contents)
+		return nil
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(),
+		strings.Replace(msg.To, string(filepath.Separator), "_", -1))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), contents, 0600)
+}
+
+// NewFromEnv returns an SMTPMailer for GOBOX_SMTP_ADDR, with the optional
+// GOBOX_SMTP_USERNAME, GOBOX_SMTP_PASSWORD and GOBOX_MAIL_FROM. Without
+// GOBOX_SMTP_ADDR it returns a LogMailer, writing to GOBOX_MAIL_DIR if
+// that is set.
+func NewFromEnv() (Mailer, error) {
+	from := os.Getenv("GOBOX_MAIL_FROM")
+	if from == "" {
+		from = defaultFrom
+	}
+	addr := os.Getenv("GOBOX_SMTP_ADDR")
+	if addr == "" {
+		return &LogMailer{Dir: os.Getenv("GOBOX_MAIL_DIR"), From: from}, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	mailer := &SMTPMailer{Addr: addr, From: from}
+	if username := os.Getenv("GOBOX_SMTP_USERNAME"); username != "" {
+		mailer.Auth = smtp.PlainAuth("", username,
+			os.Getenv("GOBOX_SMTP_PASSWORD"), host)
+	}
+	return mailer, nil
+}
+
+// format turns msg into a plain text email. Header values have line breaks
+// removed, so nothing can be smuggled into the headers.
+func format(from string, msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", header(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+func header(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	contents := string(format("gobox@gobox.test", Message{
+		To:      "me@gobox.test\r\nBcc: everyone@gobox.test",
+		Subject: "Hello",
+		Body:    "line one\nline two",
+	}))
+	if !strings.Contains(contents, "To: me@gobox.testBcc: everyone@gobox.test\r\n") {
+		t.Error("Line breaks in headers should be removed")
+	}
+	if !strings.HasSuffix(contents, "\r\n\r\nline one\r\nline two") {
+		t.Error("The body should follow the headers with CRLF line endings")
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobox-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mailer := &LogMailer{Dir: dir}
+	err = mailer.Send(Message{To: "me@gobox.test", Subject: "Hello", Body: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*-me@gobox.test.eml"))
+	if len(files) != 1 {
+		t.Fatal("LogMailer should write a file per message")
+	}
+	contents, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(contents), "From: "+defaultFrom) ||
+		!strings.HasSuffix(string(contents), "hi") {
+		t.Error("Written message is wrong")
+	}
+}
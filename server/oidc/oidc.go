@@ -0,0 +1,310 @@
+// Package oidc signs users in with an OpenID Connect identity provider,
+// using the authorization code flow with PKCE.
+//
+// Only what gobox needs is implemented: discovery, the code exchange, and
+// verifying RS256 signed ID tokens against the provider's published keys.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is how far the provider's clock may be off from ours.
+const clockSkew = time.Minute
+
+var (
+	ErrInvalidToken = errors.New("oidc: invalid id token")
+	ErrUnknownKey   = errors.New("oidc: id token signed with an unknown key")
+)
+
+// Provider is an identity provider gobox is registered with as a client.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, gobox's
+	// callback url.
+	RedirectURL string
+	Client      *http.Client
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+// Claims are the parts of an ID token gobox uses.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+// NewProvider looks up the provider's endpoints from its discovery
+// document.
+func NewProvider(issuer, clientID, clientSecret, redirectURL string) (
+	*Provider, error) {
+	p := &Provider{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Client:       http.DefaultClient,
+	}
+	var discovery struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery is for issuer %s", discovery.Issuer)
+	}
+	if discovery.AuthURL == "" || discovery.TokenURL == "" || discovery.JWKSURL == "" {
+		return nil, errors.New("oidc: discovery is missing endpoints")
+	}
+	p.authURL = discovery.AuthURL
+	p.tokenURL = discovery.TokenURL
+	p.jwksURL = discovery.JWKSURL
+	return p, nil
+}
+
+// NewFromEnv returns the provider set by GOBOX_OIDC_ISSUER,
+// GOBOX_OIDC_CLIENT_ID, GOBOX_OIDC_CLIENT_SECRET and
+// GOBOX_OIDC_REDIRECT_URL, or nil if there's no issuer.
+func NewFromEnv() (*Provider, error) {
+	issuer := os.Getenv("GOBOX_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	return NewProvider(issuer, os.Getenv("GOBOX_OIDC_CLIENT_ID"),
+		os.Getenv("GOBOX_OIDC_CLIENT_SECRET"), os.Getenv("GOBOX_OIDC_REDIRECT_URL"))
+}
+
+// NewRandom returns a random value for a state, nonce or code verifier.
+func NewRandom() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL is where to send the user to sign in. verifier has to be
+// passed to Exchange with the code the provider returns.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.authURL, "?") {
+		separator = "&"
+	}
+	return p.authURL + separator + values.Encode()
+}
+
+// Exchange trades an authorization code for the user's verified claims.
+func (p *Provider) Exchange(code, verifier, nonce string) (claims Claims,
+	err error) {
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("oidc: token endpoint returned %s: %s", resp.Status, contents)
+		return
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.Unmarshal(contents, &token)
+	if err != nil {
+		return
+	}
+	return p.Verify(token.IDToken, nonce)
+}
+
+// Verify checks rawIDToken's signature, that it was issued by the
+// provider for gobox, that it hasn't expired and that it carries nonce.
+func (p *Provider) Verify(rawIDToken, nonce string) (claims Claims, err error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = decodeSegment(parts[0], &header)
+	if err != nil || header.Alg != "RS256" {
+		return claims, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer,
+		!claims.Audience.contains(p.ClientID),
+		now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)),
+		now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)),
+		claims.Nonce != nonce,
+		claims.Subject == "":
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// key returns the provider's signing key with id kid, fetching the keys
+// again if it's one we haven't seen, since providers rotate them.
+func (p *Provider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err := p.getJSON(p.jwksURL, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (p *Provider) getJSON(url string, v interface{}) error {
+	resp, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+	return err
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, value := range a {
+		if value == clientID {
+			return true
+		}
+	}
+	return false
+}
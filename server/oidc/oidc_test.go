@@ -0,0 +1,107 @@
+package oidc
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golangbox/gobox/server/oidc/oidctest"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp := oidctest.NewIdP("gobox", "secret")
+	defer idp.Close()
+	idp.SignIn(oidctest.User{Subject: "123", Email: "me@gobox.test", EmailVerified: true})
+	provider, err := NewProvider(idp.URL, "gobox", "secret", "http://gobox.test/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := NewRandom()
+	nonce, _ := NewRandom()
+	verifier, _ := NewRandom()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(provider.AuthCodeURL(state, nonce, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Query().Get("state") != state {
+		t.Fatal("IdP should redirect back with the state")
+	}
+	code := callback.Query().Get("code")
+
+	_, err = provider.Exchange(code, "wrong verifier", nonce)
+	if err == nil {
+		t.Error("Exchange should need the code verifier")
+	}
+	resp, _ = client.Get(provider.AuthCodeURL(state, nonce, verifier))
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+	claims, err := provider.Exchange(callback.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "123" || claims.Email != "me@gobox.test" || !claims.EmailVerified {
+		t.Error("Exchange returned the wrong claims")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	idp := oidctest.NewIdP("gobox", "secret")
+	defer idp.Close()
+	provider, err := NewProvider(idp.URL, "gobox", "secret", "http://gobox.test/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := oidctest.User{Subject: "123", Email: "me@gobox.test"}
+
+	_, err = provider.Verify(idp.IDToken(idp.Claims(user, "nonce")), "nonce")
+	if err != nil {
+		t.Error("A valid token should verify")
+	}
+	claims := idp.Claims(user, "nonce")
+	claims["aud"] = []string{"other", "gobox"}
+	_, err = provider.Verify(idp.IDToken(claims), "nonce")
+	if err != nil {
+		t.Error("A list audience including gobox should verify")
+	}
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"another audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"another issuer":   func(c map[string]interface{}) { c["iss"] = "http://evil.test" },
+		"an expired token": func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		},
+		"a future token": func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(time.Hour).Unix()
+		},
+		"another nonce": func(c map[string]interface{}) { c["nonce"] = "other" },
+	} {
+		claims := idp.Claims(user, "nonce")
+		change(claims)
+		_, err = provider.Verify(idp.IDToken(claims), "nonce")
+		if err != ErrInvalidToken {
+			t.Errorf("A token with %s shouldn't verify", name)
+		}
+	}
+
+	token := idp.IDToken(idp.Claims(user, "nonce"))
+	tampered := token[:len(token)-4] + "AAAA"
+	if _, err = provider.Verify(tampered, "nonce"); err != ErrInvalidToken {
+		t.Error("A token with a bad signature shouldn't verify")
+	}
+	other := oidctest.NewIdP("gobox", "secret")
+	defer other.Close()
+	claims = other.Claims(user, "nonce")
+	claims["iss"] = idp.URL
+	if _, err = provider.Verify(other.IDToken(claims), "nonce"); err != ErrInvalidToken {
+		t.Error("A token signed by another key shouldn't verify")
+	}
+}
@@ -0,0 +1,187 @@
+// Package oidctest runs a mock OpenID Connect identity provider for
+// tests. It signs in whichever user it is told to without asking.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const keyId = "test-key"
+
+// User is who the IdP signs in.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type IdP struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   User
+	grants map[string]grant
+}
+
+type grant struct {
+	user        User
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func NewIdP(clientID, clientSecret string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	idp := &IdP{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		grants:       make(map[string]grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", idp.jwks)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// SignIn sets who the IdP signs in from now on.
+func (idp *IdP) SignIn(user User) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.user = user
+}
+
+// IDToken signs claims with the IdP's key.
+func (idp *IdP) IDToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyId})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Claims returns valid claims for user, as the IdP would put in an ID
+// token.
+func (idp *IdP) Claims(user User, nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            idp.URL,
+		"sub":            user.Subject,
+		"aud":            idp.ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *IdP) authorize(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("client_id") != idp.ClientID ||
+		query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	idp.mu.Lock()
+	idp.grants[code] = grant{
+		user:        idp.user,
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		redirectURI: query.Get("redirect_uri"),
+	}
+	idp.mu.Unlock()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (idp *IdP) token(w http.ResponseWriter, req *http.Request) {
+	clientID, secret, _ := req.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	secret, _ = url.QueryUnescape(secret)
+	if clientID != idp.ClientID || secret != idp.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	code := req.FormValue("code")
+	idp.mu.Lock()
+	g, ok := idp.grants[code]
+	delete(idp.grants, code)
+	idp.mu.Unlock()
+	challenge := sha256.Sum256([]byte(req.FormValue("code_verifier")))
+	if !ok || req.FormValue("redirect_uri") != g.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idp.IDToken(idp.Claims(g.user, g.nonce)),
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, req *http.Request) {
+	public := idp.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -1,36 +1,151 @@
 package s3
 
 import (
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golangbox/goamz/aws"
 	"github.com/golangbox/goamz/s3"
+	"github.com/golangbox/gobox/server/blobstore"
 )
 
-var client *s3.S3
-var bucket *s3.Bucket
+const (
+	defaultRegion = "us-west-2"
+	defaultBucket = "gobox"
+	listPageSize  = 1000
+)
+
+// Store is a blobstore.BlobStore backed by a single S3 bucket.
+type Store struct {
+	bucket *s3.Bucket
+}
+
+func New(auth aws.Auth, region aws.Region, bucketName string) *Store {
+	client := s3.New(auth, region)
+	return &Store{bucket: client.Bucket(bucketName)}
+}
 
-func init() {
+// NewFromEnv builds a Store from GOBOX_AWS_ACCESS_KEY_ID,
+// GOBOX_AWS_SECRET_ACCESS_KEY and the optional GOBOX_S3_REGION and
+// GOBOX_S3_BUCKET.
+func NewFromEnv() *Store {
+	bucket := os.Getenv("GOBOX_S3_BUCKET")
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	return NewFromEnvWithBucket(bucket)
+}
+
+// NewFromEnvWithBucket is NewFromEnv for another bucket with the same
+// credentials, such as the one the cold tier is kept in.
+func NewFromEnvWithBucket(bucket string) *Store {
 	key := os.Getenv("GOBOX_AWS_ACCESS_KEY_ID")
 	secret := os.Getenv("GOBOX_AWS_SECRET_ACCESS_KEY")
 	auth := aws.Auth{AccessKey: key, SecretKey: secret}
-	client = s3.New(auth, aws.Regions["us-west-2"])
-	bucket = client.Bucket("gobox")
+	region := os.Getenv("GOBOX_S3_REGION")
+	if region == "" {
+		region = defaultRegion
+	}
+	return New(auth, aws.Regions[region], bucket)
 }
 
-func TestKeyExistence(hash string) (exists bool, err error) {
-	// this is expensive, both in terms of time and $
-	// maybe store the s3 values in a db?
-	exists, err = bucket.Exists(hash)
+func (s *Store) Name() string {
+	return "s3"
+}
+
+// Exists asks S3 directly, which is slow and costs a request. The api
+// server goes by the blob index instead.
+func (s *Store) Exists(hash string) (exists bool, err error) {
+	exists, err = s.bucket.Exists(hash)
 	return exists, err
 }
 
-func GenerateSignedUrl(hash string) (url string, err error) {
-	return bucket.SignedURL(hash, time.Now().Add(time.Duration(time.Minute*10)))
+func (s *Store) SignedURL(hash string, expires time.Duration) (url string, err error) {
+	return s.bucket.SignedURL(hash, time.Now().Add(expires))
 }
 
-func UploadFile(hash string, fileBody []byte) error {
+func (s *Store) Put(hash string, r io.Reader, size int64) error {
 	var options s3.Options
-	return bucket.Put(hash, fileBody, "", s3.PublicRead, options)
+	return s.bucket.PutReader(hash, r, size, "", s3.Private, options)
+}
+
+func (s *Store) Get(hash string) (io.ReadCloser, error) {
+	exists, err := s.bucket.Exists(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, blobstore.ErrNotFound
+	}
+	return s.bucket.GetReader(hash)
+}
+
+func (s *Store) GetRange(hash string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// there's no way to ask S3 for an empty range
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	byteRange := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := s.bucket.GetResponseWithHeaders(hash, map[string][]string{
+		"Range": {byteRange},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, blobstore.ErrNotFound
+	}
+	return resp.Body, nil
+}
+
+func (s *Store) Stat(hash string) (object blobstore.Object, err error) {
+	resp, err := s.bucket.Head(hash, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return object, blobstore.ErrNotFound
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return blobstore.Object{
+		Key:          hash,
+		Size:         resp.ContentLength,
+		LastModified: modified,
+	}, nil
+}
+
+func (s *Store) Delete(hash string) error {
+	return s.bucket.Del(hash)
+}
+
+func (s *Store) List(prefix string) (objects []blobstore.Object, err error) {
+	marker := ""
+	for {
+		resp, err := s.bucket.List(prefix, "", marker, listPageSize)
+		if err != nil {
+			return objects, err
+		}
+		for _, key := range resp.Contents {
+			modified, _ := time.Parse(time.RFC3339, key.LastModified)
+			objects = append(objects, blobstore.Object{
+				Key:          key.Key,
+				Size:         key.Size,
+				LastModified: modified,
+			})
+			marker = key.Key
+		}
+		if !resp.IsTruncated {
+			return objects, nil
+		}
+	}
 }
@@ -1,9 +1,12 @@
 package s3
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -11,18 +14,20 @@ const (
 	validS3KeyContent = "asdfasdfasdfasldkjfhalskdjhfalsjkdhflaksjdhflasjkdfha\ndsfa\nsdfhlasjdhflaskjdhflasjhdflkjh"
 )
 
-func TestTestKeyExistence(t *testing.T) {
+var store = NewFromEnv()
+
+func TestExists(t *testing.T) {
 	var exists bool
 	var err error
 
-	exists, err = TestKeyExistence(validS3Key)
+	exists, err = store.Exists(validS3Key)
 	if exists != true {
 		t.Fail()
 	}
 	if err != nil {
 		t.Error(err)
 	}
-	exists, err = TestKeyExistence("notvalid")
+	exists, err = store.Exists("notvalid")
 	if exists == true {
 		t.Fail()
 	}
@@ -31,9 +36,9 @@ func TestTestKeyExistence(t *testing.T) {
 	}
 }
 
-func TestGenerateSignedUrl(t *testing.T) {
+func TestSignedURL(t *testing.T) {
 
-	url, err := GenerateSignedUrl(validS3Key)
+	url, err := store.SignedURL(validS3Key, time.Minute*10)
 	_ = url
 	if err != nil {
 		t.Error(err)
@@ -46,14 +51,19 @@ func TestGenerateSignedUrl(t *testing.T) {
 	}
 }
 
-func TestFileUpload(t *testing.T) {
+func TestPut(t *testing.T) {
 	testString := "file thing"
 	file := []byte(testString)
-	err := UploadFile("test2", file)
+	err := store.Put("test2", bytes.NewReader(file), int64(len(file)))
 	if err != nil {
 		t.Error(err)
 	}
-	getByte, err := bucket.Get("test2")
+	r, err := store.Get("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	getByte, err := ioutil.ReadAll(r)
 	if err != nil {
 		t.Error(err)
 	}
@@ -61,3 +71,26 @@ func TestFileUpload(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDeleteAndList(t *testing.T) {
+	contents := "to be deleted"
+	err := store.Put("test3", strings.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Error(err)
+	}
+	objects, err := store.List("test3")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(objects) != 1 || objects[0].Size != int64(len(contents)) {
+		t.Fail()
+	}
+	err = store.Delete("test3")
+	if err != nil {
+		t.Error(err)
+	}
+	exists, err := store.Exists("test3")
+	if exists || err != nil {
+		t.Fail()
+	}
+}
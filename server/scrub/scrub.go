@@ -0,0 +1,121 @@
+// Package scrub reads stored blobs back and checks them against their
+// hash, to catch bit rot and objects that were only partly written.
+//
+// A blob that fails the check is flagged in the blob index. The index then
+// counts it as not held, so the next upload of it replaces the bad copy,
+// and clients whose files contain it are asked to send it again.
+package scrub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+type Options struct {
+	// Limit is the most blobs checked in one run, 0 checks them all.
+	Limit int
+	// MinAge skips blobs checked more recently than this.
+	MinAge time.Duration
+}
+
+type Report struct {
+	Checked int
+	// Corrupt are blobs whose contents don't hash to their key.
+	Corrupt []string
+	// Missing are indexed blobs the store doesn't have.
+	Missing []string
+	// Healed are blobs flagged earlier that check out now.
+	Healed []string
+}
+
+func (r Report) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := fmt.Fprintf(w,
+		"checked %d blobs: %d corrupt, %d missing, %d healed\n",
+		r.Checked, len(r.Corrupt), len(r.Missing), len(r.Healed),
+	)
+	return int64(written), err
+}
+
+// Damaged reports whether the run found any new damage.
+func (r Report) Damaged() bool {
+	return len(r.Corrupt) != 0 || len(r.Missing) != 0
+}
+
+// Scrub checks the blobs that went longest without a check, oldest first.
+// Blobs in a cold tier are skipped, reading them would move them back to
+// the hot one.
+func Scrub(store blobstore.BlobStore, options Options) (report Report, err error) {
+	var blobs []structs.Blob
+	query := model.DB.
+		Where("scrubbed_at < ?", time.Now().Add(-options.MinAge)).
+		Where("tier <> ?", blobstore.TierCold).
+		Order("scrubbed_at")
+	if options.Limit > 0 {
+		query = query.Limit(options.Limit)
+	}
+	query = query.Find(&blobs)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return report, query.Error
+	}
+
+	for _, blob := range blobs {
+		var damage string
+		damage, err = Check(store, blob)
+		if err != nil {
+			return
+		}
+		report.Checked++
+		switch {
+		case damage == structs.BlobCorrupt && blob.Damage == "":
+			report.Corrupt = append(report.Corrupt, blob.Hash)
+		case damage == structs.BlobMissing && blob.Damage == "":
+			report.Missing = append(report.Missing, blob.Hash)
+		case damage == "" && blob.Damage != "":
+			report.Healed = append(report.Healed, blob.Hash)
+		}
+		err = blobindex.Flag(blob, damage)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Check reads blob back from store. It returns the kind of damage found,
+// or an empty string if the blob is intact. err is only set if the check
+// itself couldn't be done.
+func Check(store blobstore.BlobStore, blob structs.Blob) (damage string, err error) {
+	r, err := store.Get(blob.Hash)
+	if err == blobstore.ErrNotFound {
+		return structs.BlobMissing, nil
+	}
+	if blobstore.IsCorrupt(err) {
+		return structs.BlobCorrupt, nil
+	}
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if blobstore.IsCorrupt(err) {
+		return structs.BlobCorrupt, nil
+	}
+	if err != nil {
+		return
+	}
+	if size != blob.Size || hex.EncodeToString(h.Sum(nil)) != blob.Hash {
+		return structs.BlobCorrupt, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,91 @@
+package scrub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	var err error
+
+	model.DB, err = gorm.Open("postgres", "dbname=goboxtest sslmode=disable")
+
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.AutoMigrate(&structs.Block{}, &structs.Blob{})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	store := blobstore.NewMemoryStore()
+	good := putChecked(t, store, "intact")
+	corrupt := putChecked(t, store, "soon to rot")
+	store.Put(corrupt, strings.NewReader("rotten"), 6)
+	missing := putChecked(t, store, "soon to vanish")
+	store.Delete(missing)
+
+	report, err := Scrub(store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 {
+		t.Errorf("Expected 3 blobs checked, got %d", report.Checked)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt {
+		t.Error("Corrupt blob wasn't found")
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != missing {
+		t.Error("Missing blob wasn't found")
+	}
+
+	missingHashes, _ := blobindex.Missing([]string{good, corrupt, missing})
+	if len(missingHashes) != 2 {
+		t.Error("Damaged blobs should count as not held")
+	}
+	damaged, _ := blobindex.Damaged()
+	if len(damaged) != 2 {
+		t.Error("Damaged blobs should be flagged")
+	}
+
+	// everything was just checked
+	report, _ = Scrub(store, Options{MinAge: time.Hour})
+	if report.Checked != 0 {
+		t.Error("Recently checked blobs should be skipped")
+	}
+
+	// a good copy gets uploaded again
+	store.Put(corrupt, strings.NewReader("soon to rot"), 11)
+	report, _ = Scrub(store, Options{})
+	if len(report.Healed) != 1 || report.Healed[0] != corrupt {
+		t.Error("Repaired blob should be reported as healed")
+	}
+}
+
+// putChecked stores contents under its hash and indexes it.
+func putChecked(t *testing.T, store blobstore.BlobStore, contents string) string {
+	h := sha256.Sum256([]byte(contents))
+	hash := hex.EncodeToString(h[:])
+	err := store.Put(hash, strings.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blobindex.Record(store, hash, int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -1,12 +1,39 @@
 package server
 
 import (
+	"crypto/rand"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/golangbox/gobox/UDPush"
-	"github.com/golangbox/gobox/boxtools"
 	"github.com/golangbox/gobox/server/api"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/gc"
+	"github.com/golangbox/gobox/server/keys"
+	"github.com/golangbox/gobox/server/mail"
+	"github.com/golangbox/gobox/server/oidc"
+	"github.com/golangbox/gobox/server/s3"
+	"github.com/golangbox/gobox/server/scrub"
+	"github.com/golangbox/gobox/server/tiering"
+)
+
+const (
+	defaultBlobStoreDir     = "gobox-blobs"
+	defaultColdBlobStoreDir = "gobox-blobs-cold"
+	defaultColdBucket       = "gobox-cold"
+	defaultPublicURL        = "http://127.0.0.1:8000"
+
+	uploadSessionCheckInterval = time.Hour
+	uploadSessionMaxAge        = time.Hour * 24
+
+	// every scrub checks this many blobs, skipping ones checked in the
+	// last week
+	scrubBatchSize = 1000
+	scrubMinAge    = time.Hour * 24 * 7
 )
 
 type services struct {
@@ -34,13 +61,160 @@ func (s *server) checkStatus() bool {
 	return false
 }
 
-func createDummyUser() error {
-	user, err := boxtools.NewUser("gobox@gmail.com", "password")
+// NewBlobStoreFromEnv picks the storage backend named by GOBOX_BLOBSTORE.
+// "s3" is the default, "memory" keeps everything in process and needs no
+// credentials at all, and "disk" stores blobs under GOBOX_BLOBSTORE_DIR and
+// serves them from the api server. Setting GOBOX_COLD_BLOBSTORE adds a
+// cold tier, another backend that rarely read blobs are moved to. Setting
+// GOBOX_MASTER_KEY_FILE encrypts blobs, and GOBOX_COMPRESS compresses blobs
+// that are worth it, on top of any of them.
+func NewBlobStoreFromEnv() (store blobstore.BlobStore, err error) {
+	dir := os.Getenv("GOBOX_BLOBSTORE_DIR")
+	if dir == "" {
+		dir = defaultBlobStoreDir
+	}
+	store, err = newBackend(os.Getenv("GOBOX_BLOBSTORE"), dir, s3.NewFromEnv)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if backend := os.Getenv("GOBOX_COLD_BLOBSTORE"); backend != "" {
+		dir := os.Getenv("GOBOX_COLD_BLOBSTORE_DIR")
+		if dir == "" {
+			dir = defaultColdBlobStoreDir
+		}
+		cold, err := newBackend(backend, dir, func() *s3.Store {
+			bucket := os.Getenv("GOBOX_COLD_S3_BUCKET")
+			if bucket == "" {
+				bucket = defaultColdBucket
+			}
+			return s3.NewFromEnvWithBucket(bucket)
+		})
+		if err != nil {
+			return nil, err
+		}
+		store = blobstore.NewTieredStore(store, cold, blobindex.Tracker{})
+	}
+	if path := os.Getenv("GOBOX_MASTER_KEY_FILE"); path != "" {
+		ring, err := keys.NewRingFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := newURLSignerFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		store = blobstore.NewEncryptedStore(store, ring, signer)
+	}
+	// compress before encrypting, encrypted blobs don't compress
+	if os.Getenv("GOBOX_COMPRESS") != "" {
+		signer, err := newURLSignerFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		store = blobstore.NewCompressedStore(store, signer)
+	}
+	return store, nil
+}
+
+// newBackend makes the blob store backend called name. Disk stores keep
+// blobs in dir, and S3 stores are made by newS3.
+func newBackend(name string, dir string, newS3 func() *s3.Store) (
+	store blobstore.BlobStore, err error) {
+	switch name {
+	case "", "s3":
+		return newS3(), nil
+	case "memory":
+		return blobstore.NewMemoryStore(), nil
+	case "disk":
+		signer, err := newURLSignerFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return blobstore.NewDiskStore(dir, signer)
+	}
+	return nil, fmt.Errorf("Unknown blob store backend: %s", name)
+}
+
+// newURLSignerFromEnv signs /blobs/ urls with GOBOX_BLOB_SECRET. Without a
+// secret a random one is used, so urls handed out before a restart stop
+// working.
+func newURLSignerFromEnv() (signer *blobstore.URLSigner, err error) {
+	secret := []byte(os.Getenv("GOBOX_BLOB_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return
+		}
+	}
+	baseURL := os.Getenv("GOBOX_PUBLIC_URL")
+	if baseURL == "" {
+		baseURL = defaultPublicURL
+	}
+	return &blobstore.URLSigner{BaseURL: baseURL, Secret: secret}, nil
+}
+
+// collectGarbage runs blob garbage collection every interval, purging
+// files that have been in the trash longer than trashRetention.
+func collectGarbage(store blobstore.BlobStore, interval time.Duration,
+	trashRetention time.Duration) {
+	for range time.Tick(interval) {
+		report, err := gc.Collect(store, gc.Options{
+			GracePeriod:      gc.DefaultGracePeriod,
+			VersionRetention: gc.DefaultVersionRetention,
+			TrashRetention:   trashRetention,
+		})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		report.WriteTo(os.Stdout)
+	}
+}
+
+// scrubBlobs checks a batch of blobs every interval, and has clients
+// check for reupload requests when it finds damage.
+func scrubBlobs(store blobstore.BlobStore, pusher *UDPush.Pusher,
+	interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := scrub.Scrub(store, scrub.Options{
+			Limit:  scrubBatchSize,
+			MinAge: scrubMinAge,
+		})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		report.WriteTo(os.Stdout)
+		if report.Damaged() {
+			pusher.Notify("")
+		}
+	}
+}
+
+// tierBlobs moves blobs to the cold tier of store every interval.
+func tierBlobs(store *blobstore.TieredStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		report, err := tiering.Apply(store, tiering.Policy{
+			IdleAfter:        tiering.DefaultIdleAfter,
+			OldVersionsAfter: tiering.DefaultOldVersionsAfter,
+		})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		report.WriteTo(os.Stdout)
+	}
+}
+
+// expireUploadSessions clears out uploads that were abandoned part way.
+func expireUploadSessions() {
+	for range time.Tick(uploadSessionCheckInterval) {
+		err := api.ExpireUploadSessions(uploadSessionMaxAge)
+		if err != nil {
+			log.Println(err)
+		}
 	}
-	_ = user
-	return nil
 }
 
 //Run creates all the structures to make or project work
@@ -65,12 +239,69 @@ func Run() {
 	// 	&structs.FileAction{},
 	// 	&structs.File{},
 	// 	&structs.FileSystemFile{},
+	// 	&structs.Block{},
+	// 	&structs.UploadSession{},
+	// 	&structs.GCCandidate{},
+	// 	&structs.Blob{},
+	// 	&structs.DataKey{},
+	// 	&structs.EmailToken{},
+	// 	&structs.Namespace{},
+	// 	&structs.NamespaceMember{},
+	// 	&structs.ShareLink{},
+	// 	&structs.TrashedFile{},
 	// )
 
-	err := createDummyUser()
+	store, err := NewBlobStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if dir := os.Getenv("GOBOX_UPLOAD_DIR"); dir != "" {
+		api.UploadDirectory = dir
+	}
+	if size := os.Getenv("GOBOX_MAX_UPLOAD_SIZE"); size != "" {
+		api.MaxUploadSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if baseURL := os.Getenv("GOBOX_PUBLIC_URL"); baseURL != "" {
+		api.BaseURL = baseURL
+	}
+	api.Mailer, err = mail.NewFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
+	api.SSO, err = oidc.NewFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go expireUploadSessions()
+	if interval := os.Getenv("GOBOX_GC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		trashRetention := gc.DefaultTrashRetention
+		if retention := os.Getenv("GOBOX_TRASH_RETENTION"); retention != "" {
+			trashRetention, err = time.ParseDuration(retention)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		go collectGarbage(store, d, trashRetention)
+	}
+	if interval := os.Getenv("GOBOX_TIER_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tiered := blobstore.FindTiered(store)
+		if tiered == nil {
+			log.Fatal("GOBOX_TIER_INTERVAL needs GOBOX_COLD_BLOBSTORE")
+		}
+		go tierBlobs(tiered, d)
+	}
 	////Launch UDP notification service
 	////Define the Subject (The guy who is goin to hold all the clients)
 
@@ -79,11 +310,19 @@ func Run() {
 		BindedTo: s.port,
 	}
 
+	if interval := os.Getenv("GOBOX_SCRUB_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go scrubBlobs(store, pusher, d)
+	}
+
 	go func() {
 		err = pusher.InitUDPush()
 		if err != nil {
 			fmt.Println(err)
 		}
 	}()
-	api.ServeServerRoutes("8000", pusher)
+	api.ServeServerRoutes("8000", pusher, store)
 }
@@ -0,0 +1,117 @@
+// Package tiering moves blobs that are rarely needed from the hot tier of
+// a blobstore.TieredStore to the cold one. Moving them back is up to the
+// store, which does it as soon as one is read.
+package tiering
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/gc"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	DefaultIdleAfter        = time.Hour * 24 * 90
+	DefaultOldVersionsAfter = time.Hour * 24 * 7
+)
+
+type Policy struct {
+	// IdleAfter moves blobs nothing has read for this long. 0 turns it
+	// off.
+	IdleAfter time.Duration
+	// OldVersionsAfter moves blobs that only old versions of files are
+	// made of, once nothing has read them for this long. 0 turns it off.
+	OldVersionsAfter time.Duration
+	// Limit is the most blobs moved in one run, 0 moves them all.
+	Limit int
+	// DryRun reports what would be moved without moving anything.
+	DryRun bool
+}
+
+type Report struct {
+	Checked int
+	// Idle are blobs moved because nothing read them.
+	Idle []string
+	// OldVersions are blobs moved because only old versions need them.
+	OldVersions []string
+	BytesMoved  int64
+}
+
+func (r Report) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := fmt.Fprintf(w,
+		"checked %d blobs: moved %d idle and %d old versions to the cold tier, %d bytes\n",
+		r.Checked, len(r.Idle), len(r.OldVersions), r.BytesMoved,
+	)
+	return int64(written), err
+}
+
+// Apply moves the blobs in store's hot tier that policy says belong in the
+// cold tier, least recently read first.
+func Apply(store *blobstore.TieredStore, policy Policy) (report Report, err error) {
+	cutoff := policy.IdleAfter
+	if policy.OldVersionsAfter > 0 &&
+		(cutoff == 0 || policy.OldVersionsAfter < cutoff) {
+		cutoff = policy.OldVersionsAfter
+	}
+	if cutoff == 0 {
+		return
+	}
+	now := time.Now()
+
+	live, err := gc.LiveHashes()
+	if err != nil {
+		return
+	}
+	var blobs []structs.Blob
+	query := model.DB.
+		Where("tier <> ?", blobstore.TierCold).
+		Where("damage = ?", "").
+		Where("accessed_at < ?", now.Add(-cutoff)).
+		Order("accessed_at").
+		Find(&blobs)
+	if query.Error != nil && query.Error != gorm.RecordNotFound {
+		return report, query.Error
+	}
+
+	for _, blob := range blobs {
+		if policy.Limit > 0 && len(report.Idle)+len(report.OldVersions) >= policy.Limit {
+			break
+		}
+		report.Checked++
+		accessed := blob.AccessedAt
+		if accessed.Before(blob.StoredAt) {
+			// indexed before accesses were tracked
+			accessed = blob.StoredAt
+		}
+		idle := now.Sub(accessed)
+		var moved *[]string
+		switch {
+		case policy.IdleAfter > 0 && idle > policy.IdleAfter:
+			moved = &report.Idle
+		case policy.OldVersionsAfter > 0 && idle > policy.OldVersionsAfter &&
+			!live[blob.Hash]:
+			moved = &report.OldVersions
+		default:
+			continue
+		}
+		if !policy.DryRun {
+			err = store.Demote(blob.Hash)
+			if err == blobstore.ErrNotFound {
+				// gone from the store, reconcile deals with that
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+		*moved = append(*moved, blob.Hash)
+		report.BytesMoved += blob.StoredSize
+	}
+	return
+}
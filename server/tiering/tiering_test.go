@@ -0,0 +1,154 @@
+package tiering
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golangbox/gobox/boxtools"
+	"github.com/golangbox/gobox/server/blobindex"
+	"github.com/golangbox/gobox/server/blobstore"
+	"github.com/golangbox/gobox/server/model"
+	"github.com/golangbox/gobox/structs"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+)
+
+var user structs.User
+var client structs.Client
+
+func init() {
+	var err error
+
+	model.DB, err = gorm.Open("postgres", "dbname=goboxtest sslmode=disable")
+
+	model.DB.DropTableIfExists(&structs.User{})
+	model.DB.DropTableIfExists(&structs.Client{})
+	model.DB.DropTableIfExists(&structs.FileAction{})
+	model.DB.DropTableIfExists(&structs.File{})
+	model.DB.DropTableIfExists(&structs.FileSystemFile{})
+	model.DB.DropTableIfExists(&structs.Block{})
+	model.DB.DropTableIfExists(&structs.Blob{})
+	model.DB.DropTableIfExists(&structs.TrashedFile{})
+	model.DB.AutoMigrate(&structs.User{}, &structs.Client{}, &structs.FileAction{}, &structs.File{}, &structs.FileSystemFile{}, &structs.Block{}, &structs.Blob{}, &structs.TrashedFile{})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	user, _ = boxtools.NewUser("tiering@gobox.test", "password")
+	client, err = boxtools.NewClient(user, "test", false)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// putFile stores a blob, makes it the contents of path and marks it as
+// last read idle ago. Files that aren't live are deleted again.
+func putFile(t *testing.T, store blobstore.BlobStore, path string,
+	isLive bool, idle time.Duration) string {
+	hash, err := boxtools.GenerateRandomSha256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(hash, strings.NewReader(hash), int64(len(hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blobindex.Record(store, hash, int64(len(hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := structs.File{Path: path, Hash: hash, Size: int64(len(hash))}
+	applyFileAction(t, structs.FileAction{IsCreate: true, File: file})
+	if !isLive {
+		applyFileAction(t, structs.FileAction{IsCreate: false, File: file})
+	}
+	model.DB.Exec("UPDATE blobs SET accessed_at = ?, stored_at = ? WHERE hash = ?",
+		time.Now().Add(-idle), time.Now().Add(-idle), hash)
+	return hash
+}
+
+func applyFileAction(t *testing.T, fileAction structs.FileAction) {
+	fileActions, err := boxtools.WriteFileActionsToDatabase(
+		[]structs.FileAction{fileAction}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := boxtools.ApplyFileActionsToFileSystemFileTable(fileActions, user)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+func TestApply(t *testing.T) {
+	hot := blobstore.NewMemoryStore()
+	cold := blobstore.NewMemoryStore()
+	store := blobstore.NewTieredStore(hot, cold, blobindex.Tracker{})
+
+	day := time.Hour * 24
+	fresh := putFile(t, store, "/fresh", true, 0)
+	idle := putFile(t, store, "/idle", true, 100*day)
+	oldVersion := putFile(t, store, "/old", false, 10*day)
+	recentOldVersion := putFile(t, store, "/recent", false, day)
+
+	policy := Policy{
+		IdleAfter:        DefaultIdleAfter,
+		OldVersionsAfter: DefaultOldVersionsAfter,
+		DryRun:           true,
+	}
+	report, err := Apply(store, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Idle) != 1 || len(report.OldVersions) != 1 {
+		t.Fatal("Dry run should report an idle blob and an old version")
+	}
+	if exists, _ := cold.Exists(idle); exists {
+		t.Error("Dry run shouldn't move anything")
+	}
+
+	policy.DryRun = false
+	report, err = Apply(store, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Idle) != 1 || report.Idle[0] != idle {
+		t.Error("Blob nobody read should have been moved")
+	}
+	if len(report.OldVersions) != 1 || report.OldVersions[0] != oldVersion {
+		t.Error("Blob only an old version needs should have been moved")
+	}
+	for _, hash := range []string{idle, oldVersion} {
+		if exists, _ := cold.Exists(hash); !exists {
+			t.Errorf("%s should be in the cold store", hash)
+		}
+		var blob structs.Blob
+		model.DB.Where("hash = ?", hash).First(&blob)
+		if blob.Tier != blobstore.TierCold {
+			t.Errorf("%s should be indexed as cold", hash)
+		}
+	}
+	for _, hash := range []string{fresh, recentOldVersion} {
+		if exists, _ := hot.Exists(hash); !exists {
+			t.Errorf("%s should have stayed in the hot store", hash)
+		}
+	}
+
+	report, _ = Apply(store, policy)
+	if len(report.Idle)+len(report.OldVersions) != 0 {
+		t.Error("Cold blobs shouldn't be moved again")
+	}
+
+	rc, err := store.Get(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	var blob structs.Blob
+	model.DB.Where("hash = ?", idle).First(&blob)
+	if blob.Tier != blobstore.TierHot || time.Since(blob.AccessedAt) > time.Minute {
+		t.Error("Reading a cold blob should move it back and count as an access")
+	}
+}
@@ -0,0 +1,109 @@
+// Package totp implements the time based one time passwords of RFC 6238,
+// as shown by authenticator apps: six digits from an HMAC-SHA1 of the
+// number of 30 second steps since the epoch.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Step   = 30 * time.Second
+	// Skew is how many steps either side of now a code is accepted for,
+	// to allow for clocks being slightly off.
+	Skew = 1
+
+	secretSize = 20
+)
+
+// GenerateSecret returns a new random secret, base32 encoded as apps
+// expect it.
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// URL returns the otpauth url for secret, which apps can read from a QR
+// code instead of the secret being typed in.
+func URL(secret, issuer, account string) string {
+	values := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" +
+		values.Encode()
+}
+
+// Code returns the code for secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, stepAt(t), Digits), nil
+}
+
+// Verify checks code against secret at t, and returns the step it was
+// for. Codes for steps up to and including lastStep are refused, so
+// passing the step of the last code accepted stops a code being used
+// twice.
+func Verify(secret, code string, t time.Time, lastStep int64) (step int64,
+	ok bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(key) == 0 || len(code) != Digits {
+		return 0, false
+	}
+	now := stepAt(t)
+	for step = now - Skew; step <= now+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected := hotp(key, step, Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func stepAt(t time.Time) int64 {
+	return t.Unix() / int64(Step/time.Second)
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// hotp is the HOTP of RFC 4226 for counter.
+func hotp(key []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRFCVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for seconds, expected := range vectors {
+		got := hotp(key, stepAt(time.Unix(seconds, 0)), 8)
+		if got != expected {
+			t.Errorf("Code at %d was %s, should be %s", seconds, got, expected)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1426000000, 0)
+	current, err := Code(secret, now)
+	if err != nil || len(current) != Digits {
+		t.Fatal("Couldn't generate a code")
+	}
+
+	step, ok := Verify(secret, current, now, 0)
+	if !ok || step != stepAt(now) {
+		t.Error("The current code should verify")
+	}
+	if _, ok = Verify(secret, current, now, step); ok {
+		t.Error("A code shouldn't verify twice")
+	}
+	if _, ok = Verify(secret, current, now.Add(Step), 0); !ok {
+		t.Error("The last step's code should still verify")
+	}
+	if _, ok = Verify(secret, current, now.Add(Step*(Skew+1)), 0); ok {
+		t.Error("An old code shouldn't verify")
+	}
+	if _, ok = Verify(secret, "12345", now, 0); ok {
+		t.Error("A short code shouldn't verify")
+	}
+
+	lower := strings.ToLower(strings.TrimRight(secret, "="))
+	if _, ok = Verify(lower, current, now, 0); !ok {
+		t.Error("Secrets should be accepted however they were typed")
+	}
+	if _, err = base32.StdEncoding.DecodeString(secret); err != nil {
+		t.Error("Secrets should be base32")
+	}
+}
+
+func TestURL(t *testing.T) {
+	got := URL("ABCD", "GoBox", "me@gobox.test")
+	expected := "otpauth://totp/GoBox:me@gobox.test?issuer=GoBox&secret=ABCD"
+	if got != expected {
+		t.Errorf("URL was %s", got)
+	}
+}
@@ -21,6 +21,35 @@ type CurrentAction struct {
 type ClientFileActionsResponse struct {
 	LastId      int64
 	FileActions []FileAction
+	// Reupload lists blocks the server lost or found damaged, that
+	// the client should send again if its copy is still good.
+	Reupload []ReuploadRequest
+}
+
+// ReuploadRequest points at a block of a file in the user's tree whose
+// blob needs to be uploaded again.
+type ReuploadRequest struct {
+	Path   string
+	Hash   string
+	Offset int64
+	Size   int64
+}
+
+// FileActionsResponse answers the file actions a client sends.
+type FileActionsResponse struct {
+	// Upload lists the blocks the server doesn't have yet.
+	Upload []string
+	// Rejected are actions the server refused, which the client should
+	// undo locally.
+	Rejected []RejectedFileAction
+}
+
+// RejectedFileAction is a file action the server refused, with an http
+// status code saying why.
+type RejectedFileAction struct {
+	Path   string
+	Code   int
+	Reason string
 }
 
 type ErrorMessage struct {
@@ -35,12 +64,40 @@ type FileSystemState struct {
 }
 
 type User struct {
-	Id             int64
-	Email          string `sql:"type:text;"`
+	Id    int64
+	Email string `sql:"type:text;"`
+	// EmailVerifiedAt is set once the user follows the link mailed to
+	// Email.
+	EmailVerifiedAt time.Time
+	// OIDCSubject links the user to their identity at the single sign-on
+	// provider, as the issuer and subject separated by a space.
+	OIDCSubject    string
 	HashedPassword string
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	DeletedAt      time.Time
+	// HashedRecoveryCodes holds bcrypt hashes of the user's unused
+	// recovery codes, separated by spaces.
+	HashedRecoveryCodes string `sql:"type:text;"`
+	// TOTPSecret is set on enrollment, but only asked for at login once
+	// a code has confirmed it and TOTPEnabled is set. TOTPLastStep is the
+	// step of the last code accepted, so no code works twice.
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	IsAdmin      bool
+	// E2ESalt and E2ECheck are set once a client turns on end to end
+	// encryption for the user, see E2EParams.
+	E2ESalt   string
+	E2ECheck  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt time.Time
+}
+
+// E2EParams are what every client of a user needs to agree on to read
+// each other's end to end encrypted files: the salt the key is derived
+// with, and a check value telling whether the passphrase was the same.
+type E2EParams struct {
+	Salt  string
+	Check string
 }
 
 type Client struct {
@@ -50,14 +107,172 @@ type Client struct {
 	Name                    string
 	IsServer                bool
 	LastSynchedFileActionId int64
-	CreatedAt               time.Time
-	UpdatedAt               time.Time
-	DeletedAt               time.Time
+	LastSynchedAt           time.Time
+	// SessionKey stops working at SessionExpiresAt, or once RevokedAt
+	// is set.
+	SessionExpiresAt time.Time
+	RevokedAt        time.Time
+	LastSeenAt       time.Time
+	LastSeenIP       string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	DeletedAt        time.Time
+}
+
+// Session is what signing up or logging in returns: the client created
+// for the device, and the key it authenticates with.
+type Session struct {
+	ClientId   int64
+	ClientName string
+	Email      string
+	SessionKey string
+	ExpiresAt  time.Time
+}
+
+// EmailToken is a token mailed to a user, to verify their address or to
+// reset their password. Only the sha256 of the token is kept.
+type EmailToken struct {
+	Id          int64
+	UserId      int64
+	Purpose     string
+	HashedToken string
+	ExpiresAt   time.Time
+	UsedAt      time.Time
+	CreatedAt   time.Time
+}
+
+// TrashedFile is a file deleted from a user's tree, or from a shared
+// folder if NamespaceId is set, kept until it's restored or the trash
+// retention period has passed. ClientId is the device that deleted it,
+// with the delete FileActionId.
+type TrashedFile struct {
+	Id           int64
+	UserId       int64
+	NamespaceId  int64
+	FileId       int64
+	Path         string `sql:"type:text;"`
+	ClientId     int64
+	FileActionId int64
+	TrashedAt    time.Time
+}
+
+// TrashItem is how a TrashedFile is shown to a user, at its path in their
+// tree.
+type TrashItem struct {
+	Id        int64
+	Path      string
+	Hash      string
+	Size      int64
+	TrashedAt time.Time
+	DeviceId  int64
+	Device    string
+}
+
+// TrashRestore is what restoring from the trash did, by path.
+type TrashRestore struct {
+	Restored []string
+	// Conflicts have a file at their path again, which restoring would
+	// replace, so they are left in the trash.
+	Conflicts []string
+	// Gone are files whose contents have already been collected.
+	Gone []string
+}
+
+// FileVersion is an entry in the journal of a path, as shown to a user
+// looking for an older version of a file. Device is the name of the
+// device that made the change, and Email whose device it is.
+type FileVersion struct {
+	FileActionId int64
+	IsCreate     bool
+	Hash         string
+	Size         int64
+	Modified     time.Time
+	CreatedAt    time.Time
+	DeviceId     int64
+	Device       string
+	Email        string
+	// Current is set on the version the path has now.
+	Current bool
+}
+
+// ShareLink gives anyone with its token read access to a file or folder
+// in the tree of the user who made it, or in a shared folder if
+// NamespaceId is set, in which case Path is relative to the namespace.
+// Only the sha256 of the token is kept, and a bcrypt hash of the
+// password if it has one. A zero ExpiresAt or MaxDownloads is no limit.
+type ShareLink struct {
+	Id             int64
+	UserId         int64
+	NamespaceId    int64
+	Path           string `sql:"type:text;"`
+	IsFolder       bool
+	HashedToken    string
+	HashedPassword string
+	ExpiresAt      time.Time
+	MaxDownloads   int64
+	Downloads      int64
+	RevokedAt      time.Time
+	CreatedAt      time.Time
+}
+
+// Share is how a ShareLink is shown to the user who made it. Token and
+// URL are only returned when it's created.
+type Share struct {
+	Id           int64
+	Path         string
+	IsFolder     bool
+	HasPassword  bool
+	ExpiresAt    time.Time
+	MaxDownloads int64
+	Downloads    int64
+	CreatedAt    time.Time
+	Token        string
+	URL          string
+}
+
+// ShareListing is what the page of a share link shows: the name of the
+// file or folder and, for a folder, the files in it.
+type ShareListing struct {
+	Name     string
+	IsFolder bool
+	Files    []SharedFile
 }
 
+type SharedFile struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+}
+
+// TOTPEnrollment is what a user needs to add gobox to an authenticator
+// app.
+type TOTPEnrollment struct {
+	Secret string
+	URL    string
+}
+
+// Device is how a client is shown to the user it belongs to.
+type Device struct {
+	Id                      int64
+	Name                    string
+	LastSynchedAt           time.Time
+	LastSynchedFileActionId int64
+	// Behind is how many file actions from the user's other clients the
+	// device hasn't synced yet.
+	Behind     int
+	LastSeenAt time.Time
+	LastSeenIP string
+	CreatedAt  time.Time
+	// Current is set on the device making the request.
+	Current bool
+}
+
+// FileAction is an entry in a journal: the user's own if NamespaceId is
+// 0, otherwise the shared namespace's.
 type FileAction struct {
 	Id           int64
 	ClientId     int64
+	NamespaceId  int64
 	IsCreate     bool
 	CreatedAt    time.Time
 	PreviousHash string
@@ -65,21 +280,187 @@ type FileAction struct {
 	FileId       int64
 }
 
+// File is a version of a file in the tree of the user who wrote it, or in
+// a shared namespace if NamespaceId is set, in which case Path is
+// relative to the namespace's folder.
 type File struct {
+	Id          int64
+	UserId      int64
+	NamespaceId int64
+	Name        string
+	Hash        string
+	Size        int64
+	Modified    time.Time
+	Path        string `sql:"type:text;"`
+	CreatedAt   time.Time
+	Blocks      []Block
+}
+
+// Block is one content defined chunk of a File. A file's contents are
+// its blocks concatenated in Position order, and blocks are stored and
+// transferred individually under their own hash.
+type Block struct {
+	Id       int64
+	FileId   int64
+	Position int64
+	Offset   int64
+	Hash     string
+	Size     int64
+}
+
+// UploadSession tracks a resumable upload of one blob. Parts are kept on
+// the server's disk until the session is committed.
+type UploadSession struct {
 	Id        int64
 	UserId    int64
-	Name      string
+	ClientId  int64
 	Hash      string
 	Size      int64
-	Modified  time.Time
-	Path      string `sql:"type:text;"`
+	PartSize  int64
 	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
+// UploadSessionStatus is what the server reports about an upload session,
+// ReceivedParts lists the part numbers it already has.
+type UploadSessionStatus struct {
+	Id            int64
+	Hash          string
+	Size          int64
+	PartSize      int64
+	ReceivedParts []int64
+	Complete      bool
+}
+
+// GCCandidate is a blob the garbage collector found unreferenced. It is
+// only deleted if it is still unreferenced once the grace period since
+// MarkedAt has passed.
+type GCCandidate struct {
+	Id       int64
+	Hash     string
+	MarkedAt time.Time
+}
+
+// Blob is the server's record of a blob it holds. The blobs table is what
+// the server goes by when deciding whether it already has some contents,
+// RefCount is the number of file blocks pointing at the blob. A damaged
+// blob counts as not held, so it gets uploaded again.
+type Blob struct {
+	Id       int64
+	Hash     string `sql:"unique"`
+	Size     int64
+	StoredAt time.Time
+	RefCount int64
+	Backend  string
+	// Codec is how the blob was compressed, if at all, and StoredSize
+	// what it takes up in the backend.
+	Codec      string
+	StoredSize int64
+	// ScrubbedAt is when the blob was last read back and checked, Damage
+	// is set if that check failed.
+	ScrubbedAt time.Time
+	Damage     string
+	// Tier is which tier of a tiered store the blob is in, empty if the
+	// store has no tiers. AccessedAt is when it was last read.
+	Tier       string
+	AccessedAt time.Time
+}
+
+const (
+	BlobCorrupt = "corrupt"
+	BlobMissing = "missing"
+)
+
+// DataKey is a user's key for encrypting blobs at rest. It is only ever
+// stored wrapped by the master key named by MasterKeyId.
+type DataKey struct {
+	Id          int64
+	UserId      int64
+	WrappedKey  string `sql:"type:text;"`
+	MasterKeyId string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// FileSystemFile is a file currently in a tree. Files in a shared
+// namespace belong to the namespace rather than any one user, so they have
+// a NamespaceId and no UserId.
 type FileSystemFile struct {
-	Id     int64
-	UserId int64
-	FileId int64
-	Path   string `sql:"type:text;"`
-	File   File
+	Id          int64
+	UserId      int64
+	NamespaceId int64
+	FileId      int64
+	Path        string `sql:"type:text;"`
+	File        File
+}
+
+// Namespace is a folder shared between users. Every member sees it at
+// their own Path in their tree.
+type Namespace struct {
+	Id        int64
+	Name      string
+	CreatedAt time.Time
+}
+
+// Roles a NamespaceMember can have. Only editors and the owner can change
+// files, and only the owner can change who the members are.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+type NamespaceMember struct {
+	Id          int64
+	NamespaceId int64
+	UserId      int64
+	Role        string
+	// Path is the folder the namespace appears at in the member's tree.
+	Path string `sql:"type:text;"`
+	// JoinedActionId is the newest journal entry when the member joined.
+	// Their devices get everything up to it as a snapshot of the files in
+	// the namespace, rather than its whole history.
+	JoinedActionId int64
+	CreatedAt      time.Time
+}
+
+// SharedFolder is how a namespace is shown to one of its members.
+type SharedFolder struct {
+	Id      int64
+	Name    string
+	Path    string
+	Role    string
+	Members []SharedFolderMember
+}
+
+type SharedFolderMember struct {
+	Email string
+	Role  string
+}
+
+// Snapshot is a user's tree as it was right after a journal entry.
+type Snapshot struct {
+	FileActionId int64
+	Files        []SnapshotFile
+}
+
+// SnapshotFile is a file in a Snapshot.
+type SnapshotFile struct {
+	Path     string
+	Hash     string
+	Size     int64
+	Modified time.Time
+}
+
+// SnapshotRestore is what restoring a snapshot did, by path.
+type SnapshotRestore struct {
+	// Restored are files that were missing or have changed since.
+	Restored []string
+	// Deleted are files added since, which were moved to the trash.
+	Deleted []string
+	// Gone are files whose contents have already been collected.
+	Gone []string
+	// ReadOnly are in shared folders the user can only view.
+	ReadOnly  []string
+	Unchanged int
 }